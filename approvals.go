@@ -0,0 +1,606 @@
+// Calls that must be approved by an operator before being executed.
+// Keys listed in `sparko-approval-keys` have their calls matching
+// `sparko-approval-rules` parked instead of executed. The operator is notified
+// with an `approval-required` event and can approve or deny them with the
+// `sparko-approve` and `sparko-deny` methods. Approved calls are executed as
+// async jobs, so their results are delivered in the same way.
+// Calls matching `sparko-quorum-rules` are parked regardless of the key used
+// and need signed approvals from a number of operators (see quorum.go).
+// Calls not resolved in time expire.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	lightning "github.com/fiatjaf/lightningd-gjson-rpc"
+	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
+)
+
+type ApprovalRule struct {
+	Method    string
+	Threshold int64  // in msat, 0 means every call
+	Flag      string // if set the rule only applies when this param is true
+	Quorum    int    // number of operator signatures required, 0 for quorum-less rules
+}
+
+type PendingCall struct {
+	Id         string                   `json:"id"`
+	KeyId      string                   `json:"key_id"`
+	Request    lightning.JSONRPCMessage `json:"request"`
+	Node       string                   `json:"node,omitempty"`
+	AmountMsat int64                    `json:"amount_msat,omitempty"`
+	Quorum     int                      `json:"quorum,omitempty"`
+	Approvals  []Approval               `json:"approvals,omitempty"`
+	CreatedAt  int64                    `json:"created_at"`
+	ExpiresAt  int64                    `json:"expires_at"`
+
+	// with an idempotency key the call is only parked once and is executed
+	// like other calls with the same key
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+}
+
+const DEFAULTAPPROVALEXPIRY = time.Hour * 24
+
+// DEFAULTAPPROVALRULES cover every method that moves funds or opens or closes
+// channels, including the ones that do it through other methods.
+const DEFAULTAPPROVALRULES = "pay>100000000,keysend>100000000,sendpay>100000000,xpay>100000000," +
+	"withdraw,close,closeget,closeget-batch," +
+	"fundchannel,fundchannel_start,multifundchannel,connectfund,connectfund-start,connectfund-batch," +
+	"sparko-voucher-create>100000000,sparko-nwc-create>100000000"
+
+var (
+	approvalKeys   = make(map[string]bool)
+	approvalRules  = make(map[string]ApprovalRule)
+	quorumRules    = make(map[string]ApprovalRule)
+	approvalExpiry = DEFAULTAPPROVALEXPIRY
+
+	pendingMutex sync.Mutex
+	pendingCalls = make(map[string]*PendingCall)
+)
+
+// positional params of the methods we need to read amounts and flags from.
+var positionalParams = map[string][]string{
+	"pay":                   {"bolt11", "amount_msat"},
+	"keysend":               {"destination", "amount_msat"},
+	"sendpay":               {"route", "payment_hash", "label", "amount_msat"},
+	"xpay":                  {"invstring", "amount_msat"},
+	"sparko-voucher-create": {"amount_msat", "uses"},
+	"sparko-nwc-create":     {"name", "methods", "budget_msat", "budget_period"},
+	"withdraw":              {"destination", "satoshi"},
+	"fundchannel":           {"id", "amount", "feerate"},
+	"fundchannel_start":     {"id", "amount", "feerate"},
+	"multifundchannel":      {"destinations", "feerate"},
+	"connectfund":           {"peeruri", "satoshi"},
+	"connectfund-start":     {"peeruri", "satoshi"},
+	"connectfund-batch":     {"peers"},
+	"close":                 {"id", "unilateraltimeout"},
+	"closeget":              {"peeruri", "chanid", "force", "timeout"},
+	"closeget-batch":        {"channels", "unilateraltimeout"},
+}
+
+// readApprovalRules parses a comma-separated list of methods, each optionally
+// followed by a threshold in msat or by a param that must be true for the rule
+// to apply, like "pay>100000000,withdraw,closeget?force". When withQuorum is
+// set each entry must also end with the number of required approvals, like
+// "withdraw:2".
+func readApprovalRules(configstr string, withQuorum bool) (map[string]ApprovalRule, error) {
+	rules := make(map[string]ApprovalRule)
+	for _, entry := range strings.Split(configstr, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		rule := ApprovalRule{}
+		if withQuorum {
+			spl := strings.Split(entry, ":")
+			if len(spl) != 2 {
+				return nil, fmt.Errorf("invalid quorum rule '%s', should be 'method:quorum'", entry)
+			}
+			quorum, err := strconv.Atoi(strings.TrimSpace(spl[1]))
+			if err != nil || quorum <= 0 {
+				return nil, fmt.Errorf("invalid quorum for '%s'", spl[0])
+			}
+			rule.Quorum = quorum
+			entry = strings.TrimSpace(spl[0])
+		}
+
+		spl := strings.Split(entry, ">")
+		methodflag := strings.Split(spl[0], "?")
+		rule.Method = strings.TrimSpace(methodflag[0])
+		if len(methodflag) == 2 {
+			rule.Flag = strings.TrimSpace(methodflag[1])
+		}
+		if len(spl) == 2 {
+			threshold, err := strconv.ParseInt(strings.TrimSpace(spl[1]), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid threshold for '%s'", rule.Method)
+			}
+			rule.Threshold = threshold
+		} else if len(spl) > 2 {
+			return nil, fmt.Errorf("invalid approval rule '%s'", entry)
+		}
+		rules[rule.Method] = rule
+	}
+	return rules, nil
+}
+
+// keyId is a non-secret identifier for a key, so we can show which key made
+// a call without leaking it.
+func keyId(key string) string {
+	if key == "" {
+		return "login"
+	}
+	return hmacStr(key, "key-id")[:8]
+}
+
+// requiresApproval tells if the call made with this key must be parked, how
+// many operator signatures it requires and the amount involved when that is
+// relevant. Quorum rules apply to every key and take precedence.
+func requiresApproval(p *plugin.Plugin, key string, req lightning.JSONRPCMessage) (needed bool, quorum int, amount int64) {
+	if rule, ok := quorumRules[req.Method]; ok {
+		if needed, amount := rule.matches(p, req); needed {
+			return true, rule.Quorum, amount
+		}
+	}
+
+	if !approvalKeys[key] {
+		return false, 0, 0
+	}
+	if rule, ok := approvalRules[req.Method]; ok {
+		if needed, amount := rule.matches(p, req); needed {
+			return true, 0, amount
+		}
+	}
+	return false, 0, 0
+}
+
+func (rule ApprovalRule) matches(p *plugin.Plugin, req lightning.JSONRPCMessage) (bool, int64) {
+	if rule.Flag != "" {
+		switch v := namedParams(req)[rule.Flag].(type) {
+		case nil:
+			return false, 0
+		case bool:
+			if !v {
+				return false, 0
+			}
+		case string:
+			if v == "" || v == "false" || v == "0" {
+				return false, 0
+			}
+		}
+	}
+
+	amount, err := callAmountMsat(p, req)
+	if err != nil {
+		// if we can't know the amount we must be careful
+		p.Logf("couldn't determine amount of '%s' call: %s", req.Method, err)
+		return true, 0
+	}
+	return amount > rule.Threshold || rule.Threshold == 0, amount
+}
+
+// namedParams returns the params of a call as a map even if they were given
+// as a list.
+func namedParams(req lightning.JSONRPCMessage) map[string]interface{} {
+	params := make(map[string]interface{})
+	switch given := req.Params.(type) {
+	case map[string]interface{}:
+		params = given
+	case []interface{}:
+		for i, name := range positionalParams[req.Method] {
+			if i < len(given) {
+				params[name] = given[i]
+			}
+		}
+	}
+	return params
+}
+
+// callAmountMsat finds how much a call is going to move.
+func callAmountMsat(p *plugin.Plugin, req lightning.JSONRPCMessage) (int64, error) {
+	params := namedParams(req)
+
+	switch req.Method {
+	case "sendpay":
+		// what leaves the node is what is sent to the first hop
+		if route, ok := params["route"].([]interface{}); ok && len(route) > 0 {
+			if hop, ok := route[0].(map[string]interface{}); ok {
+				if amount, ok := hop["amount_msat"]; ok {
+					return parseMsat(fmt.Sprint(amount), true)
+				}
+				return parseMsat(fmt.Sprint(hop["msatoshi"]), true)
+			}
+		}
+	case "sparko-voucher-create":
+		// each use can withdraw the full amount
+		amount, err := parseMsat(fmt.Sprint(params["amount_msat"]), true)
+		if err != nil {
+			return 0, err
+		}
+		if uses, err := parseMsat(fmt.Sprint(params["uses"]), true); err == nil && uses > 1 {
+			amount *= uses
+		}
+		return amount, nil
+	case "sparko-nwc-create":
+		// without a budget the connection can spend everything
+		budget, _ := parseMsat(fmt.Sprint(params["budget_msat"]), true)
+		if budget <= 0 {
+			return parseMsat("all", true)
+		}
+		return budget, nil
+	}
+
+	var amount interface{}
+	for _, name := range []string{"amount_msat", "msatoshi", "satoshi", "amount"} {
+		if v, ok := params[name]; ok && v != nil {
+			amount = v
+			break
+		}
+	}
+
+	// batches move the sum of all their amounts
+	if peers, ok := params["peers"].([]interface{}); ok {
+		return sumAmounts(peers, "satoshi")
+	}
+	if destinations, ok := params["destinations"].([]interface{}); ok {
+		return sumAmounts(destinations, "amount")
+	}
+
+	if amount == nil {
+		bolt11, ok := params["bolt11"].(string)
+		if !ok {
+			// xpay
+			bolt11, ok = params["invstring"].(string)
+		}
+		if !ok {
+			return 0, nil
+		}
+		res, err := callBackend("decodepay", []interface{}{bolt11})
+		if err != nil {
+			return 0, err
+		}
+		return parseMsat(res.Get("amount_msat").String(), true)
+	}
+
+	// satoshi and amount are given in satoshis unless they say otherwise
+	_, isMsat := params["amount_msat"]
+	if !isMsat {
+		_, isMsat = params["msatoshi"]
+	}
+	return parseMsat(fmt.Sprint(amount), isMsat)
+}
+
+// sumAmounts adds the amounts in satoshis (unless they say otherwise) of a
+// list of objects.
+func sumAmounts(list []interface{}, field string) (int64, error) {
+	var total int64
+	for _, item := range list {
+		if item, ok := item.(map[string]interface{}); ok {
+			msat, err := parseMsat(fmt.Sprint(item[field]), false)
+			if err != nil {
+				return 0, err
+			}
+			total += msat
+		}
+	}
+	return total, nil
+}
+
+// parseMsat reads amounts in the many formats lightningd accepts,
+// like 1000, "1000msat", "1sat", "0.001btc" or "all".
+func parseMsat(amount string, defaultMsat bool) (int64, error) {
+	amount = strings.TrimSpace(amount)
+	switch {
+	case amount == "all":
+		return 21000000 * 100000000 * 1000, nil
+	case strings.HasSuffix(amount, "msat"):
+		return strconv.ParseInt(strings.TrimSuffix(amount, "msat"), 10, 64)
+	case strings.HasSuffix(amount, "sat"):
+		sat, err := strconv.ParseInt(strings.TrimSuffix(amount, "sat"), 10, 64)
+		return sat * 1000, err
+	case strings.HasSuffix(amount, "btc"):
+		btc, err := strconv.ParseFloat(strings.TrimSuffix(amount, "btc"), 64)
+		return int64(btc * 100000000 * 1000), err
+	}
+
+	n, err := strconv.ParseFloat(amount, 64)
+	if err != nil {
+		return 0, errors.New("invalid amount '" + amount + "'")
+	}
+	if defaultMsat {
+		return int64(n), nil
+	}
+	return int64(n * 1000), nil
+}
+
+// parkCall stores the call until an operator approves or denies it. A call
+// retried with the same idempotency key gets the call that is already parked.
+func parkCall(
+	w http.ResponseWriter,
+	p *plugin.Plugin,
+	key string,
+	idempotencyKey string,
+	node string,
+	req lightning.JSONRPCMessage,
+	quorum int,
+	amount int64,
+) {
+	random := make([]byte, 16)
+	rand.Read(random)
+
+	now := time.Now()
+	pending := &PendingCall{
+		Id:             hex.EncodeToString(random),
+		KeyId:          keyId(key),
+		Request:        req,
+		Node:           node,
+		AmountMsat:     amount,
+		Quorum:         quorum,
+		CreatedAt:      now.Unix(),
+		ExpiresAt:      now.Add(approvalExpiry).Unix(),
+		IdempotencyKey: idempotencyKey,
+	}
+
+	pendingMutex.Lock()
+	if idempotencyKey != "" {
+		for _, parked := range pendingCalls {
+			if parked.KeyId == pending.KeyId && parked.IdempotencyKey == idempotencyKey {
+				pendingMutex.Unlock()
+				p.Logf("'%s' call from key %s is already awaiting approval: %s", req.Method, parked.KeyId, parked.Id)
+				writeParked(w, parked)
+				return
+			}
+		}
+	}
+	pendingCalls[pending.Id] = pending
+	err := savePendingCalls(p)
+	pendingMutex.Unlock()
+	if err != nil {
+		p.Log("failed to save pending calls: " + err.Error())
+	}
+
+	jobsMutex.Lock()
+	jobs[pending.Id] = pendingJob(pending)
+	jobsMutex.Unlock()
+
+	p.Logf("'%s' call from key %s is awaiting approval: %s", req.Method, pending.KeyId, pending.Id)
+	audit(p, "parked", pending, "")
+	j, _ := json.Marshal(pending)
+	ee <- event{typ: "approval-required", data: string(j)}
+
+	writeParked(w, pending)
+}
+
+func writeParked(w http.ResponseWriter, pending *PendingCall) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", nodePath(pending.Node)+"/jobs/"+pending.Id)
+	w.WriteHeader(202)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"job":    pending.Id,
+		"status": "awaiting-approval",
+	})
+}
+
+// pendingJob is the job through which the result of a parked call is given.
+func pendingJob(pending *PendingCall) *Job {
+	return &Job{
+		Id:      pending.Id,
+		Status:  "awaiting-approval",
+		Request: pending.Request,
+		Node:    pending.Node,
+		KeyId:   pending.KeyId,
+		Started: pending.CreatedAt,
+
+		idempotencyKey: pending.IdempotencyKey,
+	}
+}
+
+func savePendingCalls(p *plugin.Plugin) error {
+	path := dataPath(p, "pending.json")
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	j, _ := json.Marshal(pendingCalls)
+	return writeFileAtomic(path, j)
+}
+
+// loadPendingCalls restores the calls that were waiting for approval when
+// sparko was last stopped.
+func loadPendingCalls(p *plugin.Plugin) error {
+	b, err := ioutil.ReadFile(dataPath(p, "pending.json"))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+	if err := json.Unmarshal(b, &pendingCalls); err != nil {
+		return err
+	}
+
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	for _, pending := range pendingCalls {
+		jobs[pending.Id] = pendingJob(pending)
+	}
+	return nil
+}
+
+// resolvePending removes a call from the pending list.
+func resolvePending(p *plugin.Plugin, id string) (*PendingCall, error) {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+
+	pending, ok := pendingCalls[id]
+	if !ok {
+		return nil, errors.New("no pending call with this id")
+	}
+	delete(pendingCalls, id)
+	if err := savePendingCalls(p); err != nil {
+		p.Log("failed to save pending calls: " + err.Error())
+	}
+	return pending, nil
+}
+
+// finishPending marks the job of a call that won't be executed as finished.
+func finishPending(pending *PendingCall, status string, reason string) {
+	jobsMutex.Lock()
+	job, ok := jobs[pending.Id]
+	if !ok {
+		job = pendingJob(pending)
+		jobs[pending.Id] = job
+	}
+	job.Status = status
+	job.Finished = time.Now().Unix()
+	job.Error = &LightningError{
+		Type:     "sparko",
+		Name:     "ApprovalError",
+		Message:  reason,
+		FullType: "sparko",
+	}
+	j, _ := json.Marshal(job)
+	jobsMutex.Unlock()
+
+	ee <- event{typ: "job-complete", data: string(j), keyId: pending.KeyId}
+}
+
+// expirePendingCalls gets rid of the calls that have waited for too long.
+func expirePendingCalls(p *plugin.Plugin) {
+	now := time.Now().Unix()
+
+	pendingMutex.Lock()
+	expired := make([]*PendingCall, 0)
+	for id, pending := range pendingCalls {
+		if pending.ExpiresAt != 0 && pending.ExpiresAt < now {
+			expired = append(expired, pending)
+			delete(pendingCalls, id)
+		}
+	}
+	if len(expired) > 0 {
+		if err := savePendingCalls(p); err != nil {
+			p.Log("failed to save pending calls: " + err.Error())
+		}
+	}
+	pendingMutex.Unlock()
+
+	for _, pending := range expired {
+		p.Logf("'%s' call %s expired without approval", pending.Request.Method, pending.Id)
+		audit(p, "expired", pending, "")
+		finishPending(pending, "expired", "approval expired")
+	}
+}
+
+var sparkoPending = plugin.RPCMethod{
+	"sparko-pending",
+	"",
+	"List calls awaiting approval.",
+	"",
+	func(p *plugin.Plugin, params plugin.Params) (resp interface{}, errCode int, err error) {
+		pendingMutex.Lock()
+		defer pendingMutex.Unlock()
+
+		list := make([]*PendingCall, 0, len(pendingCalls))
+		for _, pending := range pendingCalls {
+			list = append(list, pending)
+		}
+		return map[string]interface{}{"pending": list}, 0, nil
+	},
+}
+
+var sparkoApprove = plugin.RPCMethod{
+	"sparko-approve",
+	"id [operator] [signature]",
+	"Approve a pending call, which will then be executed.",
+	"Calls that require a quorum must be approved by each operator with a signature of the call id, method, params and node.",
+	func(p *plugin.Plugin, params plugin.Params) (resp interface{}, errCode int, err error) {
+		id := params.Get("id").String()
+
+		pendingMutex.Lock()
+		pending, ok := pendingCalls[id]
+		if ok && pending.Quorum > 0 {
+			operator := params.Get("operator").String()
+			signature := params.Get("signature").String()
+			err = addApproval(pending, operator, signature)
+			if err == nil {
+				err = savePendingCalls(p)
+			}
+			reached := len(pending.Approvals) >= pending.Quorum
+			pendingMutex.Unlock()
+
+			if err != nil {
+				return nil, 401, err
+			}
+			audit(p, "signed", pending, operator)
+			if !reached {
+				return map[string]interface{}{
+					"id":        id,
+					"status":    "awaiting-approval",
+					"approvals": len(pending.Approvals),
+					"quorum":    pending.Quorum,
+				}, 0, nil
+			}
+		} else {
+			pendingMutex.Unlock()
+		}
+
+		pending, err = resolvePending(p, id)
+		if err != nil {
+			return nil, 404, err
+		}
+
+		jobsMutex.Lock()
+		job, ok := jobs[pending.Id]
+		if !ok {
+			job = pendingJob(pending)
+			jobs[pending.Id] = job
+		}
+		job.Status = "pending"
+		jobsMutex.Unlock()
+
+		p.Logf("'%s' call %s approved", pending.Request.Method, pending.Id)
+		audit(p, "approved", pending, "")
+		go runJob(p, job)
+
+		return map[string]interface{}{"id": pending.Id, "status": "approved"}, 0, nil
+	},
+}
+
+var sparkoDeny = plugin.RPCMethod{
+	"sparko-deny",
+	"id [reason]",
+	"Deny a pending call, which will never be executed.",
+	"",
+	func(p *plugin.Plugin, params plugin.Params) (resp interface{}, errCode int, err error) {
+		pending, err := resolvePending(p, params.Get("id").String())
+		if err != nil {
+			return nil, 404, err
+		}
+
+		reason := params.Get("reason").String()
+		if reason == "" {
+			reason = "denied by operator"
+		}
+
+		p.Logf("'%s' call %s denied", pending.Request.Method, pending.Id)
+		audit(p, "denied", pending, "")
+		finishPending(pending, "denied", reason)
+
+		return map[string]interface{}{"id": pending.Id, "status": "denied"}, 0, nil
+	},
+}
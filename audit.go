@@ -0,0 +1,94 @@
+// An append-only log of everything that happens to calls that require
+// approval, kept at sparko/audit.log inside the lightning dir.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
+)
+
+type AuditEntry struct {
+	At         int64       `json:"at"`
+	Action     string      `json:"action"`
+	Id         string      `json:"id"`
+	Method     string      `json:"method"`
+	Params     interface{} `json:"params"`
+	KeyId      string      `json:"key_id"`
+	AmountMsat int64       `json:"amount_msat,omitempty"`
+	Operator   string      `json:"operator,omitempty"`
+}
+
+var auditMutex sync.Mutex
+
+func audit(p *plugin.Plugin, action string, pending *PendingCall, operator string) {
+	j, _ := json.Marshal(AuditEntry{
+		At:         time.Now().Unix(),
+		Action:     action,
+		Id:         pending.Id,
+		Method:     pending.Request.Method,
+		Params:     pending.Request.Params,
+		KeyId:      pending.KeyId,
+		AmountMsat: pending.AmountMsat,
+		Operator:   operator,
+	})
+
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	path := dataPath(p, "audit.log")
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		p.Log("failed to write to audit log: " + err.Error())
+		return
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		p.Log("failed to write to audit log: " + err.Error())
+		return
+	}
+	defer file.Close()
+
+	file.Write(append(j, '\n'))
+}
+
+var sparkoAudit = plugin.RPCMethod{
+	"sparko-audit",
+	"[id]",
+	"Show the audit log of calls that required approval, optionally only for the given call.",
+	"",
+	func(p *plugin.Plugin, params plugin.Params) (resp interface{}, errCode int, err error) {
+		id := params.Get("id").String()
+		entries := make([]AuditEntry, 0)
+
+		auditMutex.Lock()
+		defer auditMutex.Unlock()
+
+		file, err := os.Open(dataPath(p, "audit.log"))
+		if os.IsNotExist(err) {
+			return map[string]interface{}{"audit": entries}, 0, nil
+		} else if err != nil {
+			return nil, 500, err
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var entry AuditEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				continue
+			}
+			if id == "" || entry.Id == id {
+				entries = append(entries, entry)
+			}
+		}
+
+		return map[string]interface{}{"audit": entries}, 0, nil
+	},
+}
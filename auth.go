@@ -11,20 +11,33 @@ import (
 	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
 )
 
-func defaultAuth(r *http.Request) error {
+// defaultAuth checks the full-access credentials and returns the user that
+// should be stored in the session cookie.
+func defaultAuth(r *http.Request) (user string, err error) {
 	if accessKey == "" {
-		return errors.New("no default login credentials set")
+		return "", errors.New("no default login credentials set")
 	}
+
+	loginUser := ""
+	if login != "" {
+		loginUser = strings.Split(login, ":")[0]
+	}
+
 	if r.Header.Get("X-Access") == accessKey {
-		return nil
+		return loginUser, nil
 	}
 	if r.URL.Query().Get("access-key") == accessKey {
-		return nil
+		return loginUser, nil
 	}
 	if cookie, err := r.Cookie("user"); err == nil {
 		var value string
-		if err = scookie.Decode("user", cookie.Value, &value); err == nil && strings.HasPrefix(login+":", value) {
-			return nil
+		if err = scookie.Decode("user", cookie.Value, &value); err == nil {
+			if login != "" && strings.HasPrefix(login+":", value+":") {
+				return value, nil
+			}
+			if isLNURLAuthUser(value) {
+				return value, nil
+			}
 		}
 	}
 
@@ -34,13 +47,28 @@ func defaultAuth(r *http.Request) error {
 	if len(parts) == 2 {
 		creds, err := base64.StdEncoding.DecodeString(parts[1])
 		if err == nil {
-			if string(creds) == login {
-				return nil
+			if login != "" && string(creds) == login {
+				return loginUser, nil
 			}
 		}
 	}
 
-	return fmt.Errorf("Invalid access key.")
+	return "", fmt.Errorf("Invalid access key.")
+}
+
+// setUserCookie keeps the user logged in the wallet UI.
+func setUserCookie(w http.ResponseWriter, user string) {
+	if encoded, err := scookie.Encode("user", user); err == nil {
+		cookie := &http.Cookie{
+			Name:     "user",
+			Value:    encoded,
+			Secure:   true,
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+			MaxAge:   2592000,
+		}
+		http.SetCookie(w, cookie)
+	}
 }
 
 func authMiddleware(p *plugin.Plugin) func(next http.Handler) http.Handler {
@@ -48,37 +76,27 @@ func authMiddleware(p *plugin.Plugin) func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			path := strings.TrimPrefix(r.URL.Path, "/")
 
-			if path == "" || path == "rpc" || path == "stream" {
+			if path == "" || isAPIPath(path) {
 				// default key / login
-				if err := defaultAuth(r); err == nil {
+				if user, err := defaultAuth(r); err == nil {
 					// set cookie
-					user := strings.Split(login, ":")[0]
-					if encoded, err := scookie.Encode("user", user); err == nil {
-						cookie := &http.Cookie{
-							Name:     "user",
-							Value:    encoded,
-							Secure:   true,
-							HttpOnly: true,
-							SameSite: http.SameSiteStrictMode,
-							MaxAge:   2592000,
-						}
-						http.SetCookie(w, cookie)
+					if user != "" {
+						setUserCookie(w, user)
 					}
 
 					next.ServeHTTP(w, r)
 					return
 				}
 
-				// extra keys -- only access the /rpc and /stream endpoints
-				if path == "rpc" || path == "stream" {
+				// extra keys -- only access the API endpoints
+				if isAPIPath(path) {
 					for key, permissions := range keys {
 						if r.Header.Get("X-Access") == key ||
 							r.URL.Query().Get("access-key") == key {
 
-							r = r.WithContext(context.WithValue(
-								r.Context(),
-								"permissions", permissions,
-							))
+							ctx := context.WithValue(r.Context(), "permissions", permissions)
+							ctx = context.WithValue(ctx, "key", key)
+							r = r.WithContext(ctx)
 
 							next.ServeHTTP(w, r)
 							return
@@ -86,6 +104,12 @@ func authMiddleware(p *plugin.Plugin) func(next http.Handler) http.Handler {
 					}
 				}
 
+				// send the browser to the lnurl-auth login page
+				if path == "" && len(lnurlauthKeys) > 0 && r.URL.Query().Get("basic") == "" {
+					http.Redirect(w, r, "/login", 302)
+					return
+				}
+
 				p.Logf("auth failed at /%s", path)
 				w.Header().Set("WWW-Authenticate", `Basic realm="Private Area"`)
 				w.WriteHeader(401)
@@ -102,3 +126,11 @@ func authMiddleware(p *plugin.Plugin) func(next http.Handler) http.Handler {
 		})
 	}
 }
+
+// isAPIPath tells if a path is one of the endpoints that can be accessed with
+// the extra keys (besides the default login).
+func isAPIPath(path string) bool {
+	return path == "rpc" || path == "stream" || path == "openrpc.json" ||
+		strings.HasPrefix(path, "v1/") || strings.HasPrefix(path, "jobs/") ||
+		strings.HasPrefix(path, "nodes/")
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"time"
+
+	lightning "github.com/fiatjaf/lightningd-gjson-rpc"
+	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
+	"github.com/tidwall/gjson"
+)
+
+// Backend is the node the HTTP bridge talks to. The RPC, REST, discovery and
+// streaming layers only use this, so they work the same with lightningd and
+// with the in-memory FakeNode, and other node implementations can be added.
+type Backend interface {
+	// Call calls a method and returns the raw JSON result. errors returned by
+	// the node itself must be a lightning.ErrorCommand.
+	Call(timeout time.Duration, req lightning.JSONRPCMessage) ([]byte, error)
+
+	// Events emits everything that happens on the node.
+	Events() <-chan event
+
+	// Help describes the methods the node has, like lightningd's `help`.
+	Help() (gjson.Result, error)
+}
+
+var backend Backend
+
+// callBackend is a shortcut for calling a method on the backend with named
+// (a map) or positional (a slice) params. everything sparko calls on the
+// node goes through here, never directly to p.Client, so it also works with
+// other backends.
+func callBackend(method string, params interface{}) (gjson.Result, error) {
+	return callNode(backend, method, params)
+}
+
+// callNode is the same as callBackend for any node (see nodes.go).
+func callNode(b Backend, method string, params interface{}) (gjson.Result, error) {
+	return callNodeWithTimeout(b, callTimeout(method), method, params)
+}
+
+func callNodeWithTimeout(b Backend, timeout time.Duration, method string, params interface{}) (gjson.Result, error) {
+	if params == nil {
+		params = make(map[string]interface{})
+	}
+	respbytes, err := b.Call(timeout, lightning.JSONRPCMessage{
+		Version: "2.0",
+		Method:  method,
+		Params:  params,
+	})
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	return gjson.ParseBytes(respbytes), nil
+}
+
+// CLNBackend is lightningd, to which we're connected as a plugin (or as a
+// standalone daemon, see standalone.go).
+type CLNBackend struct {
+	p *plugin.Plugin
+}
+
+// clnEvents gets the notifications lightningd sends to the plugin.
+var clnEvents = make(chan event)
+
+func (cln CLNBackend) Call(timeout time.Duration, req lightning.JSONRPCMessage) ([]byte, error) {
+	return cln.p.Client.CallMessageRaw(timeout, req)
+}
+
+func (cln CLNBackend) Events() <-chan event {
+	return clnEvents
+}
+
+func (cln CLNBackend) Help() (gjson.Result, error) {
+	return cln.p.Client.Call("help")
+}
@@ -0,0 +1,239 @@
+// Opening and closing many channels at once. `connectfund-batch` opens all
+// channels in a single transaction with `multifundchannel`, and
+// `closeget-batch` closes a list of channels. Both report the outcome for each
+// peer or channel separately, with channels in the same shape `connectfund`
+// and `closeget` return them.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
+	"github.com/tidwall/gjson"
+)
+
+const BATCHWORKERS = 4
+
+type BatchResult struct {
+	Peer    string                 `json:"peer,omitempty"`
+	Channel string                 `json:"chanid,omitempty"`
+	Ok      bool                   `json:"ok"`
+	Error   string                 `json:"error,omitempty"`
+	Code    int                    `json:"code,omitempty"`
+	Result  map[string]interface{} `json:"result,omitempty"`
+}
+
+var connectFundBatch = plugin.RPCMethod{
+	"connectfund-batch",
+	"peers [feerate] [minchannels]",
+	"Opens channels to many peers in a single transaction. peers is a list of {peeruri, satoshi, [announce], [push_msat]}.",
+	"",
+	func(p *plugin.Plugin, params plugin.Params) (resp interface{}, errCode int, err error) {
+		peers := params.Get("peers").Array()
+		if len(peers) == 0 {
+			return nil, 400, errors.New("peers must be a list of {peeruri, satoshi}")
+		}
+
+		results := make([]*BatchResult, len(peers))
+		ids := make([]string, len(peers))
+		for i, peer := range peers {
+			peeruri := peer.Get("peeruri").String()
+			ids[i] = strings.Split(peeruri, "@")[0]
+			results[i] = &BatchResult{Peer: peeruri}
+			if peeruri == "" || peer.Get("satoshi").Int() <= 0 {
+				results[i].Error = "peeruri and a positive satoshi amount are required"
+			}
+		}
+
+		// each channel must follow the rules, and all of them together too
+		feerate := params.Get("feerate").String()
+		var valid []int
+		for i, peer := range peers {
+			if results[i].Error != "" {
+				continue
+			}
+			open := ChannelOpen{ids[i], peer.Get("satoshi").Int()}
+			if err := openPolicy.check(backend, []ChannelOpen{open}, feerate, false); err != nil {
+				results[i].Error = err.Error()
+				results[i].Code = err.(PolicyError).Code
+				continue
+			}
+			valid = append(valid, i)
+		}
+		opens := make([]ChannelOpen, len(valid))
+		for j, i := range valid {
+			opens[j] = ChannelOpen{ids[i], peers[i].Get("satoshi").Int()}
+		}
+		if err := openPolicy.check(backend, opens, feerate, false); err != nil {
+			for _, i := range valid {
+				results[i].Error = err.Error()
+				results[i].Code = err.(PolicyError).Code
+			}
+		}
+
+		// connect to everybody first, so peers we can't reach are left out
+		forEach(len(peers), BATCHWORKERS, func(i int) {
+			if results[i].Error != "" {
+				return
+			}
+			if _, err := callBackend("connect", []interface{}{results[i].Peer}); err != nil {
+				results[i].Error = "cannot connect to peer: " + err.Error()
+			}
+		})
+
+		var destinations []interface{}
+		for i, peer := range peers {
+			if results[i].Error != "" {
+				continue
+			}
+			destination := map[string]interface{}{
+				"id":     ids[i],
+				"amount": peer.Get("satoshi").Int(),
+			}
+			if announce := peer.Get("announce"); announce.Exists() {
+				destination["announce"] = announce.Bool()
+			}
+			if push := peer.Get("push_msat"); push.Exists() {
+				destination["push_msat"] = push.Int()
+			}
+			destinations = append(destinations, destination)
+		}
+		if len(destinations) == 0 {
+			return map[string]interface{}{"results": results}, 0, nil
+		}
+
+		args := map[string]interface{}{"destinations": destinations}
+		if feerate != "" {
+			args["feerate"] = feerate
+		}
+		if minchannels := params.Get("minchannels").Int(); minchannels > 0 {
+			args["minchannels"] = minchannels
+		}
+		res, err := callBackend("multifundchannel", args)
+		if err != nil {
+			for _, result := range results {
+				if result.Error == "" {
+					result.Error = "cannot open channels: " + err.Error()
+				}
+			}
+			return map[string]interface{}{"results": results}, 0, nil
+		}
+
+		// with minchannels some peers may have been left out
+		failed := make(map[string]gjson.Result)
+		for _, f := range res.Get("failed").Array() {
+			failed[f.Get("id").String()] = f
+		}
+		opened := make(map[string]string)
+		for _, c := range res.Get("channel_ids").Array() {
+			opened[c.Get("id").String()] = c.Get("channel_id").String()
+		}
+
+		forEach(len(peers), BATCHWORKERS, func(i int) {
+			result := results[i]
+			if result.Error != "" {
+				return
+			}
+			if f, ok := failed[ids[i]]; ok {
+				result.Error = fmt.Sprintf("%s failed: %s", f.Get("method").String(), f.Get("error.message").String())
+				return
+			}
+			channelId, ok := opened[ids[i]]
+			if !ok {
+				result.Error = "channel wasn't opened"
+				return
+			}
+			channel, _, err := getChannel(p, ids[i], channelId)
+			if err != nil {
+				result.Error = err.Error()
+				return
+			}
+			result.Ok = true
+			result.Result = channel
+		})
+
+		return map[string]interface{}{
+			"txid":    res.Get("txid").String(),
+			"results": results,
+		}, 0, nil
+	},
+}
+
+var closeGetBatch = plugin.RPCMethod{
+	"closeget-batch",
+	"channels [unilateraltimeout]",
+	"Closes many channels. channels is a list of channel ids or of {peeruri, chanid}.",
+	"",
+	func(p *plugin.Plugin, params plugin.Params) (resp interface{}, errCode int, err error) {
+		channels := params.Get("channels").Array()
+		if len(channels) == 0 {
+			return nil, 400, errors.New("channels must be a list of channel ids")
+		}
+		// like closeget, go unilateral after 30 seconds unless told otherwise
+		timeout := int64(30)
+		if t := params.Get("unilateraltimeout"); t.Exists() && t.String() != "" {
+			timeout, err = strconv.ParseInt(t.String(), 10, 64)
+			if err != nil || timeout < 0 {
+				return nil, 400, errors.New("unilateraltimeout must be a number of seconds")
+			}
+		}
+
+		results := make([]*BatchResult, len(channels))
+		forEach(len(channels), BATCHWORKERS, func(i int) {
+			result := &BatchResult{Channel: channels[i].String()}
+			if channels[i].IsObject() {
+				result.Peer = channels[i].Get("peeruri").String()
+				result.Channel = channels[i].Get("chanid").String()
+			}
+			results[i] = result
+
+			args := map[string]interface{}{"id": result.Channel, "unilateraltimeout": timeout}
+			closing, err := callNodeWithTimeout(backend, closeTimeout(timeout), "close", args)
+			if err != nil {
+				result.Error = "cannot close channel: " + err.Error()
+				return
+			}
+
+			chanid := closing.Get("channel_id").String()
+			if chanid == "" {
+				chanid = result.Channel
+			}
+			peerid := strings.Split(result.Peer, "@")[0]
+			channel, _, err := getChannel(p, peerid, chanid)
+			if err != nil {
+				// the channel is closed anyway
+				channel = map[string]interface{}{}
+			}
+			channel["closing"] = closing.Value()
+			result.Ok = true
+			result.Result = channel
+		})
+
+		return map[string]interface{}{"results": results}, 0, nil
+	},
+}
+
+// forEach calls f for 0..n-1 with a number of workers and waits for all of them.
+func forEach(n int, workers int, f func(i int)) {
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				f(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
@@ -0,0 +1,184 @@
+// A cache for read-only methods that are called too often (by dashboards and
+// such), configured with `sparko-cache`. Entries are invalidated when their TTL
+// expires or when an event that may change their results arrives, and there
+// are never more than MAXCACHEENTRIES of them.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	lightning "github.com/fiatjaf/lightningd-gjson-rpc"
+	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
+)
+
+// MAXCACHEENTRIES bounds the cache, as each different set of params (or
+// filter) gets its own entry.
+const MAXCACHEENTRIES = 1000
+
+type cachedResponse struct {
+	respbytes []byte
+	expires   time.Time
+}
+
+var (
+	cacheMutex sync.Mutex
+	cacheTTLs  = make(map[string]time.Duration)
+	respCache  = make(map[string]cachedResponse)
+)
+
+// cacheableMethods are the only methods that can be cached, as they don't
+// change anything on the node.
+var cacheableMethods = map[string]bool{
+	"getinfo":                true,
+	"listnodes":              true,
+	"listchannels":           true,
+	"listpeers":              true,
+	"listpeerchannels":       true,
+	"listclosedchannels":     true,
+	"listfunds":              true,
+	"listinvoices":           true,
+	"listpays":               true,
+	"listsendpays":           true,
+	"listforwards":           true,
+	"listtransactions":       true,
+	"listoffers":             true,
+	"listconfigs":            true,
+	"feerates":               true,
+	"getroute":               true,
+	"decodepay":              true,
+	"decode":                 true,
+	"help":                   true,
+	"bkpr-listbalances":      true,
+	"bkpr-listincome":        true,
+	"bkpr-listaccountevents": true,
+}
+
+// readCacheConfig parses `sparko-cache`, which can only have read-only methods.
+func readCacheConfig(configstr string) (map[string]time.Duration, error) {
+	ttls, err := readMethodDurations(configstr)
+	if err != nil {
+		return nil, err
+	}
+	for method := range ttls {
+		if !cacheableMethods[method] {
+			return nil, fmt.Errorf("'%s' can't be cached, only read-only methods can", method)
+		}
+	}
+	return ttls, nil
+}
+
+// invalidatedBy lists the methods whose cached results are dropped when each
+// kind of event arrives.
+var invalidatedBy = map[string][]string{
+	"channel_opened":        {"getinfo", "listpeers", "listpeerchannels", "listfunds", "listchannels"},
+	"channel_state_changed": {"getinfo", "listpeers", "listpeerchannels", "listclosedchannels", "listfunds", "listchannels"},
+	"connect":               {"getinfo", "listpeers", "listpeerchannels", "listnodes"},
+	"disconnect":            {"getinfo", "listpeers", "listpeerchannels"},
+	"invoice_payment":       {"listinvoices", "listfunds", "listpeers", "listpeerchannels"},
+	"invoice_creation":      {"listinvoices"},
+	"forward_event":         {"getinfo", "listforwards", "listfunds", "listpeers", "listpeerchannels"},
+	"sendpay_success":       {"listsendpays", "listpays", "listfunds", "listpeers", "listpeerchannels"},
+	"sendpay_failure":       {"listsendpays", "listpays"},
+	"coin_movement":         {"listfunds", "bkpr-listbalances"},
+}
+
+// callCached calls lightningd, or gets the result from the cache if the
+// method is cacheable and has been called with the same params recently.
+func callCached(p *plugin.Plugin, b Backend, node string, req lightning.JSONRPCMessage) ([]byte, error) {
+	ttl, cacheable := cacheTTLs[req.Method]
+	if !cacheable {
+		return b.Call(callTimeout(req.Method), req)
+	}
+
+	jparams, _ := json.Marshal(req.Params)
+	cachekey := nodePrefix(node) + req.Method + ":" + string(jparams)
+
+	cacheMutex.Lock()
+	cached, ok := respCache[cachekey]
+	cacheMutex.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.respbytes, nil
+	}
+
+	respbytes, err := b.Call(callTimeout(req.Method), req)
+	if err != nil {
+		return nil, err
+	}
+
+	cacheMutex.Lock()
+	if _, exists := respCache[cachekey]; !exists && len(respCache) >= MAXCACHEENTRIES {
+		evictCacheEntries()
+	}
+	respCache[cachekey] = cachedResponse{respbytes, time.Now().Add(ttl)}
+	cacheMutex.Unlock()
+
+	return respbytes, nil
+}
+
+// evictCacheEntries makes room in the cache by dropping the expired entries
+// or, if none has expired, the one that would expire first. must be called
+// with cacheMutex locked.
+func evictCacheEntries() {
+	now := time.Now()
+	oldest := ""
+	for key, cached := range respCache {
+		if now.After(cached.expires) {
+			delete(respCache, key)
+		} else if oldest == "" || cached.expires.Before(respCache[oldest].expires) {
+			oldest = key
+		}
+	}
+	if len(respCache) >= MAXCACHEENTRIES {
+		delete(respCache, oldest)
+	}
+}
+
+// invalidateCache drops the cached results that may have been changed by an
+// event. events from other nodes have the node name prefixed to their type.
+func invalidateCache(eventType string) {
+	prefix := ""
+	if spl := strings.SplitN(eventType, "/", 2); len(spl) == 2 {
+		prefix = nodePrefix(spl[0])
+		eventType = spl[1]
+	}
+
+	methods, ok := invalidatedBy[eventType]
+	if !ok {
+		return
+	}
+
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	for key := range respCache {
+		for _, method := range methods {
+			if strings.HasPrefix(key, prefix+method+":") {
+				delete(respCache, key)
+			}
+		}
+	}
+}
+
+// writeWithETag writes the response with an ETag, or just a 304 if the client
+// already has it.
+func writeWithETag(w http.ResponseWriter, r *http.Request, respbytes []byte) {
+	hash := sha256.Sum256(respbytes)
+	etag := `"` + hex.EncodeToString(hash[:16]) + `"`
+	w.Header().Set("ETag", etag)
+
+	for _, match := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		if strings.TrimPrefix(strings.TrimSpace(match), "W/") == etag {
+			w.WriteHeader(304)
+			return
+		}
+	}
+
+	w.Write(respbytes)
+}
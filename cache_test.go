@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	lightning "github.com/fiatjaf/lightningd-gjson-rpc"
+	"github.com/tidwall/gjson"
+)
+
+// countingBackend answers every call with an empty object and counts them.
+type countingBackend struct{ calls int }
+
+func (b *countingBackend) Call(timeout time.Duration, req lightning.JSONRPCMessage) ([]byte, error) {
+	b.calls++
+	return []byte(`{}`), nil
+}
+
+func (b *countingBackend) Events() <-chan event { return nil }
+
+func (b *countingBackend) Help() (gjson.Result, error) { return gjson.Result{}, nil }
+
+func TestCacheBound(t *testing.T) {
+	defer func(ttls map[string]time.Duration) {
+		cacheTTLs = ttls
+		respCache = make(map[string]cachedResponse)
+	}(cacheTTLs)
+	cacheTTLs = map[string]time.Duration{"listnodes": time.Minute}
+	respCache = make(map[string]cachedResponse)
+
+	b := &countingBackend{}
+	call := func(i int) {
+		req := lightning.JSONRPCMessage{Method: "listnodes", Params: []interface{}{fmt.Sprint(i)}}
+		if _, err := callCached(nil, b, "", req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < MAXCACHEENTRIES*2; i++ {
+		call(i)
+	}
+	if len(respCache) != MAXCACHEENTRIES {
+		t.Errorf("cache has %d entries, expected at most %d", len(respCache), MAXCACHEENTRIES)
+	}
+
+	// the most recent entries are kept
+	calls := b.calls
+	call(MAXCACHEENTRIES*2 - 1)
+	if b.calls != calls {
+		t.Error("the most recent entry was evicted")
+	}
+	call(0)
+	if b.calls != calls+1 {
+		t.Error("the oldest entry wasn't evicted")
+	}
+
+	// expired entries go first
+	for key, cached := range respCache {
+		cached.expires = time.Now().Add(-time.Second)
+		respCache[key] = cached
+		break
+	}
+	call(MAXCACHEENTRIES * 3)
+	for key, cached := range respCache {
+		if time.Now().After(cached.expires) {
+			t.Errorf("expired entry %s wasn't evicted", key)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+// Companion mode, for when sparko runs as a standalone daemon (see
+// standalone.go). The same binary is loaded as a lightningd plugin with
+// `sparko-companion-socket` set and, instead of serving HTTP, forwards all
+// notifications and calls to sparko's own RPC methods to the daemon, which
+// connects to that Unix socket.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
+)
+
+type companionMessage struct {
+	Type   string          `json:"type"` // "notification", "call" or "result"
+	Id     int64           `json:"id,omitempty"`
+	Method string          `json:"method,omitempty"`
+	Params plugin.Params   `json:"params,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Code   int             `json:"code,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// companionLink is one end of the socket between the companion plugin and the
+// daemon. writes can come from many goroutines.
+type companionLink struct {
+	conn    net.Conn
+	mutex   sync.Mutex
+	encoder *json.Encoder
+}
+
+func newCompanionLink(conn net.Conn) *companionLink {
+	return &companionLink{conn: conn, encoder: json.NewEncoder(conn)}
+}
+
+func (link *companionLink) send(msg companionMessage) error {
+	link.mutex.Lock()
+	defer link.mutex.Unlock()
+	return link.encoder.Encode(msg)
+}
+
+var (
+	// set when running as the companion plugin
+	companionListening bool
+
+	companionMutex  sync.Mutex
+	companionDaemon *companionLink
+	companionCalls  = make(map[int64]chan companionMessage)
+	companionNextId int64
+)
+
+// wrapForCompanion makes all subscriptions and RPC methods be forwarded to the
+// daemon when running in companion mode. it must be called before p.Run().
+func wrapForCompanion(p *plugin.Plugin) {
+	for i := range p.Subscriptions {
+		typ := p.Subscriptions[i].Type
+		handler := p.Subscriptions[i].Handler
+		p.Subscriptions[i].Handler = func(p *plugin.Plugin, params plugin.Params) {
+			if !companionListening {
+				handler(p, params)
+				return
+			}
+
+			companionMutex.Lock()
+			daemon := companionDaemon
+			companionMutex.Unlock()
+			if daemon == nil {
+				return
+			}
+			daemon.send(companionMessage{Type: "notification", Method: typ, Params: params})
+		}
+	}
+
+	for i := range p.RPCMethods {
+		name := p.RPCMethods[i].Name
+		handler := p.RPCMethods[i].Handler
+		p.RPCMethods[i].Handler = func(p *plugin.Plugin, params plugin.Params) (interface{}, int, error) {
+			if !companionListening {
+				return handler(p, params)
+			}
+			return forwardCall(name, params)
+		}
+	}
+}
+
+func forwardCall(method string, params plugin.Params) (interface{}, int, error) {
+	companionMutex.Lock()
+	daemon := companionDaemon
+	if daemon == nil {
+		companionMutex.Unlock()
+		return nil, 503, errors.New("the sparko daemon is not connected")
+	}
+	companionNextId++
+	id := companionNextId
+	result := make(chan companionMessage, 1)
+	companionCalls[id] = result
+	companionMutex.Unlock()
+
+	defer func() {
+		companionMutex.Lock()
+		delete(companionCalls, id)
+		companionMutex.Unlock()
+	}()
+
+	if err := daemon.send(companionMessage{Type: "call", Id: id, Method: method, Params: params}); err != nil {
+		return nil, 503, err
+	}
+
+	select {
+	case res := <-result:
+		if res.Error != "" {
+			return nil, res.Code, errors.New(res.Error)
+		}
+		return res.Result, 0, nil
+	case <-time.After(ASYNCTIMEOUT):
+		return nil, 504, errors.New("the sparko daemon didn't answer")
+	}
+}
+
+// listenCompanion creates the socket with the given permissions from the start,
+// setting the umask while it's created instead of changing them afterwards,
+// and optionally gives it to another user and group ("user:group", "user" or
+// ":group"). nothing else is running yet in companion mode, so changing the
+// process umask is safe.
+func listenCompanion(path string, mode os.FileMode, owner string) (net.Listener, error) {
+	os.Remove(path)
+	umask := syscall.Umask(int(^mode & 0777))
+	listener, err := net.Listen("unix", path)
+	syscall.Umask(umask)
+	if err != nil {
+		return nil, err
+	}
+
+	if owner != "" {
+		uid, gid := -1, -1
+		spl := strings.SplitN(owner, ":", 2)
+		if spl[0] != "" {
+			u, err := user.Lookup(spl[0])
+			if err != nil {
+				listener.Close()
+				return nil, err
+			}
+			uid, _ = strconv.Atoi(u.Uid)
+		}
+		if len(spl) == 2 && spl[1] != "" {
+			g, err := user.LookupGroup(spl[1])
+			if err != nil {
+				listener.Close()
+				return nil, err
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+		if err := os.Chown(path, uid, gid); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+
+	return listener, nil
+}
+
+// startCompanion listens for the daemon on a Unix socket. only one daemon is
+// connected at a time, a new connection replaces the previous one.
+func startCompanion(p *plugin.Plugin, path string) {
+	mode := os.FileMode(0600)
+	if modestr, err := p.Args.String("sparko-companion-socket-mode"); err == nil && modestr != "" {
+		m, err := strconv.ParseUint(modestr, 8, 32)
+		if err != nil || m > 0777 {
+			p.Log("Error on sparko-companion-socket-mode: invalid mode '" + modestr + "'")
+			return
+		}
+		mode = os.FileMode(m)
+	}
+	owner, _ := p.Args.String("sparko-companion-socket-owner")
+
+	listener, err := listenCompanion(path, mode, owner)
+	if err != nil {
+		p.Log("Error listening on companion socket: " + err.Error())
+		return
+	}
+	companionListening = true
+	p.Log("Waiting for the sparko daemon on " + path)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			p.Log("Error accepting daemon connection: " + err.Error())
+			continue
+		}
+
+		link := newCompanionLink(conn)
+		companionMutex.Lock()
+		if companionDaemon != nil {
+			companionDaemon.conn.Close()
+		}
+		companionDaemon = link
+		companionMutex.Unlock()
+		p.Log("sparko daemon connected")
+
+		go func() {
+			decoder := json.NewDecoder(conn)
+			for {
+				var msg companionMessage
+				if err := decoder.Decode(&msg); err != nil {
+					break
+				}
+				if msg.Type != "result" {
+					continue
+				}
+				companionMutex.Lock()
+				if result, ok := companionCalls[msg.Id]; ok {
+					result <- msg
+				}
+				companionMutex.Unlock()
+			}
+
+			conn.Close()
+			companionMutex.Lock()
+			if companionDaemon == link {
+				companionDaemon = nil
+				p.Log("sparko daemon disconnected")
+			}
+			companionMutex.Unlock()
+		}()
+	}
+}
+
+// connectCompanion is used by the daemon to receive notifications and calls
+// from the companion plugin, reconnecting when the connection drops.
+func connectCompanion(p *plugin.Plugin, path string) {
+	subscriptions := make(map[string]plugin.NotificationHandler)
+	for _, sub := range p.Subscriptions {
+		subscriptions[sub.Type] = sub.Handler
+	}
+	methods := make(map[string]plugin.RPCMethod)
+	for _, method := range p.RPCMethods {
+		methods[method.Name] = method
+	}
+
+	for {
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			p.Log("Error connecting to the companion plugin: " + err.Error())
+			time.Sleep(time.Second * 5)
+			continue
+		}
+		p.Log("Connected to the companion plugin on " + path)
+
+		link := newCompanionLink(conn)
+		decoder := json.NewDecoder(conn)
+		for {
+			var msg companionMessage
+			if err := decoder.Decode(&msg); err != nil {
+				break
+			}
+
+			switch msg.Type {
+			case "notification":
+				if handler, ok := subscriptions[msg.Method]; ok {
+					go handler(p, msg.Params)
+				}
+			case "call":
+				go func(msg companionMessage) {
+					res := companionMessage{Type: "result", Id: msg.Id}
+					method, ok := methods[msg.Method]
+					if !ok {
+						res.Code = 404
+						res.Error = "unknown method " + msg.Method
+						link.send(res)
+						return
+					}
+
+					resp, errCode, err := method.Handler(p, msg.Params)
+					if err != nil {
+						if errCode == 0 {
+							errCode = -1
+						}
+						res.Code = errCode
+						res.Error = err.Error()
+					} else {
+						res.Result, _ = json.Marshal(resp)
+					}
+					link.send(res)
+				}(msg)
+			}
+		}
+
+		conn.Close()
+		p.Log("Lost connection to the companion plugin, reconnecting")
+		time.Sleep(time.Second)
+	}
+}
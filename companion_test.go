@@ -0,0 +1,36 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompanionSocketMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "companion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sparko.sock")
+
+	for _, mode := range []os.FileMode{0600, 0660} {
+		listener, err := listenCompanion(path, mode, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(path)
+		listener.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != mode {
+			t.Errorf("socket created with mode %o, expected %o", info.Mode().Perm(), mode)
+		}
+	}
+
+	if _, err := listenCompanion(path, 0600, "no-such-user-here"); err == nil {
+		t.Error("socket given to an unknown user")
+	}
+}
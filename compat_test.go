@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+const fixtureChannel = "ad5a1e4e2a2b6bd3c1f8e7f3c7d3e1c0b1f1e9e1a1b1c1d1e1f1011121314150"
+
+// fixtureMethods answers each method with the response recorded from a
+// lightningd version in testdata/cln/<version>/<method>.json.
+func fixtureMethods(t *testing.T, version string) map[string]MethodHandler {
+	files, err := filepath.Glob(filepath.Join("testdata", "cln", version, "*.json"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no fixtures for %s", version)
+	}
+
+	methods := make(map[string]MethodHandler)
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response := json.RawMessage(b)
+		methods[strings.TrimSuffix(filepath.Base(file), ".json")] = func(params gjson.Result) (interface{}, *RPCError) {
+			return response, nil
+		}
+	}
+	methods["connect"] = func(params gjson.Result) (interface{}, *RPCError) {
+		return map[string]interface{}{"id": params.Get("0").String()}, nil
+	}
+	methods["fundchannel"] = func(params gjson.Result) (interface{}, *RPCError) {
+		return map[string]interface{}{"channel_id": fixtureChannel, "txid": "ff"}, nil
+	}
+	methods["close"] = func(params gjson.Result) (interface{}, *RPCError) {
+		return map[string]interface{}{"channel_id": fixtureChannel, "type": "mutual", "txid": "ee"}, nil
+	}
+	return methods
+}
+
+func TestCLNVersions(t *testing.T) {
+	versions, err := ioutil.ReadDir(filepath.Join("testdata", "cln"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, version := range versions {
+		version := version.Name()
+		t.Run(version, func(t *testing.T) {
+			ln := StartLightningd(t, map[string]interface{}{
+				"sparko-keys": "k; lp: listpeers; lpc: listpeerchannels",
+			}, fixtureMethods(t, version))
+
+			res, rpcerr := ln.CallPlugin("connectfund", []interface{}{
+				"022d223620a359a47ff7f7ac447c85c46c923da53389221a0054c11c1e3ca31d59@127.0.0.1:9735", "1000000", "normal",
+			})
+			if rpcerr.Exists() {
+				t.Fatalf("connectfund failed: %s", rpcerr.Raw)
+			}
+			checkChannel(t, "connectfund", res)
+
+			channels := restGet(t, ln, "k", "/v1/channels")
+			if channels.Get("channels.#").Int() != 1 ||
+				channels.Get("channels.0.channel_id").String() != fixtureChannel ||
+				channels.Get("channels.0.peer_id").String() != "022d223620a359a47ff7f7ac447c85c46c923da53389221a0054c11c1e3ca31d59" {
+				t.Errorf("wrong channels from /v1/channels: %s", channels.Raw)
+			}
+
+			// keys need the method that is called on this version
+			allowed, denied := "lp", "lpc"
+			if hasListPeerChannels(parseCLNVersion(version)) {
+				allowed, denied = "lpc", "lp"
+			}
+			if channels := restGet(t, ln, allowed, "/v1/channels"); channels.Get("channels.#").Int() != 1 {
+				t.Errorf("wrong channels from /v1/channels with %s: %s", allowed, channels.Raw)
+			}
+			req, _ := http.NewRequest("GET", ln.URL("/v1/channels"), nil)
+			req.Header.Set("X-Access", denied)
+			if resp, err := http.DefaultClient.Do(req); err != nil {
+				t.Fatal(err)
+			} else if resp.Body.Close(); resp.StatusCode != 401 {
+				t.Errorf("/v1/channels with %s: expected 401, got %d", denied, resp.StatusCode)
+			}
+
+			res, rpcerr = ln.CallPlugin("closeget", []interface{}{
+				"022d223620a359a47ff7f7ac447c85c46c923da53389221a0054c11c1e3ca31d59@127.0.0.1:9735", fixtureChannel, false, 30,
+			})
+			if rpcerr.Exists() {
+				t.Fatalf("closeget failed: %s", rpcerr.Raw)
+			}
+			checkChannel(t, "closeget", res)
+
+			res, rpcerr = ln.CallPlugin("listpaysext", []interface{}{})
+			if rpcerr.Exists() {
+				t.Fatalf("listpaysext failed: %s", rpcerr.Raw)
+			}
+			complete := res.Get(`pays.#(status=="complete")`)
+			if complete.Get("payment_hash").String() != "66687aadf862bd776c8fc18b8e9f8e20089714856ee233b3902a591d0d5f2925" ||
+				complete.Get("created_at").Int() != 1600000000 ||
+				complete.Get("msatoshi_sent").Int() != 1001 {
+				t.Errorf("wrong listpaysext result: %s", res.Raw)
+			}
+
+			invpaid := streamEvent(t, ln, "k", "inv-paid", func() {
+				ln.Notify("invoice_payment", map[string]interface{}{
+					"invoice_payment": map[string]interface{}{"label": "l1", "preimage": "00", "msat": "5000msat"},
+				})
+			})
+			if gjson.Get(invpaid, "msatoshi_received").Int() != 5000 || gjson.Get(invpaid, "label").String() != "l1" {
+				t.Errorf("wrong inv-paid event: %s", invpaid)
+			}
+		})
+	}
+}
+
+// checkChannel checks the channel returned by the Spark methods has the shape
+// of old lightningd versions.
+func checkChannel(t *testing.T, method string, res gjson.Result) {
+	if res.Get("peer.id").String() != "022d223620a359a47ff7f7ac447c85c46c923da53389221a0054c11c1e3ca31d59" ||
+		res.Get("peer.channels").Exists() {
+		t.Errorf("wrong peer from %s: %s", method, res.Get("peer").Raw)
+	}
+	channel := res.Get("chan")
+	if channel.Get("channel_id").String() != fixtureChannel ||
+		channel.Get("state").String() != "CHANNELD_NORMAL" ||
+		channel.Get("msatoshi_total").Int() != 1000000000 ||
+		channel.Get("msatoshi_to_us").Int() != 400000000 ||
+		channel.Get("peer_id").Exists() {
+		t.Errorf("wrong channel from %s: %s", method, channel.Raw)
+	}
+}
+
+// restGet calls one of the /v1 routes.
+func restGet(t *testing.T, ln *FakeLightningd, key string, path string) gjson.Result {
+	req, _ := http.NewRequest("GET", ln.URL(path), nil)
+	req.Header.Set("X-Access", key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		t.Errorf("GET %s returned %d: %s", path, resp.StatusCode, b)
+	}
+	return gjson.ParseBytes(b)
+}
+
+// streamEvent listens on /stream while trigger runs and returns the data of
+// the first event of the given type.
+func streamEvent(t *testing.T, ln *FakeLightningd, key string, typ string, trigger func()) string {
+	req, _ := http.NewRequest("GET", ln.URL("/stream"), nil)
+	req.Header.Set("X-Access", key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	data := make(chan string, 1)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		current := ""
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.HasPrefix(line, "event: ") {
+				current = strings.TrimPrefix(line, "event: ")
+			}
+			if strings.HasPrefix(line, "data: ") && current == typ {
+				data <- strings.TrimPrefix(line, "data: ")
+				return
+			}
+		}
+	}()
+
+	// give the stream some time to be registered
+	time.Sleep(time.Millisecond * 200)
+	trigger()
+
+	select {
+	case d := <-data:
+		return d
+	case <-time.After(time.Second * 5):
+		t.Fatalf("didn't get a %s event", typ)
+		return ""
+	}
+}
+
+func TestCLNVersionRetry(t *testing.T) {
+	methods := fixtureMethods(t, "v24.08.1")
+	getinfo := methods["getinfo"]
+	var failed int32
+	methods["getinfo"] = func(params gjson.Result) (interface{}, *RPCError) {
+		if atomic.AddInt32(&failed, 1) == 1 {
+			return nil, &RPCError{-1, "lightningd is still starting"}
+		}
+		return getinfo(params)
+	}
+	ln := StartLightningd(t, nil, methods)
+
+	// the first time the version can't be known, so the channel isn't found
+	// in the old place, but the next call asks for the version again
+	peeruri := "022d223620a359a47ff7f7ac447c85c46c923da53389221a0054c11c1e3ca31d59@127.0.0.1:9735"
+	if _, rpcerr := ln.CallPlugin("connectfund", []interface{}{peeruri, "1000000", "normal"}); !rpcerr.Exists() {
+		t.Error("connectfund shouldn't find the channel without knowing the version")
+	}
+	res, rpcerr := ln.CallPlugin("connectfund", []interface{}{peeruri, "1000000", "normal"})
+	if rpcerr.Exists() {
+		t.Fatalf("connectfund failed after getting the version: %s", rpcerr.Raw)
+	}
+	checkChannel(t, "connectfund", res)
+	if calls := len(ln.Calls("getinfo")); calls != 2 {
+		t.Errorf("version should be asked again once, got %d getinfo calls", calls)
+	}
+}
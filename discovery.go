@@ -0,0 +1,148 @@
+// An OpenRPC document describing the methods available at /rpc, generated from
+// lightningd's `help` output, so clients can discover what they can call.
+// https://spec.open-rpc.org/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
+)
+
+type OpenRPCMethod struct {
+	Name        string               `json:"name"`
+	Summary     string               `json:"summary,omitempty"`
+	Description string               `json:"description,omitempty"`
+	Tags        []OpenRPCTag         `json:"tags,omitempty"`
+	Params      []OpenRPCContentDesc `json:"params"`
+	Result      OpenRPCContentDesc   `json:"result"`
+	ParamStruct string               `json:"paramStructure"`
+}
+
+type OpenRPCTag struct {
+	Name string `json:"name"`
+}
+
+type OpenRPCContentDesc struct {
+	Name     string                 `json:"name"`
+	Required bool                   `json:"required,omitempty"`
+	Schema   map[string]interface{} `json:"schema"`
+}
+
+var (
+	methodsMutex sync.RWMutex
+	methods      = make(map[string][]OpenRPCMethod) // by node, "" being the local one
+)
+
+// loadMethods calls `help` on a node and parses every command into an
+// OpenRPC method.
+func loadMethods(node string) error {
+	b, ok := nodeBackend(node)
+	if !ok {
+		return errors.New("unknown node '" + node + "'")
+	}
+	res, err := b.Help()
+	if err != nil {
+		return err
+	}
+
+	loaded := make([]OpenRPCMethod, 0)
+	for _, entry := range res.Get("help").Array() {
+		parts := strings.Fields(entry.Get("command").String())
+		if len(parts) == 0 {
+			continue
+		}
+
+		params := make([]OpenRPCContentDesc, 0, len(parts)-1)
+		for _, param := range parts[1:] {
+			required := true
+			if strings.HasPrefix(param, "[") && strings.HasSuffix(param, "]") {
+				required = false
+				param = param[1 : len(param)-1]
+			}
+			schema := map[string]interface{}{}
+			if strings.HasSuffix(param, "...") {
+				param = strings.TrimSuffix(param, "...")
+				schema["type"] = "array"
+			}
+			params = append(params, OpenRPCContentDesc{
+				Name:     param,
+				Required: required,
+				Schema:   schema,
+			})
+		}
+
+		method := OpenRPCMethod{
+			Name:        parts[0],
+			Summary:     entry.Get("description").String(),
+			Description: entry.Get("verbose").String(),
+			Params:      params,
+			Result: OpenRPCContentDesc{
+				Name:   "result",
+				Schema: map[string]interface{}{"type": "object"},
+			},
+			ParamStruct: "either",
+		}
+		if category := entry.Get("category").String(); category != "" {
+			method.Tags = []OpenRPCTag{{category}}
+		}
+		loaded = append(loaded, method)
+	}
+
+	methodsMutex.Lock()
+	methods[node] = loaded
+	methodsMutex.Unlock()
+
+	return nil
+}
+
+// handleDiscovery serves the OpenRPC document of a node, listing only the
+// methods the requesting key is allowed to call on it. `?refresh=true` reloads
+// the list from the node.
+func handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	p := r.Context().Value("plugin").(*plugin.Plugin)
+	node := requestNode(r)
+	if _, ok := nodeBackend(node); !ok {
+		w.WriteHeader(404)
+		return
+	}
+
+	methodsMutex.RLock()
+	empty := len(methods[node]) == 0
+	methodsMutex.RUnlock()
+
+	if empty || r.URL.Query().Get("refresh") == "true" {
+		if err := loadMethods(node); err != nil {
+			p.Log("failed to load methods from `help`: " + err.Error())
+			w.WriteHeader(502)
+			return
+		}
+	}
+
+	methodsMutex.RLock()
+	allowed := make([]OpenRPCMethod, 0, len(methods[node]))
+	for _, method := range methods[node] {
+		if isAllowed(r, method.Name) {
+			allowed = append(allowed, method)
+		}
+	}
+	methodsMutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"openrpc": "1.2.6",
+		"info": map[string]interface{}{
+			"title":   "sparko",
+			"version": p.Version,
+		},
+		"servers": []map[string]interface{}{
+			{"name": "sparko", "url": nodePath(node) + "/rpc"},
+		},
+		"methods": allowed,
+	})
+}
@@ -0,0 +1,2019 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/tidwall/gjson"
+)
+
+var getinfo = map[string]MethodHandler{
+	"getinfo": func(params gjson.Result) (interface{}, *RPCError) {
+		return map[string]interface{}{"id": "02aa", "alias": "fake", "blockheight": 100}, nil
+	},
+}
+
+func rpcRequest(t *testing.T, ln *FakeLightningd, key string, body string) (int, gjson.Result) {
+	req, _ := http.NewRequest("POST", ln.URL("/rpc"), strings.NewReader(body))
+	if key != "" {
+		req.Header.Set("X-Access", key)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, gjson.ParseBytes(b)
+}
+
+func TestManifest(t *testing.T) {
+	ln := StartLightningd(t, nil, nil)
+
+	methods := ln.Manifest.Get("result.rpcmethods.#.name").String()
+	for _, method := range []string{"connectfund", "closeget", "listpaysext"} {
+		if !strings.Contains(methods, `"`+method+`"`) {
+			t.Errorf("manifest doesn't declare %s: %s", method, methods)
+		}
+	}
+	if !ln.Manifest.Get(`result.options.#(name=="sparko-keys")`).Exists() {
+		t.Error("manifest doesn't declare sparko-keys")
+	}
+	if !strings.Contains(ln.Manifest.Get("result.subscriptions").String(), "invoice_payment") {
+		t.Error("manifest doesn't subscribe to invoice_payment")
+	}
+}
+
+func TestRPCKeys(t *testing.T) {
+	ln := StartLightningd(t, map[string]interface{}{
+		"sparko-keys": "masterkey; readkey: getinfo, listfunds",
+	}, getinfo)
+
+	status, _ := rpcRequest(t, ln, "", `{"method": "getinfo"}`)
+	if status != 401 {
+		t.Errorf("call without a key: expected 401, got %d", status)
+	}
+	status, _ = rpcRequest(t, ln, "wrongkey", `{"method": "getinfo"}`)
+	if status != 401 {
+		t.Errorf("call with an unknown key: expected 401, got %d", status)
+	}
+
+	status, res := rpcRequest(t, ln, "masterkey", `{"method": "getinfo"}`)
+	if status != 200 || res.Get("id").String() != "02aa" {
+		t.Errorf("getinfo with the master key: got %d %s", status, res.Raw)
+	}
+	status, res = rpcRequest(t, ln, "readkey", `{"method": "getinfo", "params": {}}`)
+	if status != 200 || res.Get("alias").String() != "fake" {
+		t.Errorf("getinfo with a restricted key: got %d %s", status, res.Raw)
+	}
+
+	status, _ = rpcRequest(t, ln, "readkey", `{"method": "pay", "params": ["lnbc1"]}`)
+	if status != 401 {
+		t.Errorf("pay with a restricted key: expected 401, got %d", status)
+	}
+	if len(ln.Calls("pay")) != 0 {
+		t.Error("pay shouldn't have reached lightningd")
+	}
+}
+
+func TestRPCParamsAndErrors(t *testing.T) {
+	ln := StartLightningd(t, map[string]interface{}{"sparko-keys": "k"}, map[string]MethodHandler{
+		"invoice": func(params gjson.Result) (interface{}, *RPCError) {
+			if params.Get("label").String() == "taken" {
+				return nil, &RPCError{900, "Duplicate label 'taken'"}
+			}
+			return map[string]interface{}{"bolt11": "lnbcrt1fake"}, nil
+		},
+	})
+
+	status, res := rpcRequest(t, ln, "k", `{"method": "invoice", "params": {"amount_msat": 1000, "label": "new", "description": "x"}}`)
+	if status != 200 || res.Get("bolt11").String() != "lnbcrt1fake" {
+		t.Errorf("invoice: got %d %s", status, res.Raw)
+	}
+	calls := ln.Calls("invoice")
+	if len(calls) != 1 || calls[0].Get("params.amount_msat").Int() != 1000 {
+		t.Errorf("params not passed to lightningd: %v", calls)
+	}
+
+	status, res = rpcRequest(t, ln, "k", `{"method": "invoice", "params": {"amount_msat": 1000, "label": "taken", "description": "x"}}`)
+	if status != 500 || res.Get("code").Int() != 900 || res.Get("type").String() != "lightning" {
+		t.Errorf("invoice error: got %d %s", status, res.Raw)
+	}
+
+	status, res = rpcRequest(t, ln, "k", `{"method": "nonexisting"}`)
+	if status != 500 || res.Get("code").Int() != -32601 {
+		t.Errorf("unknown method: got %d %s", status, res.Raw)
+	}
+
+	status, _ = rpcRequest(t, ln, "k", `not json`)
+	if status != 400 {
+		t.Errorf("invalid body: expected 400, got %d", status)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	ln := StartLightningd(t, map[string]interface{}{"sparko-login": "user:pass"}, getinfo)
+
+	req, _ := http.NewRequest("POST", ln.URL("/rpc"), strings.NewReader(`{"method": "getinfo"}`))
+	req.SetBasicAuth("user", "pass")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("basic auth: expected 200, got %d", resp.StatusCode)
+	}
+	var cookie *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == "user" {
+			cookie = c
+		}
+	}
+	if cookie == nil {
+		t.Fatal("login didn't set the session cookie")
+	}
+
+	// the cookie alone is enough afterwards
+	req, _ = http.NewRequest("POST", ln.URL("/rpc"), strings.NewReader(`{"method": "getinfo"}`))
+	req.AddCookie(cookie)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("cookie auth: expected 200, got %d", resp.StatusCode)
+	}
+
+	req, _ = http.NewRequest("POST", ln.URL("/rpc"), strings.NewReader(`{"method": "getinfo"}`))
+	req.SetBasicAuth("user", "wrong")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 401 {
+		t.Errorf("wrong password: expected 401, got %d", resp.StatusCode)
+	}
+}
+
+func TestLNURLAuth(t *testing.T) {
+	allowed, _ := testKey(t, "0000000000000000000000000000000000000000000000000000000000000001")
+	other, _ := testKey(t, "0000000000000000000000000000000000000000000000000000000000000002")
+	linkingKey := hex.EncodeToString(allowed.PubKey().SerializeCompressed())
+	otherKey := hex.EncodeToString(other.PubKey().SerializeCompressed())
+	ln := StartLightningd(t, map[string]interface{}{"sparko-lnurlauth-keys": linkingKey}, getinfo)
+
+	challenge := func() string {
+		resp, err := http.Get(ln.URL("/login"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		m := regexp.MustCompile(`/lnurlauth/([0-9a-f]{64})/status`).FindSubmatch(b)
+		if m == nil {
+			t.Fatalf("no challenge in the login page: %s", b)
+		}
+		return string(m[1])
+	}
+	sign := func(sk *btcec.PrivateKey, k1 string) string {
+		k1b, _ := hex.DecodeString(k1)
+		return hex.EncodeToString(ecdsa.Sign(sk, k1b).Serialize())
+	}
+	callback := func(k1 string, key string, sig string) gjson.Result {
+		return lnurlGet(t, ln, "/lnurlauth/callback?tag=login&k1="+k1+"&key="+key+"&sig="+sig)
+	}
+	status := func(k1 string) *http.Response {
+		resp, err := http.Get(ln.URL("/lnurlauth/" + k1 + "/status"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	k1 := challenge()
+	if resp := status(k1); resp.StatusCode != 202 {
+		t.Errorf("unsigned challenge: expected 202, got %d", resp.StatusCode)
+	}
+
+	// the signature must be of this challenge by the linking key given
+	if res := callback(k1, linkingKey, sign(other, k1)); res.Get("reason").String() != "invalid signature" {
+		t.Errorf("signature by another key: %s", res.Raw)
+	}
+	if res := callback(k1, linkingKey, sign(allowed, challenge())); res.Get("reason").String() != "invalid signature" {
+		t.Errorf("signature of another challenge: %s", res.Raw)
+	}
+	if res := callback(k1, otherKey, sign(other, k1)); res.Get("reason").String() != "this key is not allowed" {
+		t.Errorf("unknown linking key: %s", res.Raw)
+	}
+	if res := callback(strings.Repeat("00", 32), linkingKey, sign(allowed, strings.Repeat("00", 32))); res.Get("status").String() != "ERROR" {
+		t.Errorf("unknown challenge: %s", res.Raw)
+	}
+	if resp := status(k1); resp.StatusCode != 202 {
+		t.Errorf("failed attempts shouldn't sign the challenge: got %d", resp.StatusCode)
+	}
+
+	if res := callback(k1, linkingKey, sign(allowed, k1)); res.Get("status").String() != "OK" {
+		t.Fatalf("valid signature: %s", res.Raw)
+	}
+	if res := callback(k1, linkingKey, sign(allowed, k1)); res.Get("status").String() != "ERROR" {
+		t.Errorf("a challenge was signed twice: %s", res.Raw)
+	}
+
+	resp := status(k1)
+	var cookie *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == "user" {
+			cookie = c
+		}
+	}
+	if resp.StatusCode != 200 || cookie == nil {
+		t.Fatalf("signed challenge should set the session cookie: %d %v", resp.StatusCode, resp.Cookies())
+	}
+	if resp := status(k1); resp.StatusCode != 404 || len(resp.Cookies()) != 0 {
+		t.Errorf("a challenge was used twice: %d", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest("POST", ln.URL("/rpc"), strings.NewReader(`{"method": "getinfo"}`))
+	req.AddCookie(cookie)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("cookie from LNURL-auth: expected 200, got %d", resp.StatusCode)
+	}
+}
+
+func TestCache(t *testing.T) {
+	ln := StartLightningd(t, map[string]interface{}{
+		"sparko-keys":  "k",
+		"sparko-cache": "getinfo:60",
+	}, getinfo)
+
+	request := func(etag string) *http.Response {
+		req, _ := http.NewRequest("POST", ln.URL("/rpc"), strings.NewReader(`{"method": "getinfo"}`))
+		req.Header.Set("X-Access", "k")
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+
+	first := request("")
+	etag := first.Header.Get("ETag")
+	if first.StatusCode != 200 || etag == "" {
+		t.Fatalf("expected a 200 with an ETag, got %d %q", first.StatusCode, etag)
+	}
+	if resp := request(""); resp.StatusCode != 200 || len(ln.Calls("getinfo")) != 1 {
+		t.Errorf("second call should come from the cache: %d, %d calls", resp.StatusCode, len(ln.Calls("getinfo")))
+	}
+	if resp := request(etag); resp.StatusCode != 304 {
+		t.Errorf("If-None-Match with the same ETag: expected 304, got %d", resp.StatusCode)
+	}
+	if resp := request(`"other", W/` + etag); resp.StatusCode != 304 {
+		t.Errorf("If-None-Match with a list of ETags: expected 304, got %d", resp.StatusCode)
+	}
+	if resp := request(`"other"`); resp.StatusCode != 200 {
+		t.Errorf("If-None-Match with another ETag: expected 200, got %d", resp.StatusCode)
+	}
+
+	// events that may change the result drop it from the cache
+	streamEvent(t, ln, "k", "connect", func() {
+		ln.Notify("connect", map[string]interface{}{"id": "02bb", "address": map[string]interface{}{}})
+	})
+	request("")
+	if calls := ln.Calls("getinfo"); len(calls) != 2 {
+		t.Errorf("the cache should be invalidated by connect, got %d calls", len(calls))
+	}
+}
+
+func TestStream(t *testing.T) {
+	ln := StartLightningd(t, map[string]interface{}{
+		"sparko-keys": "listener: stream; other: getinfo",
+	}, map[string]MethodHandler{
+		"waitinvoice": func(params gjson.Result) (interface{}, *RPCError) {
+			return map[string]interface{}{"label": "l1", "status": "paid", "amount_received_msat": 5000}, nil
+		},
+	})
+
+	req, _ := http.NewRequest("GET", ln.URL("/stream"), nil)
+	req.Header.Set("X-Access", "other")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 401 {
+		t.Errorf("stream without permission: expected 401, got %d", resp.StatusCode)
+	}
+
+	req, _ = http.NewRequest("GET", ln.URL("/stream"), nil)
+	req.Header.Set("X-Access", "listener")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	events := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		typ := ""
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.HasPrefix(line, "event: ") {
+				typ = strings.TrimPrefix(line, "event: ")
+			}
+			if strings.HasPrefix(line, "data: ") && typ != "" && typ != "keepalive" {
+				events <- typ + " " + strings.TrimPrefix(line, "data: ")
+			}
+		}
+		close(events)
+	}()
+
+	// give the stream some time to be registered
+	time.Sleep(time.Millisecond * 200)
+	ln.Notify("connect", map[string]interface{}{"id": "02bb", "address": map[string]interface{}{}})
+	ln.Notify("invoice_payment", map[string]interface{}{
+		"invoice_payment": map[string]interface{}{"label": "l1", "preimage": "00", "msat": "5000msat"},
+	})
+
+	expected := []string{"connect", "invoice_payment", "inv-paid"}
+	seen := make(map[string]string)
+	timeout := time.After(time.Second * 5)
+	for len(seen) < len(expected) {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				t.Fatal("stream closed")
+			}
+			spl := strings.SplitN(e, " ", 2)
+			seen[spl[0]] = spl[1]
+		case <-timeout:
+			t.Fatalf("didn't get all events, got %v", seen)
+		}
+	}
+
+	if gjson.Get(seen["connect"], "id").String() != "02bb" {
+		t.Errorf("wrong connect event: %s", seen["connect"])
+	}
+	if gjson.Get(seen["inv-paid"], "label").String() != "l1" {
+		t.Errorf("wrong inv-paid event: %s", seen["inv-paid"])
+	}
+}
+
+// listenStream returns the events, as "type data", of a stream that stays
+// open until the end of the test.
+func listenStream(t *testing.T, ln *FakeLightningd, key string, path string, header map[string]string) <-chan string {
+	req, _ := http.NewRequest("GET", ln.URL(path), nil)
+	req.Header.Set("X-Access", key)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != 200 {
+		t.Fatalf("stream at %s with key %s: got %d", path, key, resp.StatusCode)
+	}
+
+	events := make(chan string, 100)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		typ := ""
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.HasPrefix(line, "event: ") {
+				typ = strings.TrimPrefix(line, "event: ")
+			}
+			if strings.HasPrefix(line, "data: ") && typ != "" && typ != "keepalive" {
+				events <- typ + " " + strings.TrimPrefix(line, "data: ")
+			}
+		}
+	}()
+
+	// give the stream some time to be registered
+	time.Sleep(time.Millisecond * 200)
+	return events
+}
+
+// receivedEvents collects the events of the given type that arrive in a second.
+func receivedEvents(events <-chan string, typ string) []string {
+	var received []string
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case e := <-events:
+			if spl := strings.SplitN(e, " ", 2); spl[0] == typ {
+				received = append(received, spl[1])
+			}
+		case <-timeout:
+			return received
+		}
+	}
+}
+
+func TestAsyncJobs(t *testing.T) {
+	ln := StartLightningd(t, map[string]interface{}{
+		"sparko-keys": "alice: pay, stream; bob: pay, stream",
+	}, map[string]MethodHandler{
+		"pay": func(params gjson.Result) (interface{}, *RPCError) {
+			return map[string]interface{}{"status": "complete", "payment_preimage": "aa11"}, nil
+		},
+	})
+
+	aliceEvents := listenStream(t, ln, "alice", "/stream", nil)
+	bobEvents := listenStream(t, ln, "bob", "/stream", nil)
+
+	req, _ := http.NewRequest("POST", ln.URL("/rpc?async=1"), strings.NewReader(`{"method": "pay", "params": ["lnbcrt1"]}`))
+	req.Header.Set("X-Access", "alice")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	id := gjson.GetBytes(b, "job").String()
+	if resp.StatusCode != 202 || id == "" {
+		t.Fatalf("async call: got %d %s", resp.StatusCode, b)
+	}
+
+	completed := receivedEvents(aliceEvents, "job-complete")
+	if len(completed) != 1 || gjson.Get(completed[0], "result.payment_preimage").String() != "aa11" {
+		t.Errorf("the key that made the call should get its result: %v", completed)
+	}
+	if completed := receivedEvents(bobEvents, "job-complete"); len(completed) != 0 {
+		t.Errorf("other keys shouldn't get the result: %v", completed)
+	}
+
+	for key, expected := range map[string]int{"alice": 200, "bob": 404} {
+		req, _ := http.NewRequest("GET", ln.URL("/jobs/"+id), nil)
+		req.Header.Set("X-Access", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Errorf("job with key %s: expected %d, got %d %s", key, expected, resp.StatusCode, b)
+		}
+	}
+}
+
+// asyncCall makes an async call and waits for its job to finish.
+func asyncCall(t *testing.T, ln *FakeLightningd, key string, idempotencyKey string, body string) gjson.Result {
+	req, _ := http.NewRequest("POST", ln.URL("/rpc?async=1"), strings.NewReader(body))
+	req.Header.Set("X-Access", key)
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	id := gjson.GetBytes(b, "job").String()
+	if resp.StatusCode != 202 || id == "" {
+		t.Fatalf("async call: got %d %s", resp.StatusCode, b)
+	}
+
+	for i := 0; i < 50; i++ {
+		req, _ := http.NewRequest("GET", ln.URL("/jobs/"+id), nil)
+		req.Header.Set("X-Access", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if job := gjson.ParseBytes(b); job.Get("status").String() != "pending" {
+			return job
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	t.Fatalf("job %s didn't finish", id)
+	return gjson.Result{}
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	ln := StartLightningd(t, map[string]interface{}{
+		"sparko-keys": "alice: pay; bob: pay",
+	}, map[string]MethodHandler{
+		"pay": func(params gjson.Result) (interface{}, *RPCError) {
+			return map[string]interface{}{"status": "complete", "payment_preimage": "aa11"}, nil
+		},
+	})
+
+	pay := `{"method": "pay", "params": ["lnbcrt1"]}`
+	first := asyncCall(t, ln, "alice", "idem1", pay)
+	retry := asyncCall(t, ln, "alice", "idem1", pay)
+	if first.Get("status").String() != "complete" || retry.Get("result.payment_preimage").String() != "aa11" {
+		t.Errorf("retry should get the same result: %s, %s", first.Raw, retry.Raw)
+	}
+	if calls := ln.Calls("pay"); len(calls) != 1 {
+		t.Errorf("async retries with the same Idempotency-Key should pay once, paid %d times", len(calls))
+	}
+
+	// sync retries too
+	req, _ := http.NewRequest("POST", ln.URL("/rpc"), strings.NewReader(pay))
+	req.Header.Set("X-Access", "alice")
+	req.Header.Set("Idempotency-Key", "idem1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 || len(ln.Calls("pay")) != 1 {
+		t.Errorf("sync retry: got %d, paid %d times", resp.StatusCode, len(ln.Calls("pay")))
+	}
+
+	other := asyncCall(t, ln, "alice", "idem1", `{"method": "pay", "params": ["lnbcrt2"]}`)
+	if other.Get("status").String() != "failed" || other.Get("error.code").Int() != 422 {
+		t.Errorf("same key with another call should fail: %s", other.Raw)
+	}
+
+	// keys of other access keys are not the same
+	bob := asyncCall(t, ln, "bob", "idem1", `{"method": "pay", "params": ["lnbcrt2"]}`)
+	if bob.Get("status").String() != "complete" || len(ln.Calls("pay")) != 2 {
+		t.Errorf("another access key should have its own idempotency keys: %s", bob.Raw)
+	}
+}
+
+var listpeers = func(params gjson.Result) (interface{}, *RPCError) {
+	return map[string]interface{}{
+		"peers": []interface{}{
+			map[string]interface{}{
+				"id":        "02bb",
+				"connected": true,
+				"channels": []interface{}{
+					map[string]interface{}{"channel_id": "cc01", "short_channel_id": "103x1x0", "state": "CHANNELD_NORMAL"},
+				},
+			},
+		},
+	}, nil
+}
+
+func TestConnectFund(t *testing.T) {
+	ln := StartLightningd(t, nil, map[string]MethodHandler{
+		"connect": func(params gjson.Result) (interface{}, *RPCError) {
+			return map[string]interface{}{"id": "02bb"}, nil
+		},
+		"fundchannel": func(params gjson.Result) (interface{}, *RPCError) {
+			return map[string]interface{}{"channel_id": "cc01", "txid": "ff"}, nil
+		},
+		"listpeers": listpeers,
+	})
+
+	res, rpcerr := ln.CallPlugin("connectfund", []interface{}{"02bb@127.0.0.1:9735", "100000", "normal"})
+	if rpcerr.Exists() {
+		t.Fatalf("connectfund failed: %s", rpcerr.Raw)
+	}
+
+	if calls := ln.Calls("connect"); len(calls) != 1 || calls[0].Get("params.0").String() != "02bb@127.0.0.1:9735" {
+		t.Errorf("wrong connect calls: %v", calls)
+	}
+	if calls := ln.Calls("fundchannel"); len(calls) != 1 || calls[0].Get("params.0").String() != "02bb" {
+		t.Errorf("wrong fundchannel calls: %v", calls)
+	}
+	if res.Get("chan.channel_id").String() != "cc01" || res.Get("peer.id").String() != "02bb" {
+		t.Errorf("wrong connectfund result: %s", res.Raw)
+	}
+
+	ln.Handle("fundchannel", func(params gjson.Result) (interface{}, *RPCError) {
+		return nil, &RPCError{301, "Cannot afford"}
+	})
+	_, rpcerr = ln.CallPlugin("connectfund", []interface{}{"02bb@127.0.0.1:9735", "100000", "normal"})
+	if !rpcerr.Exists() {
+		t.Error("connectfund should fail when fundchannel fails")
+	}
+}
+
+func TestConnectFundPSBT(t *testing.T) {
+	ln := StartLightningd(t, map[string]interface{}{"sparko-keys": "k"}, map[string]MethodHandler{
+		"connect": func(params gjson.Result) (interface{}, *RPCError) {
+			return map[string]interface{}{"id": "02bb"}, nil
+		},
+		"fundchannel_start": func(params gjson.Result) (interface{}, *RPCError) {
+			return map[string]interface{}{"funding_address": "bcrt1qfunding", "scriptpubkey": "0020ab"}, nil
+		},
+		"fundchannel_complete": func(params gjson.Result) (interface{}, *RPCError) {
+			if params.Get("psbt").String() != "cHNidP8signed" {
+				return nil, &RPCError{300, "No output to funding address"}
+			}
+			return map[string]interface{}{"channel_id": "cc01", "commitments_secured": true}, nil
+		},
+		"fundchannel_cancel": func(params gjson.Result) (interface{}, *RPCError) {
+			return map[string]interface{}{"cancelled": "Channel open canceled"}, nil
+		},
+		"sendpsbt": func(params gjson.Result) (interface{}, *RPCError) {
+			return map[string]interface{}{"tx": "02000000", "txid": "ff01"}, nil
+		},
+		"listpeers": listpeers,
+	})
+
+	var res, rpcerr gjson.Result
+	started := streamEvent(t, ln, "k", "funding-started", func() {
+		res, rpcerr = ln.CallPlugin("connectfund-start", []interface{}{"02bb@127.0.0.1:9735", 100000})
+	})
+	if rpcerr.Exists() {
+		t.Fatalf("connectfund-start failed: %s", rpcerr.Raw)
+	}
+	if res.Get("funding_address").String() != "bcrt1qfunding" || gjson.Get(started, "peer_id").String() != "02bb" {
+		t.Errorf("wrong connectfund-start result: %s, event: %s", res.Raw, started)
+	}
+	if calls := ln.Calls("fundchannel_start"); len(calls) != 1 || calls[0].Get("params.amount").Int() != 100000 {
+		t.Errorf("wrong fundchannel_start calls: %v", calls)
+	}
+
+	failed := streamEvent(t, ln, "k", "funding-failed", func() {
+		_, rpcerr = ln.CallPlugin("connectfund-complete", []interface{}{"02bb", "cHNidP8wrong"})
+	})
+	if !rpcerr.Exists() || !strings.Contains(gjson.Get(failed, "error").String(), "No output") {
+		t.Errorf("connectfund-complete should fail with a wrong PSBT: %s, event: %s", rpcerr.Raw, failed)
+	}
+
+	broadcast := streamEvent(t, ln, "k", "funding-broadcast", func() {
+		res, rpcerr = ln.CallPlugin("connectfund-complete", []interface{}{"02bb", "cHNidP8signed"})
+	})
+	if rpcerr.Exists() {
+		t.Fatalf("connectfund-complete failed: %s", rpcerr.Raw)
+	}
+	if res.Get("chan.channel_id").String() != "cc01" || res.Get("funding.txid").String() != "ff01" ||
+		gjson.Get(broadcast, "channel_id").String() != "cc01" {
+		t.Errorf("wrong connectfund-complete result: %s, event: %s", res.Raw, broadcast)
+	}
+
+	_, rpcerr = ln.CallPlugin("connectfund-complete", []interface{}{"02bb", "cHNidP8signed"})
+	if !rpcerr.Exists() {
+		t.Error("connectfund-complete shouldn't complete the same open twice")
+	}
+
+	ln.CallPlugin("connectfund-start", []interface{}{"02bb@127.0.0.1:9735", 100000})
+	res, rpcerr = ln.CallPlugin("connectfund-cancel", []interface{}{"02bb"})
+	if rpcerr.Exists() || res.Get("status").String() != "canceled" || len(ln.Calls("fundchannel_cancel")) != 1 {
+		t.Errorf("connectfund-cancel: %s %s", res.Raw, rpcerr.Raw)
+	}
+
+	ln.CallPlugin("connectfund-start", []interface{}{"02bb@127.0.0.1:9735", 100000})
+	canceled := streamEvent(t, ln, "k", "funding-canceled", func() {
+		ln.Notify("disconnect", map[string]interface{}{"id": "02bb"})
+	})
+	if gjson.Get(canceled, "error").String() != "peer disconnected" {
+		t.Errorf("wrong event on disconnect: %s", canceled)
+	}
+	_, rpcerr = ln.CallPlugin("connectfund-complete", []interface{}{"02bb", "cHNidP8signed"})
+	if !rpcerr.Exists() {
+		t.Error("connectfund-complete shouldn't complete an open after the peer disconnected")
+	}
+}
+
+func TestApprovalDefaults(t *testing.T) {
+	ln := StartLightningd(t, map[string]interface{}{
+		"sparko-keys":          "full; flagged; operator: sparko-approve, sparko-deny",
+		"sparko-approval-keys": "flagged",
+	}, nil)
+
+	for _, call := range []string{
+		`{"method": "closeget", "params": ["02bb", "cc01", true]}`,
+		`{"method": "closeget-batch", "params": [["cc01"]]}`,
+		`{"method": "connectfund", "params": ["02bb@127.0.0.1:9735", 100000, "normal"]}`,
+		`{"method": "connectfund-start", "params": ["02bb@127.0.0.1:9735", 100000]}`,
+		`{"method": "connectfund-batch", "params": [[{"peeruri": "02bb", "satoshi": 100000}]]}`,
+		`{"method": "multifundchannel", "params": [[{"id": "02bb", "amount": 100000}]]}`,
+		`{"method": "sendpay", "params": [[{"id": "02bb", "amount_msat": "200000000msat"}], "aa11"]}`,
+		`{"method": "xpay", "params": {"invstring": "lnbcrt1", "amount_msat": 200000000}}`,
+		`{"method": "sparko-voucher-create", "params": [60000000, 2]}`,
+		`{"method": "sparko-nwc-create", "params": {"name": "unlimited"}}`,
+		`{"method": "sparko-nwc-create", "params": {"name": "big", "budget_msat": 200000000}}`,
+	} {
+		status, res := rpcRequest(t, ln, "flagged", call)
+		if status != 202 || res.Get("status").String() != "awaiting-approval" {
+			t.Errorf("%s should await approval by default: %d %s", call, status, res.Raw)
+		}
+	}
+	for _, call := range []string{
+		`{"method": "sendpay", "params": [[{"id": "02bb", "amount_msat": 1000}], "aa11"]}`,
+		`{"method": "sparko-voucher-create", "params": [60000000]}`,
+		`{"method": "sparko-nwc-create", "params": {"name": "small", "budget_msat": 1000000}}`,
+	} {
+		if status, res := rpcRequest(t, ln, "flagged", call); status == 202 {
+			t.Errorf("%s is below the default thresholds: %s", call, res.Raw)
+		}
+	}
+
+	deny := `{"method": "sparko-deny", "params": ["nonexisting"]}`
+	for key, allowed := range map[string]bool{"full": false, "flagged": false, "operator": true} {
+		status, _ := rpcRequest(t, ln, key, deny)
+		if (status != 401) != allowed {
+			t.Errorf("sparko-deny with key %s: got %d", key, status)
+		}
+	}
+}
+
+func TestApprovalIdempotency(t *testing.T) {
+	ln := StartLightningd(t, map[string]interface{}{
+		"sparko-keys":          "flagged",
+		"sparko-approval-keys": "flagged",
+	}, map[string]MethodHandler{
+		"withdraw": func(params gjson.Result) (interface{}, *RPCError) {
+			return map[string]interface{}{"tx": "0200", "txid": "ff01"}, nil
+		},
+	})
+
+	park := func() string {
+		req, _ := http.NewRequest("POST", ln.URL("/rpc"),
+			strings.NewReader(`{"method": "withdraw", "params": ["bcrt1qdestination", 100000]}`))
+		req.Header.Set("X-Access", "flagged")
+		req.Header.Set("Idempotency-Key", "idem1")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != 202 {
+			t.Fatalf("withdraw should await approval: %d %s", resp.StatusCode, b)
+		}
+		return gjson.GetBytes(b, "job").String()
+	}
+
+	first := park()
+	if retry := park(); retry != first {
+		t.Errorf("a retry with the same Idempotency-Key should get the parked call %s, got %s", first, retry)
+	}
+
+	res, rpcerr := ln.CallPlugin("sparko-approve", []interface{}{first})
+	if rpcerr.Exists() || res.Get("status").String() != "approved" {
+		t.Fatalf("approve: %s %s", res.Raw, rpcerr.Raw)
+	}
+	for i := 0; i < 50 && len(ln.Calls("withdraw")) == 0; i++ {
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	// once it has run a retry is parked again, but only gets the same result
+	second := park()
+	ln.CallPlugin("sparko-approve", []interface{}{second})
+	time.Sleep(time.Millisecond * 300)
+	if calls := ln.Calls("withdraw"); len(calls) != 1 {
+		t.Errorf("retries with the same Idempotency-Key should withdraw once, withdrew %d times", len(calls))
+	}
+}
+
+func TestBatch(t *testing.T) {
+	ln := StartLightningd(t, map[string]interface{}{
+		"sparko-keys":           "k; limited: connectfund-batch",
+		"sparko-approval-keys":  "limited",
+		"sparko-approval-rules": "connectfund-batch>150000000",
+	}, map[string]MethodHandler{
+		"connect": func(params gjson.Result) (interface{}, *RPCError) {
+			if strings.HasPrefix(params.Get("0").String(), "02cc") {
+				return nil, &RPCError{401, "Connection refused"}
+			}
+			return map[string]interface{}{"id": params.Get("0").String()[:4]}, nil
+		},
+		"multifundchannel": func(params gjson.Result) (interface{}, *RPCError) {
+			return map[string]interface{}{
+				"txid":        "ff02",
+				"channel_ids": []interface{}{map[string]interface{}{"id": "02bb", "channel_id": "cc-02bb", "outnum": 0}},
+				"failed": []interface{}{map[string]interface{}{
+					"id": "02dd", "method": "openchannel_init", "error": map[string]interface{}{"code": 400, "message": "too small"},
+				}},
+			}, nil
+		},
+		"close": func(params gjson.Result) (interface{}, *RPCError) {
+			if params.Get("id").String() == "cc-02dd" {
+				return nil, &RPCError{-1, "Unknown channel"}
+			}
+			return map[string]interface{}{"type": "mutual", "txid": "ee" + params.Get("id").String()}, nil
+		},
+		"listpeers": func(params gjson.Result) (interface{}, *RPCError) {
+			ids := []string{"02bb", "02dd"}
+			if id := params.Get("0").String(); id != "" {
+				ids = []string{id}
+			}
+			var peers []interface{}
+			for _, id := range ids {
+				peers = append(peers, map[string]interface{}{
+					"id": id, "connected": true,
+					"channels": []interface{}{map[string]interface{}{"channel_id": "cc-" + id, "state": "CHANNELD_AWAITING_LOCKIN"}},
+				})
+			}
+			return map[string]interface{}{"peers": peers}, nil
+		},
+	})
+
+	res, rpcerr := ln.CallPlugin("connectfund-batch", map[string]interface{}{
+		"peers": []interface{}{
+			map[string]interface{}{"peeruri": "02bb@127.0.0.1:9735", "satoshi": 100000},
+			map[string]interface{}{"peeruri": "02cc@127.0.0.1:9736", "satoshi": 100000},
+			map[string]interface{}{"peeruri": "02dd@127.0.0.1:9737", "satoshi": 1000},
+			map[string]interface{}{"peeruri": "02ee@127.0.0.1:9738"},
+		},
+		"minchannels": 1,
+	})
+	if rpcerr.Exists() {
+		t.Fatalf("connectfund-batch failed: %s", rpcerr.Raw)
+	}
+	results := res.Get("results").Array()
+	if len(results) != 4 || res.Get("txid").String() != "ff02" {
+		t.Fatalf("wrong connectfund-batch result: %s", res.Raw)
+	}
+	if !results[0].Get("ok").Bool() || results[0].Get("result.chan.channel_id").String() != "cc-02bb" ||
+		results[0].Get("result.peer.id").String() != "02bb" {
+		t.Errorf("02bb should have been opened: %s", results[0].Raw)
+	}
+	if results[1].Get("ok").Bool() || !strings.Contains(results[1].Get("error").String(), "Connection refused") {
+		t.Errorf("02cc should have failed to connect: %s", results[1].Raw)
+	}
+	if results[2].Get("ok").Bool() || !strings.Contains(results[2].Get("error").String(), "too small") {
+		t.Errorf("02dd should have failed to open: %s", results[2].Raw)
+	}
+	if results[3].Get("ok").Bool() {
+		t.Errorf("02ee has no amount: %s", results[3].Raw)
+	}
+	calls := ln.Calls("multifundchannel")
+	if len(calls) != 1 || calls[0].Get("params.destinations.#").Int() != 2 || calls[0].Get("params.minchannels").Int() != 1 {
+		t.Errorf("wrong multifundchannel calls: %v", calls)
+	}
+
+	res, rpcerr = ln.CallPlugin("closeget-batch", map[string]interface{}{
+		"channels": []interface{}{"cc-02bb", map[string]interface{}{"peeruri": "02dd@127.0.0.1:9737", "chanid": "cc-02dd"}},
+	})
+	if rpcerr.Exists() {
+		t.Fatalf("closeget-batch failed: %s", rpcerr.Raw)
+	}
+	results = res.Get("results").Array()
+	if len(results) != 2 || !results[0].Get("ok").Bool() || results[0].Get("result.closing.txid").String() != "eecc-02bb" ||
+		results[0].Get("result.chan.channel_id").String() != "cc-02bb" {
+		t.Errorf("cc-02bb should have been closed: %s", res.Raw)
+	}
+	if len(results) == 2 && (results[1].Get("ok").Bool() || results[1].Get("peer").String() != "02dd@127.0.0.1:9737") {
+		t.Errorf("cc-02dd should have failed to close: %s", results[1].Raw)
+	}
+	if calls := ln.Calls("close"); len(calls) != 2 || calls[0].Get("params.unilateraltimeout").Int() != 30 {
+		t.Errorf("closeget-batch should default to a 30 seconds unilateraltimeout: %v", calls)
+	}
+
+	// approval rules apply to the sum of the amounts
+	status, res := rpcRequest(t, ln, "limited", `{"method": "connectfund-batch", "params": {"peers": [
+		{"peeruri": "02bb@127.0.0.1:9735", "satoshi": 100000}, {"peeruri": "02dd@127.0.0.1:9737", "satoshi": 100000}]}}`)
+	if status != 202 || res.Get("status").String() != "awaiting-approval" {
+		t.Errorf("big batch should await approval: %d %s", status, res.Raw)
+	}
+}
+
+func TestCloseGet(t *testing.T) {
+	ln := StartLightningd(t, nil, map[string]MethodHandler{
+		"close": func(params gjson.Result) (interface{}, *RPCError) {
+			if params.Get("destination").Exists() {
+				// newer versions
+				return map[string]interface{}{"type": "mutual", "txs": []string{"0200"}, "txids": []string{"ee02"}}, nil
+			}
+			return map[string]interface{}{"type": "mutual", "tx": "0200", "txid": "ee"}, nil
+		},
+		"listpeers": listpeers,
+	})
+
+	res, rpcerr := ln.CallPlugin("closeget", map[string]interface{}{
+		"peeruri": "02bb@127.0.0.1:9735", "chanid": "cc01", "force": false, "timeout": 30,
+	})
+	if rpcerr.Exists() {
+		t.Fatalf("closeget failed: %s", rpcerr.Raw)
+	}
+	calls := ln.Calls("close")
+	if len(calls) != 1 || calls[0].Get("params.id").String() != "cc01" ||
+		calls[0].Get("params.unilateraltimeout").Int() != 0 || !calls[0].Get("params.unilateraltimeout").Exists() {
+		t.Errorf("wrong close calls: %v", calls)
+	}
+	if res.Get("closing.type").String() != "mutual" || res.Get("closing.txid").String() != "ee" ||
+		res.Get("chan.channel_id").String() != "cc01" {
+		t.Errorf("wrong closeget result: %s", res.Raw)
+	}
+	if calls := ln.Calls("listpeers"); len(calls) == 0 || calls[0].Get("params.0").String() != "02bb" {
+		t.Errorf("listpeers should be called with the peer id: %v", calls)
+	}
+
+	// positional, forced, with all the options
+	res, rpcerr = ln.CallPlugin("closeget", []interface{}{
+		"02bb@127.0.0.1:9735", "103x1x0", true, 60, "bcrt1qdestination0000000000000", "50%",
+		[]interface{}{"253perkw", "urgent"}, strings.Repeat("ab", 32) + ":1",
+	})
+	if rpcerr.Exists() {
+		t.Fatalf("closeget with options failed: %s", rpcerr.Raw)
+	}
+	call := ln.Calls("close")[1].Get("params")
+	if call.Get("id").String() != "103x1x0" || call.Get("unilateraltimeout").Int() != 60 ||
+		call.Get("destination").String() != "bcrt1qdestination0000000000000" ||
+		call.Get("fee_negotiation_step").String() != "50%" ||
+		call.Get("feerange").Raw != `["253perkw","urgent"]` ||
+		call.Get("wrong_funding").String() != strings.Repeat("ab", 32)+":1" {
+		t.Errorf("wrong close params: %s", call.Raw)
+	}
+	if res.Get("closing.txid").String() != "ee02" || res.Get("closing.tx").String() != "0200" {
+		t.Errorf("wrong closing with many txs: %s", res.Raw)
+	}
+
+	// invalid inputs don't get to lightningd
+	for _, params := range []map[string]interface{}{
+		{"peeruri": "02bb", "chanid": ""},
+		{"peeruri": "02bb", "chanid": "cc01", "timeout": -1},
+		{"peeruri": "02bb", "chanid": "cc01", "destination": "not an address"},
+		{"peeruri": "02bb", "chanid": "cc01", "fee_negotiation_step": "150%"},
+		{"peeruri": "02bb", "chanid": "cc01", "fee_negotiation_step": "0"},
+		{"peeruri": "02bb", "chanid": "cc01", "feerange": []interface{}{"1000perkw", "253perkw"}},
+		{"peeruri": "02bb", "chanid": "cc01", "feerange": []interface{}{"slow"}},
+		{"peeruri": "02bb", "chanid": "cc01", "wrong_funding": "ab:1"},
+		{"peeruri": "02bb", "chanid": "cc99"},
+	} {
+		_, rpcerr := ln.CallPlugin("closeget", params)
+		if !rpcerr.Exists() {
+			t.Errorf("closeget should have failed with %v", params)
+		}
+	}
+	if calls := ln.Calls("close"); len(calls) != 2 {
+		t.Errorf("close shouldn't have been called with invalid params: %v", calls[2:])
+	}
+}
+
+func TestCloseGetOldVersion(t *testing.T) {
+	ln := StartLightningd(t, nil, map[string]MethodHandler{
+		"getinfo": func(params gjson.Result) (interface{}, *RPCError) {
+			return map[string]interface{}{"id": "02aa", "version": "v0.9.3"}, nil
+		},
+		"close": func(params gjson.Result) (interface{}, *RPCError) {
+			return map[string]interface{}{"type": "mutual", "txid": "ee"}, nil
+		},
+		"listpeers": listpeers,
+	})
+
+	_, rpcerr := ln.CallPlugin("closeget", map[string]interface{}{
+		"peeruri": "02bb", "chanid": "cc01", "wrong_funding": strings.Repeat("ab", 32) + ":1",
+	})
+	if !strings.Contains(rpcerr.Get("message").String(), "v0.10") {
+		t.Errorf("wrong_funding should require v0.10: %s", rpcerr.Raw)
+	}
+	_, rpcerr = ln.CallPlugin("closeget", map[string]interface{}{
+		"peeruri": "02bb", "chanid": "cc01", "fee_negotiation_step": "1",
+	})
+	if rpcerr.Exists() {
+		t.Errorf("fee_negotiation_step is available on v0.9: %s", rpcerr.Raw)
+	}
+}
+
+func TestListpaysExt(t *testing.T) {
+	ln := StartLightningd(t, nil, map[string]MethodHandler{
+		"listpays": func(params gjson.Result) (interface{}, *RPCError) {
+			return map[string]interface{}{
+				"pays": []interface{}{
+					map[string]interface{}{
+						"bolt11":   "lnbcrt1a",
+						"status":   "complete",
+						"preimage": "0000000000000000000000000000000000000000000000000000000000000000",
+					},
+					map[string]interface{}{"bolt11": "lnbcrt1b", "status": "failed"},
+				},
+			}, nil
+		},
+		"listsendpays": func(params gjson.Result) (interface{}, *RPCError) {
+			return map[string]interface{}{
+				"payments": []interface{}{map[string]interface{}{"created_at": 1600000000}},
+			}, nil
+		},
+	})
+
+	res, rpcerr := ln.CallPlugin("listpaysext", []interface{}{})
+	if rpcerr.Exists() {
+		t.Fatalf("listpaysext failed: %s", rpcerr.Raw)
+	}
+
+	pays := res.Get("pays").Array()
+	if len(pays) != 2 {
+		t.Fatalf("expected 2 pays, got %s", res.Raw)
+	}
+	for _, pay := range pays {
+		if pay.Get("status").String() != "complete" {
+			continue
+		}
+		// sha256 of 32 zero bytes
+		if pay.Get("payment_hash").String() != "66687aadf862bd776c8fc18b8e9f8e20089714856ee233b3902a591d0d5f2925" {
+			t.Errorf("wrong payment_hash: %s", pay.Raw)
+		}
+		if pay.Get("created_at").Int() != 1600000000 {
+			t.Errorf("wrong created_at: %s", pay.Raw)
+		}
+	}
+}
+
+func TestListpaysExtPages(t *testing.T) {
+	// an old lightningd, without hashes or creation times on listpays
+	var pays []interface{}
+	for i := 0; i < 50; i++ {
+		status := "complete"
+		if i%5 == 0 {
+			status = "failed"
+		}
+		pays = append(pays, map[string]interface{}{
+			"bolt11":   fmt.Sprintf("lnbcrt1p%02d", i),
+			"status":   status,
+			"preimage": fmt.Sprintf("%064x", i),
+		})
+	}
+	ln := StartLightningd(t, nil, map[string]MethodHandler{
+		"listpays": func(params gjson.Result) (interface{}, *RPCError) {
+			return map[string]interface{}{"pays": pays}, nil
+		},
+		"listsendpays": func(params gjson.Result) (interface{}, *RPCError) {
+			for i := range pays {
+				preimage, _ := hex.DecodeString(fmt.Sprintf("%064x", i))
+				hash := sha256.Sum256(preimage)
+				if hex.EncodeToString(hash[:]) == params.Get("payment_hash").String() {
+					return map[string]interface{}{
+						"payments": []interface{}{map[string]interface{}{"created_at": 1600000000 + i}},
+					}, nil
+				}
+			}
+			return map[string]interface{}{"payments": []interface{}{}}, nil
+		},
+	})
+
+	res, rpcerr := ln.CallPlugin("listpaysext", map[string]interface{}{})
+	if rpcerr.Exists() {
+		t.Fatalf("listpaysext failed: %s", rpcerr.Raw)
+	}
+	if res.Get("pays.#").Int() != 30 || res.Get("total").Int() != 50 {
+		t.Fatalf("expected the 30 newest of 50 pays: %s", res.Raw)
+	}
+	if res.Get("pays.0.created_at").Int() != 1600000049 || res.Get("pays.29.created_at").Int() != 1600000020 {
+		t.Errorf("pays not ordered newest first: %s", res.Get("pays.#.created_at").Raw)
+	}
+	calls := len(ln.Calls("listsendpays"))
+	if calls != 30 {
+		t.Errorf("expected 30 listsendpays calls, got %d", calls)
+	}
+
+	res, rpcerr = ln.CallPlugin("listpaysext", map[string]interface{}{"limit": 10, "offset": 5, "status": "complete"})
+	if rpcerr.Exists() {
+		t.Fatalf("listpaysext failed: %s", rpcerr.Raw)
+	}
+	if res.Get("pays.#").Int() != 10 || res.Get("total").Int() != 40 {
+		t.Fatalf("expected 10 of 40 complete pays: %s", res.Raw)
+	}
+	for _, pay := range res.Get("pays").Array() {
+		if pay.Get("status").String() != "complete" {
+			t.Errorf("got a pay that isn't complete: %s", pay.Raw)
+		}
+	}
+	// complete pays are 49,48,47,46,44,43,... so the 6th is 43
+	if res.Get("pays.0.created_at").Int() != 1600000043 {
+		t.Errorf("wrong offset: %s", res.Get("pays.#.created_at").Raw)
+	}
+	if again := len(ln.Calls("listsendpays")); again != calls {
+		t.Errorf("pays already seen were queried again: %d calls", again-calls)
+	}
+
+	for _, c := range []struct {
+		params map[string]interface{}
+		count  int64
+		total  int64
+		offset int64
+		first  int64 // created_at of the first pay returned, if any
+	}{
+		{map[string]interface{}{"limit": 0}, 30, 50, 0, 1600000049},
+		{map[string]interface{}{"limit": 100}, 50, 50, 0, 1600000049},
+		{map[string]interface{}{"offset": 45}, 5, 50, 45, 1600000004},
+		{map[string]interface{}{"offset": 50}, 0, 50, 50, 0},
+		{map[string]interface{}{"offset": 1000}, 0, 50, 50, 0},
+		{map[string]interface{}{"status": "failed", "limit": 3}, 3, 10, 0, 1600000045},
+		{map[string]interface{}{"status": "failed", "offset": 9}, 1, 10, 9, 1600000000},
+		{map[string]interface{}{"status": "pending"}, 0, 0, 0, 0},
+	} {
+		res, rpcerr := ln.CallPlugin("listpaysext", c.params)
+		if rpcerr.Exists() {
+			t.Errorf("listpaysext %v failed: %s", c.params, rpcerr.Raw)
+			continue
+		}
+		if res.Get("pays.#").Int() != c.count || res.Get("total").Int() != c.total ||
+			res.Get("offset").Int() != c.offset || res.Get("pays.0.created_at").Int() != c.first {
+			t.Errorf("listpaysext %v: expected %d of %d from %d starting at %d, got %s",
+				c.params, c.count, c.total, c.offset, c.first, res.Raw)
+		}
+	}
+
+	for _, params := range []map[string]interface{}{{"status": "paid"}, {"offset": -1}} {
+		if _, rpcerr := ln.CallPlugin("listpaysext", params); !rpcerr.Exists() {
+			t.Errorf("listpaysext %v should fail", params)
+		}
+	}
+}
+
+func TestPages(t *testing.T) {
+	var invoices []interface{}
+	for i := 0; i < 25; i++ {
+		status := "paid"
+		if i%2 == 0 {
+			status = "unpaid"
+		}
+		invoices = append(invoices, map[string]interface{}{
+			"label": fmt.Sprintf("inv%02d", i), "status": status, "created_index": i + 1,
+		})
+	}
+	ln := StartLightningd(t, map[string]interface{}{"sparko-keys": "k"}, map[string]MethodHandler{
+		"listinvoices": func(params gjson.Result) (interface{}, *RPCError) {
+			return map[string]interface{}{"invoices": invoices}, nil
+		},
+	})
+
+	page := func(size string, cursor string, filter string) (int, string, []string) {
+		req, _ := http.NewRequest("POST", ln.URL("/rpc"), strings.NewReader(`{"method": "listinvoices"}`))
+		req.Header.Set("X-Access", "k")
+		req.Header.Set("X-Page-Size", size)
+		if cursor != "" {
+			req.Header.Set("X-Cursor", cursor)
+		}
+		if filter != "" {
+			req.Header.Set("X-Filter", filter)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		var labels []string
+		for _, label := range gjson.GetBytes(b, "invoices.#.label").Array() {
+			labels = append(labels, label.String())
+		}
+		return resp.StatusCode, resp.Header.Get("X-Next-Cursor"), labels
+	}
+
+	// newest first, each page starting after the last one
+	var seen []string
+	cursor := ""
+	for i := 0; i < 5; i++ {
+		status, next, labels := page("10", cursor, "")
+		if status != 200 {
+			t.Fatalf("page %d: got %d", i, status)
+		}
+		seen = append(seen, labels...)
+		if cursor = next; cursor == "" {
+			break
+		}
+	}
+	if len(seen) != 25 || seen[0] != "inv24" || seen[9] != "inv15" || seen[10] != "inv14" || seen[24] != "inv00" {
+		t.Errorf("wrong pages: %v", seen)
+	}
+	if calls := ln.Calls("listinvoices"); len(calls) != 1 {
+		t.Errorf("following pages should come from the list fetched for the first, got %d calls", len(calls))
+	}
+
+	// filters apply to each page
+	_, _, labels := page("4", "", "invoices: status==paid")
+	if len(labels) != 2 || labels[0] != "inv23" || labels[1] != "inv21" {
+		t.Errorf("wrong filtered page: %v", labels)
+	}
+
+	for _, c := range []struct{ size, cursor string }{{"0", ""}, {"-1", ""}, {"ten", ""}, {"10", "not a cursor"}} {
+		if status, _, _ := page(c.size, c.cursor, ""); status != 400 {
+			t.Errorf("page size %q cursor %q: expected 400, got %d", c.size, c.cursor, status)
+		}
+	}
+}
+
+func TestNodes(t *testing.T) {
+	remote := StartLightningd(t, map[string]interface{}{
+		"sparko-keys":          "remotekey; remoteflagged",
+		"sparko-approval-keys": "remoteflagged",
+	}, map[string]MethodHandler{
+		"getinfo": func(params gjson.Result) (interface{}, *RPCError) {
+			return map[string]interface{}{"id": "03bb", "alias": "remote"}, nil
+		},
+	})
+	ln := StartLightningd(t, map[string]interface{}{
+		"sparko-keys": "masterkey; scoped: remote/getinfo, remote/stream",
+		"sparko-nodes": "remote=" + remote.URL("/?access-key=remotekey") +
+			"; sock=" + filepath.Join(remote.Dir, "lightning-rpc") +
+			"; flagged=" + remote.URL("/?access-key=remoteflagged"),
+	}, getinfo)
+
+	nodeRequest := func(key string, path string, node string, body string) (int, gjson.Result) {
+		req, _ := http.NewRequest("POST", ln.URL(path), strings.NewReader(body))
+		req.Header.Set("X-Access", key)
+		if node != "" {
+			req.Header.Set("X-Node", node)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, gjson.ParseBytes(b)
+	}
+
+	for _, c := range []struct{ path, node, id string }{
+		{"/rpc", "", "02aa"},
+		{"/rpc", "local", "02aa"},
+		{"/nodes/remote/rpc", "", "03bb"},
+		{"/rpc", "remote", "03bb"},
+		{"/nodes/sock/rpc", "", "03bb"},
+	} {
+		status, res := nodeRequest("masterkey", c.path, c.node, `{"method": "getinfo"}`)
+		if status != 200 || res.Get("id").String() != c.id {
+			t.Errorf("getinfo at %s (node %q): got %d %s", c.path, c.node, status, res.Raw)
+		}
+	}
+
+	status, _ := nodeRequest("masterkey", "/nodes/unknown/rpc", "", `{"method": "getinfo"}`)
+	if status != 404 {
+		t.Errorf("call to an unknown node: expected 404, got %d", status)
+	}
+
+	// a call parked by the remote sparko has no result yet
+	status, res := nodeRequest("masterkey", "/nodes/flagged/rpc", "", `{"method": "withdraw", "params": ["bcrt1qdestination", 100000]}`)
+	if status == 200 || res.Get("job").Exists() {
+		t.Errorf("a call parked by the remote node shouldn't be given as its result: %d %s", status, res.Raw)
+	}
+	if pending, _ := remote.CallPlugin("sparko-pending", nil); pending.Get("pending.#").Int() != 1 {
+		t.Errorf("the call should be parked on the remote node: %s", pending.Raw)
+	}
+
+	status, _ = nodeRequest("scoped", "/nodes/remote/rpc", "", `{"method": "getinfo"}`)
+	if status != 200 {
+		t.Errorf("scoped key on its node: expected 200, got %d", status)
+	}
+	for _, c := range []struct{ path, method string }{
+		{"/rpc", "getinfo"},
+		{"/nodes/sock/rpc", "getinfo"},
+		{"/nodes/remote/rpc", "listfunds"},
+	} {
+		status, _ = nodeRequest("scoped", c.path, "", `{"method": "`+c.method+`"}`)
+		if status != 401 {
+			t.Errorf("scoped key calling %s at %s: expected 401, got %d", c.method, c.path, status)
+		}
+	}
+	if len(remote.Calls("listfunds")) != 0 {
+		t.Error("listfunds shouldn't have reached the remote node")
+	}
+
+	// errors from the remote sparko are passed along
+	status, res = nodeRequest("masterkey", "/nodes/remote/rpc", "", `{"method": "nonexisting"}`)
+	if status != 500 || res.Get("code").Int() != -32601 {
+		t.Errorf("unknown method on remote: got %d %s", status, res.Raw)
+	}
+
+	// events from the remote node are merged into the stream
+	req, _ := http.NewRequest("GET", ln.URL("/stream"), nil)
+	req.Header.Set("X-Access", "masterkey")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	events := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if line := scanner.Text(); strings.HasPrefix(line, "event: ") {
+				events <- strings.TrimPrefix(line, "event: ")
+			}
+		}
+		close(events)
+	}()
+
+	time.Sleep(time.Millisecond * 500)
+	remote.Notify("connect", map[string]interface{}{"id": "02cc", "address": map[string]interface{}{}})
+
+	timeout := time.After(time.Second * 5)
+	for {
+		select {
+		case typ, ok := <-events:
+			if !ok {
+				t.Fatal("stream closed")
+			}
+			if typ == "remote/connect" {
+				return
+			}
+		case <-timeout:
+			t.Fatal("didn't get the remote connect event")
+		}
+	}
+}
+
+func TestOpenPolicy(t *testing.T) {
+	ln := StartLightningd(t, map[string]interface{}{
+		"sparko-keys":               "k",
+		"sparko-open-min":           20000,
+		"sparko-open-max":           1000000,
+		"sparko-open-max-per-peer":  1500000,
+		"sparko-open-max-feerate":   5000,
+		"sparko-open-reserve":       100000,
+		"sparko-open-blocked-peers": "02ff",
+	}, map[string]MethodHandler{
+		"getinfo": func(params gjson.Result) (interface{}, *RPCError) {
+			return map[string]interface{}{"id": "02aa", "version": "v23.02"}, nil
+		},
+		"connect": func(params gjson.Result) (interface{}, *RPCError) {
+			return map[string]interface{}{"id": "02bb"}, nil
+		},
+		"fundchannel": func(params gjson.Result) (interface{}, *RPCError) {
+			return map[string]interface{}{"channel_id": "cc01", "txid": "ff"}, nil
+		},
+		"listpeers": listpeers,
+		"listpeerchannels": func(params gjson.Result) (interface{}, *RPCError) {
+			return map[string]interface{}{"channels": []interface{}{
+				map[string]interface{}{"peer_id": "02bb", "channel_id": "cc01", "state": "CHANNELD_NORMAL", "total_msat": 800000000},
+				map[string]interface{}{"peer_id": "02bb", "state": "ONCHAIN", "total_msat": 900000000},
+			}}, nil
+		},
+		"listfunds": func(params gjson.Result) (interface{}, *RPCError) {
+			return map[string]interface{}{"outputs": []interface{}{
+				map[string]interface{}{"status": "confirmed", "amount_msat": "1200000000msat"},
+				map[string]interface{}{"status": "confirmed", "amount_msat": 500000000, "reserved": true},
+				map[string]interface{}{"status": "unconfirmed", "amount_msat": 500000000},
+			}}, nil
+		},
+		"feerates": func(params gjson.Result) (interface{}, *RPCError) {
+			return map[string]interface{}{"perkw": map[string]interface{}{"opening": 3000, "unilateral_close": 9000}}, nil
+		},
+	})
+
+	for _, c := range []struct {
+		satoshi string
+		feerate string
+		code    int64
+	}{
+		{"10000", "normal", POLICYBELOWMIN},
+		{"2000000", "normal", POLICYABOVEMAX},
+		{"500000", "urgent", POLICYFEERATE},
+		{"500000", "24000", POLICYFEERATE}, // perkb
+		{"800000", "normal", POLICYPEERCAPACITY},
+		{"all", "normal", POLICYABOVEMAX},
+		{"500000", "normal", 0},
+		{"500000", "4000perkw", 0},
+	} {
+		_, rpcerr := ln.CallPlugin("connectfund", []interface{}{"02bb@127.0.0.1:9735", c.satoshi, c.feerate})
+		if rpcerr.Get("code").Int() != c.code {
+			t.Errorf("connectfund %s at %s: expected code %d, got %s", c.satoshi, c.feerate, c.code, rpcerr.Raw)
+		}
+	}
+	if calls := ln.Calls("fundchannel"); len(calls) != 2 {
+		t.Errorf("only the channels following the rules should be opened: %v", calls)
+	}
+
+	_, rpcerr := ln.CallPlugin("connectfund", []interface{}{"02ff@127.0.0.1:9735", "500000", "normal"})
+	if rpcerr.Get("code").Int() != POLICYPEERBLOCKED {
+		t.Errorf("blocked peer: %s", rpcerr.Raw)
+	}
+
+	// raw calls through /rpc
+	status, res := rpcRequest(t, ln, "k", `{"method": "fundchannel", "params": ["02bb", 5000]}`)
+	if status != 403 || res.Get("code").Int() != POLICYBELOWMIN || res.Get("name").String() != "PolicyError" {
+		t.Errorf("raw fundchannel below minimum: %d %s", status, res.Raw)
+	}
+	status, res = rpcRequest(t, ln, "k", `{"method": "fundchannel", "params": ["02bb", "lots"]}`)
+	if status != 400 || res.Get("code").Int() != 400 {
+		t.Errorf("raw fundchannel with an invalid amount: %d %s", status, res.Raw)
+	}
+	status, res = rpcRequest(t, ln, "k", `{"method": "multifundchannel", "params": {"destinations": [
+		{"id": "02cc@1.2.3.4", "amount": "600000sat"}, {"id": "02dd", "amount": 600000}]}}`)
+	if status != 403 || res.Get("code").Int() != POLICYRESERVE {
+		t.Errorf("raw multifundchannel below the reserve: %d %s", status, res.Raw)
+	}
+	status, res = rpcRequest(t, ln, "k", `{"method": "multifundchannel", "params": {"destinations": [
+		{"id": "02cc", "amount": 500000}, {"id": "02ff", "amount": 500000}]}}`)
+	if status != 403 || res.Get("code").Int() != POLICYPEERBLOCKED {
+		t.Errorf("raw multifundchannel to a blocked peer: %d %s", status, res.Raw)
+	}
+	status, _ = rpcRequest(t, ln, "k", `{"method": "fundchannel", "params": ["02cc", 500000]}`)
+	if status != 200 {
+		t.Errorf("raw fundchannel following the rules: expected 200, got %d", status)
+	}
+
+	// batches check each channel and all of them together
+	res, _ = ln.CallPlugin("connectfund-batch", map[string]interface{}{
+		"peers": []interface{}{
+			map[string]interface{}{"peeruri": "02cc@127.0.0.1:9735", "satoshi": 500000},
+			map[string]interface{}{"peeruri": "02dd@127.0.0.1:9735", "satoshi": 700000},
+			map[string]interface{}{"peeruri": "02ee@127.0.0.1:9735", "satoshi": 1000},
+		},
+	})
+	if res.Get("results.2.code").Int() != POLICYBELOWMIN ||
+		res.Get("results.0.code").Int() != POLICYRESERVE || res.Get("results.1.code").Int() != POLICYRESERVE {
+		t.Errorf("wrong connectfund-batch results: %s", res.Raw)
+	}
+}
+
+func TestOpenPolicyExternalFunds(t *testing.T) {
+	ln := StartLightningd(t, map[string]interface{}{
+		"sparko-keys":         "k",
+		"sparko-open-reserve": 100000,
+	}, map[string]MethodHandler{
+		"connect": func(params gjson.Result) (interface{}, *RPCError) {
+			return map[string]interface{}{"id": "02bb"}, nil
+		},
+		"fundchannel_start": func(params gjson.Result) (interface{}, *RPCError) {
+			return map[string]interface{}{"funding_address": "bcrt1qfunding", "scriptpubkey": "0020ab"}, nil
+		},
+		"listfunds": func(params gjson.Result) (interface{}, *RPCError) {
+			return map[string]interface{}{"outputs": []interface{}{
+				map[string]interface{}{"status": "confirmed", "amount_msat": 50000000},
+			}}, nil
+		},
+	})
+
+	// the node's wallet is below the reserve, but these are funded by a PSBT
+	if _, rpcerr := ln.CallPlugin("connectfund-start", []interface{}{"02bb@127.0.0.1:9735", 500000}); rpcerr.Exists() {
+		t.Errorf("connectfund-start shouldn't be checked against the reserve: %s", rpcerr.Raw)
+	}
+	if status, res := rpcRequest(t, ln, "k", `{"method": "fundchannel_start", "params": ["02cc", 500000]}`); status != 200 {
+		t.Errorf("raw fundchannel_start shouldn't be checked against the reserve: %d %s", status, res.Raw)
+	}
+	if len(ln.Calls("fundchannel_start")) != 2 || len(ln.Calls("listfunds")) != 0 {
+		t.Errorf("wrong calls: fundchannel_start %v, listfunds %v", ln.Calls("fundchannel_start"), ln.Calls("listfunds"))
+	}
+
+	status, res := rpcRequest(t, ln, "k", `{"method": "fundchannel", "params": ["02cc", 500000]}`)
+	if status != 403 || res.Get("code").Int() != POLICYRESERVE {
+		t.Errorf("raw fundchannel below the reserve: %d %s", status, res.Raw)
+	}
+}
+
+// lnurlGet makes an unauthenticated request to an LNURL endpoint.
+func lnurlGet(t *testing.T, ln *FakeLightningd, path string) gjson.Result {
+	resp, err := http.Get(ln.URL(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	return gjson.ParseBytes(b)
+}
+
+func TestLNURLPay(t *testing.T) {
+	ln := StartLightningd(t, map[string]interface{}{
+		"sparko-keys":           "k",
+		"sparko-lnurlp":         true,
+		"sparko-lnurl-base-url": "https://pay.example.com",
+	}, map[string]MethodHandler{
+		"invoice": func(params gjson.Result) (interface{}, *RPCError) {
+			if params.Get("amount_msat").Int() == 2000 {
+				return nil, &RPCError{-1, "Database error"}
+			}
+			return map[string]interface{}{"bolt11": "lnbcrt1lnurl"}, nil
+		},
+	})
+
+	params := lnurlGet(t, ln, "/.well-known/lnurlp/alice")
+	metadata := params.Get("metadata").String()
+	if !strings.Contains(metadata, `"alice@pay.example.com"`) ||
+		params.Get("callback").String() != "https://pay.example.com/lnurlp/alice/callback" {
+		t.Errorf("metadata should use the public host: %s", params.Raw)
+	}
+
+	invoice := lnurlGet(t, ln, "/lnurlp/alice/callback?amount=1000")
+	calls := ln.Calls("invoice")
+	if invoice.Get("pr").String() != "lnbcrt1lnurl" || len(calls) != 1 ||
+		calls[0].Get("params.description").String() != metadata {
+		t.Errorf("invoice should commit to the metadata: %s %v", invoice.Raw, calls)
+	}
+
+	// errors other than an unknown deschashonly are not retried another way
+	failed := lnurlGet(t, ln, "/lnurlp/alice/callback?amount=2000")
+	if failed.Get("status").String() != "ERROR" || len(ln.Calls("invoice")) != 2 {
+		t.Errorf("invoice errors should be returned: %s", failed.Raw)
+	}
+}
+
+func TestLightningAddresses(t *testing.T) {
+	ln := StartLightningd(t, map[string]interface{}{
+		"sparko-keys":               "k",
+		"sparko-lnurlp":             true,
+		"sparko-lnurlp-description": "Payment to my node",
+		"sparko-lnaddress":          `alice: description="Tips, for Alice; thanks", prefix=tips; vip: prefix=tips/vip; bob`,
+	}, map[string]MethodHandler{
+		"waitinvoice": func(params gjson.Result) (interface{}, *RPCError) {
+			return map[string]interface{}{"label": params.Get("0").String(), "status": "paid"}, nil
+		},
+	})
+
+	for name, description := range map[string]string{
+		"alice": "Tips, for Alice; thanks",
+		"bob":   "Payment to my node",
+	} {
+		resp, err := http.Get(ln.URL("/.well-known/lnurlp/" + name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		metadata := gjson.Parse(gjson.GetBytes(b, "metadata").String())
+		if metadata.Get(`#(0=="text/plain").1`).String() != description {
+			t.Errorf("wrong description for %s: %s", name, metadata.Raw)
+		}
+	}
+
+	// the most specific prefix wins
+	for i := 0; i < 5; i++ {
+		payment := streamEvent(t, ln, "k", "lnaddress-payment", func() {
+			ln.Notify("invoice_payment", map[string]interface{}{
+				"invoice_payment": map[string]interface{}{"label": "tips/vip/ab12", "preimage": "00", "msat": "5000msat"},
+			})
+		})
+		if gjson.Get(payment, "username").String() != "vip" {
+			t.Fatalf("payment attributed to the wrong user: %s", payment)
+		}
+	}
+}
+
+func TestVouchers(t *testing.T) {
+	ln := StartLightningd(t, map[string]interface{}{
+		"sparko-keys":           "k",
+		"sparko-lnurl-base-url": "https://pay.example.com",
+	}, map[string]MethodHandler{
+		"decodepay": func(params gjson.Result) (interface{}, *RPCError) {
+			amounts := map[string]int64{"lnbcrt1big": 2000000, "lnbcrt1small": 100, "lnbcrt1ok": 1000000, "lnbcrt1other": 1000000}
+			amount, ok := amounts[params.Get("0").String()]
+			if !ok {
+				return map[string]interface{}{}, nil
+			}
+			return map[string]interface{}{"amount_msat": amount}, nil
+		},
+		"pay": func(params gjson.Result) (interface{}, *RPCError) {
+			return map[string]interface{}{"status": "complete", "payment_preimage": "aa11"}, nil
+		},
+	})
+
+	res, rpcerr := ln.CallPlugin("sparko-voucher-create", []interface{}{1000000, 1, 3600, "Gift", 500000})
+	if rpcerr.Exists() {
+		t.Fatalf("sparko-voucher-create failed: %s", rpcerr.Raw)
+	}
+	id := res.Get("voucher.id").String()
+
+	params := lnurlGet(t, ln, "/lnurlw/"+id)
+	if params.Get("tag").String() != "withdrawRequest" || params.Get("k1").String() != id ||
+		params.Get("maxWithdrawable").Int() != 1000000 || params.Get("minWithdrawable").Int() != 500000 {
+		t.Errorf("wrong withdraw params: %s", params.Raw)
+	}
+	if unknown := lnurlGet(t, ln, "/lnurlw/nonexisting"); unknown.Get("status").String() != "ERROR" {
+		t.Errorf("unknown voucher: %s", unknown.Raw)
+	}
+
+	callback := "/lnurlw/" + id + "/callback?k1=" + id + "&pr="
+	for pr, reason := range map[string]string{
+		"lnbcrt1big":    "amount out of bounds",
+		"lnbcrt1small":  "amount out of bounds",
+		"lnbcrt1amount": "invoice must have an amount",
+	} {
+		if res := lnurlGet(t, ln, callback+pr); res.Get("status").String() != "ERROR" || res.Get("reason").String() != reason {
+			t.Errorf("redeeming with %s: expected %q, got %s", pr, reason, res.Raw)
+		}
+	}
+	if res := lnurlGet(t, ln, "/lnurlw/"+id+"/callback?k1=wrong&pr=lnbcrt1ok"); res.Get("status").String() != "ERROR" {
+		t.Errorf("redeeming with a wrong k1: %s", res.Raw)
+	}
+	if calls := ln.Calls("pay"); len(calls) != 0 {
+		t.Fatalf("invalid redemptions shouldn't pay: %v", calls)
+	}
+
+	claimed := streamEvent(t, ln, "k", "voucher-claimed", func() {
+		if res := lnurlGet(t, ln, callback+"lnbcrt1ok"); res.Get("status").String() != "OK" {
+			t.Errorf("redeeming: %s", res.Raw)
+		}
+	})
+	if gjson.Get(claimed, "redemption.preimage").String() != "aa11" {
+		t.Errorf("wrong voucher-claimed event: %s", claimed)
+	}
+
+	// it can only be used once
+	if res := lnurlGet(t, ln, callback+"lnbcrt1other"); res.Get("status").String() != "ERROR" {
+		t.Errorf("a second redemption was accepted: %s", res.Raw)
+	}
+	if res := lnurlGet(t, ln, "/lnurlw/"+id); res.Get("status").String() != "ERROR" {
+		t.Errorf("a used voucher is still offered: %s", res.Raw)
+	}
+	if calls := ln.Calls("pay"); len(calls) != 1 || calls[0].Get("params.0").String() != "lnbcrt1ok" {
+		t.Errorf("the voucher should be paid once: %v", calls)
+	}
+}
+
+func TestPendingVouchers(t *testing.T) {
+	// redemptions left pending by a previous run, whose payments completed
+	// and failed in the meantime
+	now := time.Now().Unix()
+	ln := StartLightningdWithData(t, map[string]string{
+		"vouchers.json": fmt.Sprintf(`{
+			"v1": {"id": "v1", "min_msat": 1000, "max_msat": 1000, "uses": 1, "created_at": %[1]d,
+				"redemptions": [{"bolt11": "lnbcrt1paid", "msat": 1000, "status": "pending", "claimed_at": %[1]d}]},
+			"v2": {"id": "v2", "min_msat": 1000, "max_msat": 1000, "uses": 1, "created_at": %[1]d,
+				"redemptions": [{"bolt11": "lnbcrt1failed", "msat": 1000, "status": "pending", "claimed_at": %[1]d}]},
+			"v3": {"id": "v3", "min_msat": 1000, "max_msat": 1000, "uses": 1, "created_at": %[1]d,
+				"redemptions": [{"bolt11": "lnbcrt1inflight", "msat": 1000, "status": "pending", "claimed_at": %[1]d}]}
+		}`, now),
+	}, map[string]interface{}{
+		"sparko-keys":           "k",
+		"sparko-lnurl-base-url": "https://pay.example.com",
+	}, map[string]MethodHandler{
+		"listpays": func(params gjson.Result) (interface{}, *RPCError) {
+			pays := map[string][]interface{}{
+				"lnbcrt1paid": {
+					map[string]interface{}{"status": "failed"},
+					map[string]interface{}{"status": "complete", "preimage": "aa11"},
+				},
+				"lnbcrt1failed":   {map[string]interface{}{"status": "failed"}},
+				"lnbcrt1inflight": {map[string]interface{}{"status": "pending"}},
+			}[params.Get("0").String()]
+			return map[string]interface{}{"pays": pays}, nil
+		},
+	})
+
+	statuses := func() map[string]string {
+		res, _ := ln.CallPlugin("sparko-voucher-list", nil)
+		found := make(map[string]string)
+		for _, v := range res.Get("vouchers").Array() {
+			found[v.Get("voucher.id").String()] = v.Get("voucher.redemptions.0.status").String() +
+				"/" + v.Get("uses_left").String()
+		}
+		return found
+	}
+
+	expected := map[string]string{"v1": "complete/0", "v2": "failed/1", "v3": "pending/0"}
+	var found map[string]string
+	for i := 0; i < 50; i++ {
+		if found = statuses(); found["v1"] == expected["v1"] && found["v2"] == expected["v2"] {
+			break
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	for id, status := range expected {
+		if found[id] != status {
+			t.Errorf("voucher %s: expected %s, got %s", id, status, found[id])
+		}
+	}
+}
+
+// nwcCall sends a Nostr Wallet Connect request through the relay and waits
+// for the response.
+func nwcCall(t *testing.T, relay *FakeRelay, sk *btcec.PrivateKey, service string, nip44 bool, method string, params interface{}) gjson.Result {
+	request, _ := json.Marshal(map[string]interface{}{"method": method, "params": params})
+	encrypt, decrypt := nip04Encrypt, nip04Decrypt
+	if nip44 {
+		encrypt, decrypt = nip44Encrypt, nip44Decrypt
+	}
+	content, err := encrypt(sk, service, string(request))
+	if err != nil {
+		t.Fatal(err)
+	}
+	evt := NostrEvent{
+		CreatedAt: time.Now().Unix(),
+		Kind:      NWCREQUESTKIND,
+		Tags:      [][]string{{"p", service}},
+		Content:   content,
+	}
+	if err := evt.Sign(sk); err != nil {
+		t.Fatal(err)
+	}
+	relay.Publish(&evt)
+
+	reply := relay.WaitFor(t, func(reply *NostrEvent) bool {
+		return reply.Kind == NWCRESPONSEKIND && reply.Tag("e") == evt.Id
+	})
+	if reply.PubKey != service || !reply.CheckSignature() {
+		t.Fatalf("response not signed by the service: %v", reply)
+	}
+	plaintext, err := decrypt(sk, service, reply.Content)
+	if err != nil {
+		t.Fatalf("can't decrypt response: %s", err)
+	}
+	return gjson.Parse(plaintext)
+}
+
+func TestNWC(t *testing.T) {
+	relay := StartRelay(t)
+	// the example invoice from BOLT 11
+	bolt11 := "lnbc1pvjluezpp5qqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqypqdpl2pkx2ctnv5sxxmmwwd5kgetjypeh2ursdae8g6twvus8g6rfwvs8qun0dfjkxaq8rkx3yf5tcsyz3d73gafnh3cax9rn449d9p5uxz9ezhhypd0elx87sjle52x86fux2ypatgddc6k63n7erqz25le42c4u4ecky03ylcqca784w"
+	var payments int32
+	ln := StartLightningd(t, map[string]interface{}{
+		"sparko-nwc-relays": relay.URL,
+	}, map[string]MethodHandler{
+		"getinfo": getinfo["getinfo"],
+		"decodepay": func(params gjson.Result) (interface{}, *RPCError) {
+			return map[string]interface{}{"amount_msat": 1000}, nil
+		},
+		"pay": func(params gjson.Result) (interface{}, *RPCError) {
+			if atomic.AddInt32(&payments, 1) == 1 {
+				return nil, &RPCError{205, "Could not find a route"}
+			}
+			return map[string]interface{}{
+				"payment_preimage": "00ff",
+				"amount_msat":      1000,
+				"amount_sent_msat": 1010,
+			}, nil
+		},
+		"invoice": func(params gjson.Result) (interface{}, *RPCError) {
+			return map[string]interface{}{"bolt11": bolt11}, nil
+		},
+		"listinvoices": func(params gjson.Result) (interface{}, *RPCError) {
+			return map[string]interface{}{"invoices": []interface{}{map[string]interface{}{
+				"bolt11":      bolt11,
+				"status":      "unpaid",
+				"amount_msat": 5000,
+				"expires_at":  1496314718,
+			}}}, nil
+		},
+	})
+
+	res, rpcerr := ln.CallPlugin("sparko-nwc-create", map[string]interface{}{
+		"name":        "app",
+		"methods":     "pay_invoice,make_invoice,get_info",
+		"budget_msat": 2000,
+	})
+	if rpcerr.Exists() {
+		t.Fatalf("failed to create connection: %s", rpcerr.Raw)
+	}
+	uri, _ := url.Parse(res.Get("uri").String())
+	if uri.Query().Get("relay") != relay.URL {
+		t.Errorf("wrong connection uri: %s", uri)
+	}
+	sk, _ := testKey(t, uri.Query().Get("secret"))
+	service := uri.Host
+
+	info := nwcCall(t, relay, sk, service, true, "get_info", map[string]interface{}{})
+	if info.Get("result.alias").String() != "fake" || len(info.Get("result.methods").Array()) != 3 {
+		t.Errorf("wrong get_info response: %s", info.Raw)
+	}
+
+	balance := nwcCall(t, relay, sk, service, false, "get_balance", map[string]interface{}{})
+	if balance.Get("error.code").String() != "RESTRICTED" {
+		t.Errorf("restricted method was called: %s", balance.Raw)
+	}
+
+	// a failed payment gives the budget back
+	failed := nwcCall(t, relay, sk, service, true, "pay_invoice", map[string]interface{}{"invoice": bolt11})
+	if failed.Get("error.code").String() != "PAYMENT_FAILED" {
+		t.Errorf("payment should have failed: %s", failed.Raw)
+	}
+	paid := nwcCall(t, relay, sk, service, false, "pay_invoice", map[string]interface{}{"invoice": bolt11 + "x"})
+	if paid.Get("result.preimage").String() != "00ff" || paid.Get("result.fees_paid").Int() != 10 {
+		t.Errorf("wrong pay_invoice response: %s", paid.Raw)
+	}
+	over := nwcCall(t, relay, sk, service, true, "pay_invoice", map[string]interface{}{"invoice": bolt11 + "y"})
+	if over.Get("error.code").String() != "QUOTA_EXCEEDED" || len(ln.Calls("pay")) != 2 {
+		t.Errorf("payment over the budget: %s", over.Raw)
+	}
+	list, _ := ln.CallPlugin("sparko-nwc-list", map[string]interface{}{})
+	if spent := list.Get("connections.0.spent_msat").Int(); spent != 1010 {
+		t.Errorf("wrong amount spent: %d", spent)
+	}
+
+	invoice := nwcCall(t, relay, sk, service, true, "make_invoice", map[string]interface{}{"amount": 5000, "description": "coffee"})
+	if invoice.Get("result.invoice").String() != bolt11 ||
+		invoice.Get("result.created_at").Int() != 1496314658 {
+		t.Errorf("wrong make_invoice response: %s", invoice.Raw)
+	}
+
+	ln.CallPlugin("sparko-nwc-revoke", map[string]interface{}{"pubkey": list.Get("connections.0.pubkey").String()})
+	request := NostrEvent{CreatedAt: time.Now().Unix(), Kind: NWCREQUESTKIND, Tags: [][]string{{"p", service}}}
+	request.Content, _ = nip44Encrypt(sk, service, `{"method":"get_info","params":{}}`)
+	request.Sign(sk)
+	relay.Publish(&request)
+	time.Sleep(time.Millisecond * 500)
+	relay.mutex.Lock()
+	for _, evt := range relay.events {
+		if evt.Tag("e") == request.Id {
+			t.Error("revoked connection got a response")
+		}
+	}
+	relay.mutex.Unlock()
+}
+
+func TestFakeNode(t *testing.T) {
+	ln := StartFakeNode(t, map[string]string{
+		"sparko-keys":       "masterkey; payer: pay, stream",
+		"sparko-timeouts":   "waitinvoice:1",
+		"sparko-allow-cors": "",
+	})
+
+	status, _ := rpcRequest(t, ln, "", `{"method": "getinfo"}`)
+	if status != 401 {
+		t.Errorf("call without a key: expected 401, got %d", status)
+	}
+
+	// bool options can be given as bare flags
+	req, _ := http.NewRequest("OPTIONS", ln.URL("/rpc"), nil)
+	req.Header.Set("Origin", "https://example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("Access-Control-Allow-Origin") == "" {
+		t.Errorf("--sparko-allow-cors wasn't applied: %v", resp.Header)
+	}
+	status, _ = rpcRequest(t, ln, "payer", `{"method": "invoice", "params": {"amount_msat": 5000, "label": "x", "description": "x"}}`)
+	if status != 401 {
+		t.Errorf("invoice with a restricted key: expected 401, got %d", status)
+	}
+
+	status, inv := rpcRequest(t, ln, "masterkey", `{"method": "invoice", "params": {"amount_msat": 5000, "label": "coffee", "description": "a coffee"}}`)
+	if status != 200 || !strings.HasPrefix(inv.Get("bolt11").String(), "lnfake") {
+		t.Fatalf("invoice: got %d %s", status, inv.Raw)
+	}
+
+	// waiting for an unpaid invoice times out
+	start := time.Now()
+	status, res := rpcRequest(t, ln, "masterkey", `{"method": "waitinvoice", "params": ["coffee"]}`)
+	if status == 200 || time.Since(start) > time.Second*5 {
+		t.Errorf("waitinvoice should have timed out: got %d %s", status, res.Raw)
+	}
+
+	events := listenStream(t, ln, "payer", "/stream", nil)
+	status, res = rpcRequest(t, ln, "payer", `{"method": "pay", "params": {"bolt11": "`+inv.Get("bolt11").String()+`"}}`)
+	if status != 200 || res.Get("status").String() != "complete" || res.Get("amount_msat").Int() != 5000 {
+		t.Errorf("pay: got %d %s", status, res.Raw)
+	}
+	if received := receivedEvents(events, "invoice_payment"); len(received) != 1 ||
+		gjson.Get(received[0], "invoice_payment.label").String() != "coffee" {
+		t.Errorf("wrong invoice_payment events: %v", received)
+	}
+
+	status, res = rpcRequest(t, ln, "masterkey", `{"method": "waitinvoice", "params": ["coffee"]}`)
+	if status != 200 || res.Get("status").String() != "paid" || res.Get("payment_preimage").String() == "" {
+		t.Errorf("waitinvoice after paying: got %d %s", status, res.Raw)
+	}
+}
+
+func TestNodeScoping(t *testing.T) {
+	help := func(commands ...string) MethodHandler {
+		return func(params gjson.Result) (interface{}, *RPCError) {
+			var entries []interface{}
+			for _, command := range commands {
+				entries = append(entries, map[string]interface{}{"command": command, "description": command})
+			}
+			return map[string]interface{}{"help": entries}, nil
+		}
+	}
+	remote := StartLightningd(t, map[string]interface{}{"sparko-keys": "remotekey"}, map[string]MethodHandler{
+		"help": help("getinfo", "listfunds"),
+		"getinfo": func(params gjson.Result) (interface{}, *RPCError) {
+			return map[string]interface{}{"id": "03bb", "alias": "remote"}, nil
+		},
+	})
+	ln := StartLightningd(t, map[string]interface{}{
+		"sparko-keys":  "masterkey; scoped: remote/getinfo, remote/stream; localstream: stream",
+		"sparko-nodes": "remote=" + remote.URL("/?access-key=remotekey"),
+	}, map[string]MethodHandler{
+		"help":    help("getinfo", "pay [amount_msat]"),
+		"getinfo": getinfo["getinfo"],
+	})
+
+	// X-Node doesn't give access to the merged stream, and each key only gets
+	// the events of the nodes it can read
+	scoped := listenStream(t, ln, "scoped", "/stream", map[string]string{"X-Node": "remote"})
+	local := listenStream(t, ln, "localstream", "/stream", nil)
+	master := listenStream(t, ln, "masterkey", "/stream", nil)
+	time.Sleep(time.Millisecond * 500)
+	ln.Notify("connect", map[string]interface{}{"id": "02dd", "address": map[string]interface{}{}})
+	remote.Notify("connect", map[string]interface{}{"id": "02cc", "address": map[string]interface{}{}})
+
+	for _, c := range []struct {
+		name          string
+		events        <-chan string
+		local, remote int
+	}{
+		{"scoped", scoped, 0, 1},
+		{"localstream", local, 1, 0},
+		{"masterkey", master, 1, 1},
+	} {
+		var localEvents, remoteEvents int
+		timeout := time.After(time.Second * 2)
+	collect:
+		for {
+			select {
+			case e := <-c.events:
+				if strings.HasPrefix(e, "connect ") {
+					localEvents++
+				}
+				if strings.HasPrefix(e, "remote/connect ") {
+					remoteEvents++
+				}
+			case <-timeout:
+				break collect
+			}
+		}
+		if localEvents != c.local || remoteEvents != c.remote {
+			t.Errorf("%s got %d local and %d remote events, expected %d and %d",
+				c.name, localEvents, remoteEvents, c.local, c.remote)
+		}
+	}
+
+	// each node has its own discovery document
+	discover := func(key string, path string, node string) (int, []string, string) {
+		req, _ := http.NewRequest("GET", ln.URL(path), nil)
+		req.Header.Set("X-Access", key)
+		if node != "" {
+			req.Header.Set("X-Node", node)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		doc := gjson.ParseBytes(b)
+		var names []string
+		for _, method := range doc.Get("methods").Array() {
+			names = append(names, method.Get("name").String())
+		}
+		return resp.StatusCode, names, doc.Get("servers.0.url").String()
+	}
+	for _, c := range []struct {
+		key, path, node string
+		methods         string
+		server          string
+	}{
+		{"masterkey", "/openrpc.json", "", "getinfo,pay", "/rpc"},
+		{"masterkey", "/nodes/remote/openrpc.json", "", "getinfo,listfunds", "/nodes/remote/rpc"},
+		{"masterkey", "/openrpc.json", "remote", "getinfo,listfunds", "/nodes/remote/rpc"},
+		{"scoped", "/nodes/remote/openrpc.json", "", "getinfo", "/nodes/remote/rpc"},
+		{"scoped", "/openrpc.json", "", "", "/rpc"},
+	} {
+		status, names, server := discover(c.key, c.path, c.node)
+		if status != 200 || strings.Join(names, ",") != c.methods || server != c.server {
+			t.Errorf("%s at %s (node %q): got %d %v %s", c.key, c.path, c.node, status, names, server)
+		}
+	}
+	if status, _, _ := discover("masterkey", "/nodes/unknown/openrpc.json", ""); status != 404 {
+		t.Errorf("discovery of an unknown node: expected 404, got %d", status)
+	}
+
+	// jobs are only found under the node they ran on
+	req, _ := http.NewRequest("POST", ln.URL("/nodes/remote/rpc?async=1"), strings.NewReader(`{"method": "getinfo"}`))
+	req.Header.Set("X-Access", "masterkey")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	location := resp.Header.Get("Location")
+	if resp.StatusCode != 202 || !strings.HasPrefix(location, "/nodes/remote/jobs/") {
+		t.Fatalf("async call on remote: got %d %s", resp.StatusCode, location)
+	}
+	getJob := func(path string) (int, gjson.Result) {
+		req, _ := http.NewRequest("GET", ln.URL(path), nil)
+		req.Header.Set("X-Access", "masterkey")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, gjson.ParseBytes(b)
+	}
+	if status, _ := getJob(strings.TrimPrefix(location, "/nodes/remote")); status != 404 {
+		t.Errorf("remote job found on the local node: got %d", status)
+	}
+	for i := 0; ; i++ {
+		status, job := getJob(location)
+		if status == 200 && job.Get("status").String() == "complete" {
+			if job.Get("result.id").String() != "03bb" {
+				t.Errorf("wrong remote job result: %s", job.Raw)
+			}
+			break
+		}
+		if i == 50 {
+			t.Fatalf("remote job didn't complete: %d %s", status, job.Raw)
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	lightning "github.com/fiatjaf/lightningd-gjson-rpc"
+	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
+	"github.com/tidwall/gjson"
+)
+
+// FakeNode is an in-memory Backend that behaves like a very small lightning
+// node: it can create invoices, pay its own invoices and emits the same events
+// lightningd does when that happens. more methods can be added with Handle().
+// it is used to run sparko without a node (`--fake-node` in standalone mode)
+// and to test the HTTP layers.
+type FakeNode struct {
+	Id      string
+	Balance int64 // msat
+
+	mutex    sync.Mutex
+	methods  map[string]FakeMethod
+	invoices map[string]*fakeInvoice // by payment_hash
+	events   chan event
+}
+
+type FakeMethod struct {
+	Usage       string
+	Description string
+	Handler     func(ctx context.Context, params gjson.Result) (interface{}, error)
+}
+
+type fakeInvoice struct {
+	Label       string `json:"label"`
+	Bolt11      string `json:"bolt11"`
+	PaymentHash string `json:"payment_hash"`
+	Preimage    string `json:"payment_preimage,omitempty"`
+	AmountMsat  int64  `json:"amount_msat"`
+	Description string `json:"description"`
+	Status      string `json:"status"`
+	ExpiresAt   int64  `json:"expires_at"`
+	PaidAt      int64  `json:"paid_at,omitempty"`
+
+	preimage string
+	paid     chan struct{} // closed when paid
+}
+
+func NewFakeNode() *FakeNode {
+	id := make([]byte, 33)
+	rand.Read(id)
+	id[0] = 2
+
+	node := &FakeNode{
+		Id:       hex.EncodeToString(id),
+		Balance:  1000000000,
+		methods:  make(map[string]FakeMethod),
+		invoices: make(map[string]*fakeInvoice),
+		events:   make(chan event, 100),
+	}
+
+	node.Handle("getinfo", "", "Show information about this node.", node.getinfo)
+	node.Handle("listfunds", "", "Show available funds from the internal wallet.", node.listfunds)
+	node.Handle("invoice", "amount_msat label description [expiry]", "Create an invoice.", node.invoice)
+	node.Handle("listinvoices", "[label] [invstring] [payment_hash]", "Show invoices.", node.listinvoices)
+	node.Handle("waitinvoice", "label", "Wait for an invoice to be paid.", node.waitinvoice)
+	node.Handle("decodepay", "bolt11", "Decode a bolt11 invoice.", node.decodepay)
+	node.Handle("pay", "bolt11 [amount_msat]", "Pay an invoice.", node.pay)
+
+	return node
+}
+
+// Handle adds or replaces a method. params are given to the handler as named
+// params, following the usage string, and ctx is done when the call times out.
+func (node *FakeNode) Handle(name string, usage string, description string, handler func(ctx context.Context, params gjson.Result) (interface{}, error)) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	node.methods[name] = FakeMethod{usage, description, handler}
+}
+
+// Emit sends an event as if it came from the node.
+func (node *FakeNode) Emit(typ string, data interface{}) {
+	j, _ := json.Marshal(data)
+	node.events <- event{typ: typ, data: string(j)}
+}
+
+func (node *FakeNode) Call(timeout time.Duration, req lightning.JSONRPCMessage) ([]byte, error) {
+	if req.Method == "help" {
+		help, _ := node.Help()
+		return []byte(help.Raw), nil
+	}
+
+	node.mutex.Lock()
+	method, ok := node.methods[req.Method]
+	node.mutex.Unlock()
+	if !ok {
+		return nil, lightning.ErrorCommand{"Unknown command '" + req.Method + "'", -32601, nil}
+	}
+
+	params, err := plugin.GetParams(req.Params, method.Usage)
+	if err != nil {
+		return nil, lightning.ErrorCommand{err.Error(), -32602, nil}
+	}
+	jparams, _ := json.Marshal(params)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	type result struct {
+		respbytes []byte
+		err       error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := method.Handler(ctx, gjson.ParseBytes(jparams))
+		if err != nil {
+			var errc lightning.ErrorCommand
+			if !errors.As(err, &errc) {
+				errc = lightning.ErrorCommand{err.Error(), -1, nil}
+			}
+			done <- result{nil, errc}
+			return
+		}
+		respbytes, err := json.Marshal(resp)
+		done <- result{respbytes, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.respbytes, res.err
+	case <-ctx.Done():
+		return nil, errors.New("timeout calling " + req.Method)
+	}
+}
+
+func (node *FakeNode) Events() <-chan event {
+	return node.events
+}
+
+func (node *FakeNode) Help() (gjson.Result, error) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+
+	help := make([]map[string]string, 0, len(node.methods))
+	for name, method := range node.methods {
+		help = append(help, map[string]string{
+			"command":     strings.TrimSpace(name + " " + method.Usage),
+			"description": method.Description,
+		})
+	}
+	sort.Slice(help, func(i, j int) bool { return help[i]["command"] < help[j]["command"] })
+
+	j, _ := json.Marshal(map[string]interface{}{"help": help})
+	return gjson.ParseBytes(j), nil
+}
+
+func (node *FakeNode) getinfo(ctx context.Context, params gjson.Result) (interface{}, error) {
+	return map[string]interface{}{
+		"id":          node.Id,
+		"alias":       "fakenode",
+		"color":       "000000",
+		"network":     "regtest",
+		"blockheight": 100,
+		"version":     "fake",
+	}, nil
+}
+
+func (node *FakeNode) listfunds(ctx context.Context, params gjson.Result) (interface{}, error) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+
+	return map[string]interface{}{
+		"outputs": []interface{}{},
+		"channels": []interface{}{
+			map[string]interface{}{
+				"peer_id":         node.Id,
+				"state":           "CHANNELD_NORMAL",
+				"our_amount_msat": node.Balance,
+				"amount_msat":     node.Balance * 2,
+			},
+		},
+	}, nil
+}
+
+func (node *FakeNode) invoice(ctx context.Context, params gjson.Result) (interface{}, error) {
+	label := params.Get("label").String()
+
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+
+	for _, inv := range node.invoices {
+		if inv.Label == label {
+			return nil, lightning.ErrorCommand{"Duplicate label '" + label + "'", 900, nil}
+		}
+	}
+
+	preimage := make([]byte, 32)
+	rand.Read(preimage)
+	hash := sha256.Sum256(preimage)
+	expiry := params.Get("expiry").Int()
+	if expiry == 0 {
+		expiry = 604800
+	}
+
+	inv := &fakeInvoice{
+		Label:       label,
+		Bolt11:      "lnfake" + hex.EncodeToString(hash[:]),
+		PaymentHash: hex.EncodeToString(hash[:]),
+		AmountMsat:  params.Get("amount_msat").Int(),
+		Description: params.Get("description").String(),
+		Status:      "unpaid",
+		ExpiresAt:   time.Now().Unix() + expiry,
+		preimage:    hex.EncodeToString(preimage),
+		paid:        make(chan struct{}),
+	}
+	node.invoices[inv.PaymentHash] = inv
+
+	return map[string]interface{}{
+		"bolt11":       inv.Bolt11,
+		"payment_hash": inv.PaymentHash,
+		"expires_at":   inv.ExpiresAt,
+	}, nil
+}
+
+func (node *FakeNode) listinvoices(ctx context.Context, params gjson.Result) (interface{}, error) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+
+	label := params.Get("label").String()
+	invstring := params.Get("invstring").String()
+	hash := params.Get("payment_hash").String()
+
+	invoices := make([]fakeInvoice, 0)
+	for _, inv := range node.invoices {
+		if (label != "" && inv.Label != label) ||
+			(invstring != "" && inv.Bolt11 != invstring) ||
+			(hash != "" && inv.PaymentHash != hash) {
+			continue
+		}
+		invoices = append(invoices, *inv)
+	}
+	sort.Slice(invoices, func(i, j int) bool { return invoices[i].ExpiresAt < invoices[j].ExpiresAt })
+
+	return map[string]interface{}{"invoices": invoices}, nil
+}
+
+func (node *FakeNode) waitinvoice(ctx context.Context, params gjson.Result) (interface{}, error) {
+	label := params.Get("label").String()
+
+	node.mutex.Lock()
+	var found *fakeInvoice
+	for _, inv := range node.invoices {
+		if inv.Label == label {
+			found = inv
+		}
+	}
+	node.mutex.Unlock()
+	if found == nil {
+		return nil, lightning.ErrorCommand{"Unknown invoice", -1, nil}
+	}
+
+	select {
+	case <-found.paid:
+		node.mutex.Lock()
+		defer node.mutex.Unlock()
+		return *found, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (node *FakeNode) decodepay(ctx context.Context, params gjson.Result) (interface{}, error) {
+	bolt11 := params.Get("bolt11").String()
+
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+
+	inv, ok := node.invoices[strings.TrimPrefix(bolt11, "lnfake")]
+	if !ok || !strings.HasPrefix(bolt11, "lnfake") {
+		return nil, lightning.ErrorCommand{"Invalid bolt11: not a fake invoice", -32602, nil}
+	}
+	decoded := map[string]interface{}{
+		"payee":        node.Id,
+		"payment_hash": inv.PaymentHash,
+		"description":  inv.Description,
+		"expiry":       inv.ExpiresAt - time.Now().Unix(),
+	}
+	if inv.AmountMsat > 0 {
+		decoded["amount_msat"] = inv.AmountMsat
+	}
+	return decoded, nil
+}
+
+// pay pays invoices created by this same node, moving nothing anywhere but
+// emitting the events of both the payer and the payee.
+func (node *FakeNode) pay(ctx context.Context, params gjson.Result) (interface{}, error) {
+	bolt11 := params.Get("bolt11").String()
+
+	node.mutex.Lock()
+	inv, ok := node.invoices[strings.TrimPrefix(bolt11, "lnfake")]
+	if !ok || !strings.HasPrefix(bolt11, "lnfake") {
+		node.mutex.Unlock()
+		return nil, lightning.ErrorCommand{"Invalid bolt11: not a fake invoice", -32602, nil}
+	}
+	if inv.Status == "paid" {
+		node.mutex.Unlock()
+		return nil, lightning.ErrorCommand{"This invoice has already been paid", 211, nil}
+	}
+	amount := inv.AmountMsat
+	if amount == 0 {
+		amount = params.Get("amount_msat").Int()
+	}
+	if amount <= 0 {
+		node.mutex.Unlock()
+		return nil, lightning.ErrorCommand{"amount_msat parameter required", -32602, nil}
+	}
+	if amount > node.Balance {
+		node.mutex.Unlock()
+		return nil, lightning.ErrorCommand{"Ran out of routes to try", 210, nil}
+	}
+	inv.Status = "paid"
+	inv.Preimage = inv.preimage
+	inv.PaidAt = time.Now().Unix()
+	inv.AmountMsat = amount
+	close(inv.paid)
+	paid := *inv
+	node.mutex.Unlock()
+
+	node.Emit("sendpay_success", map[string]interface{}{
+		"sendpay_success": map[string]interface{}{
+			"payment_hash":     paid.PaymentHash,
+			"status":           "complete",
+			"amount_msat":      amount,
+			"amount_sent_msat": amount,
+			"payment_preimage": paid.Preimage,
+		},
+	})
+	node.Emit("invoice_payment", map[string]interface{}{
+		"invoice_payment": map[string]interface{}{
+			"label":    paid.Label,
+			"preimage": paid.Preimage,
+			"msat":     amount,
+		},
+	})
+
+	return map[string]interface{}{
+		"payment_hash":     paid.PaymentHash,
+		"payment_preimage": paid.Preimage,
+		"amount_msat":      amount,
+		"amount_sent_msat": amount,
+		"status":           "complete",
+		"parts":            1,
+		"created_at":       paid.PaidAt,
+	}, nil
+}
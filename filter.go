@@ -0,0 +1,202 @@
+// Server-side filtering of RPC responses, so clients don't have to download
+// everything just to pick a few entries.
+//
+//   X-Query: <gjson path>                       (e.g. `invoices.#.label`)
+//   X-Filter: <key>: <field><op><value> & ...   (e.g. `invoices: status==paid & paid_at>now-86400`)
+//   X-Fields: <key>: <field>,<field>,...        (e.g. `invoices: label,amount_msat,paid_at`)
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+var predicateRe = regexp.MustCompile(`^\s*([\w.]+)\s*(==|!=|>=|<=|>|<)\s*(.*?)\s*$`)
+
+type predicate struct {
+	field string
+	op    string
+	value string
+}
+
+// applyFilters transforms a raw lightningd response according to the
+// X-Query, X-Filter and X-Fields headers, in this order.
+func applyFilters(r *http.Request, respbytes []byte) ([]byte, error) {
+	if query := r.Header.Get("X-Query"); query != "" {
+		res := gjson.GetBytes(respbytes, query)
+		if !res.Exists() {
+			return []byte("null"), nil
+		}
+		respbytes = []byte(res.Raw)
+	}
+
+	filterHeader := r.Header.Get("X-Filter")
+	fieldsHeader := r.Header.Get("X-Fields")
+	if filterHeader == "" && fieldsHeader == "" {
+		return respbytes, nil
+	}
+
+	var response map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(respbytes))
+	decoder.UseNumber()
+	if err := decoder.Decode(&response); err != nil {
+		return nil, fmt.Errorf("response is not an object, can't filter")
+	}
+
+	if filterHeader != "" {
+		key, predicates, err := parseFilter(filterHeader)
+		if err != nil {
+			return nil, err
+		}
+		entries, ok := response[key].([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("'%s' is not an array, can't filter", key)
+		}
+
+		filtered := make([]interface{}, 0, len(entries))
+		for _, entry := range entries {
+			if matchesAll(entry, predicates) {
+				filtered = append(filtered, entry)
+			}
+		}
+		response[key] = filtered
+	}
+
+	if fieldsHeader != "" {
+		spl := strings.SplitN(fieldsHeader, ":", 2)
+		if len(spl) != 2 {
+			return nil, fmt.Errorf("invalid X-Fields, should be '<key>: <field>,<field>'")
+		}
+		key := strings.TrimSpace(spl[0])
+		entries, ok := response[key].([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("'%s' is not an array, can't select fields", key)
+		}
+
+		fields := strings.Split(spl[1], ",")
+		for i, entry := range entries {
+			object, ok := entry.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			projected := make(map[string]interface{}, len(fields))
+			for _, field := range fields {
+				field = strings.TrimSpace(field)
+				if value, exists := object[field]; exists {
+					projected[field] = value
+				}
+			}
+			entries[i] = projected
+		}
+	}
+
+	return json.Marshal(response)
+}
+
+func parseFilter(header string) (key string, predicates []predicate, err error) {
+	spl := strings.SplitN(header, ":", 2)
+	if len(spl) != 2 {
+		return "", nil, fmt.Errorf("invalid X-Filter, should be '<key>: <field><op><value>'")
+	}
+	key = strings.TrimSpace(spl[0])
+
+	for _, expr := range strings.Split(spl[1], "&") {
+		match := predicateRe.FindStringSubmatch(expr)
+		if match == nil {
+			return "", nil, fmt.Errorf("invalid X-Filter predicate '%s'", strings.TrimSpace(expr))
+		}
+		predicates = append(predicates, predicate{
+			field: match[1],
+			op:    match[2],
+			value: strings.Trim(match[3], `"'`),
+		})
+	}
+
+	return key, predicates, nil
+}
+
+func matchesAll(entry interface{}, predicates []predicate) bool {
+	j, _ := json.Marshal(entry)
+	for _, pred := range predicates {
+		if !pred.matches(gjson.GetBytes(j, pred.field)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (pred predicate) matches(res gjson.Result) bool {
+	if !res.Exists() {
+		return pred.op == "!="
+	}
+
+	// compare as numbers whenever possible ("1000msat" counts as a number)
+	a, errA := strconv.ParseFloat(strings.TrimSuffix(res.String(), "msat"), 64)
+	b, errB := parseFilterNumber(pred.value)
+	if errA == nil && errB == nil {
+		switch pred.op {
+		case "==":
+			return a == b
+		case "!=":
+			return a != b
+		case ">":
+			return a > b
+		case ">=":
+			return a >= b
+		case "<":
+			return a < b
+		case "<=":
+			return a <= b
+		}
+	}
+
+	switch pred.op {
+	case "==":
+		return res.String() == pred.value
+	case "!=":
+		return res.String() != pred.value
+	case ">":
+		return res.String() > pred.value
+	case ">=":
+		return res.String() >= pred.value
+	case "<":
+		return res.String() < pred.value
+	case "<=":
+		return res.String() <= pred.value
+	}
+	return false
+}
+
+// parseFilterNumber parses numbers, also accepting `now` and `now-<seconds>`
+// to make filtering by timestamps easier.
+func parseFilterNumber(value string) (float64, error) {
+	if strings.HasPrefix(value, "now") {
+		now := float64(time.Now().Unix())
+		rest := strings.TrimPrefix(value, "now")
+		if rest == "" {
+			return now, nil
+		}
+		delta, err := strconv.ParseFloat(rest[1:], 64)
+		if err != nil {
+			return 0, err
+		}
+		switch rest[0] {
+		case '-':
+			return now - delta, nil
+		case '+':
+			return now + delta, nil
+		}
+		return 0, fmt.Errorf("invalid number '%s'", value)
+	}
+
+	return strconv.ParseFloat(strings.TrimSuffix(value, "msat"), 64)
+}
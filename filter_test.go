@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFilters(t *testing.T) {
+	now := time.Now().Unix()
+	response := fmt.Sprintf(`{"invoices": [
+		{"label": "a", "status": "paid", "amount_msat": 1000, "paid_at": %d},
+		{"label": "b", "status": "unpaid", "amount_msat": "2000msat"},
+		{"label": "c", "status": "paid", "amount_msat": 3000, "paid_at": %d, "description": "coffee"},
+		{"label": "d", "status": "expired", "amount_msat": 500}
+	], "other": 1}`, now-100, now-200000)
+
+	for _, c := range []struct {
+		query    string
+		filter   string
+		fields   string
+		expected string // "error" if it must fail
+	}{
+		{"invoices.#.label", "", "", `["a","b","c","d"]`},
+		{"invoices.#(label==\"b\").status", "", "", `"unpaid"`},
+		{"nothing", "", "", `null`},
+		{"", "invoices: status==paid", "invoices: label", `{"invoices":[{"label":"a"},{"label":"c"}],"other":1}`},
+		{"", "invoices: status != paid", "invoices: label", `{"invoices":[{"label":"b"},{"label":"d"}],"other":1}`},
+		{"", "invoices: amount_msat>=2000", "invoices: label", `{"invoices":[{"label":"b"},{"label":"c"}],"other":1}`},
+		{"", "invoices: amount_msat<1000msat", "invoices: label", `{"invoices":[{"label":"d"}],"other":1}`},
+		{"", "invoices: paid_at>now-86400", "invoices: label", `{"invoices":[{"label":"a"}],"other":1}`},
+		{"", "invoices: status==paid & amount_msat>1000", "invoices: label", `{"invoices":[{"label":"c"}],"other":1}`},
+		{"", `invoices: description=="coffee"`, "invoices: label", `{"invoices":[{"label":"c"}],"other":1}`},
+		{"", "invoices: description!=coffee", "invoices: label", `{"invoices":[{"label":"a"},{"label":"b"},{"label":"d"}],"other":1}`},
+		{"", "invoices: label>b", "invoices: label", `{"invoices":[{"label":"c"},{"label":"d"}],"other":1}`},
+		{"", "invoices: status==nothing", "", `{"invoices":[],"other":1}`},
+		{"", "", "invoices: label, paid_at", fmt.Sprintf(`{"invoices":[{"label":"a","paid_at":%d},{"label":"b"},{"label":"c","paid_at":%d},{"label":"d"}],"other":1}`, now-100, now-200000)},
+		{"", "invoices: status~paid", "", "error"},
+		{"", "invoices status==paid", "", "error"},
+		{"", "other: status==paid", "", "error"},
+		{"", "", "invoices label", "error"},
+		{"", "", "other: label", "error"},
+		{"invoices.#.label", "invoices: status==paid", "", "error"},
+	} {
+		r := httptest.NewRequest("POST", "/rpc", nil)
+		r.Header.Set("X-Query", c.query)
+		r.Header.Set("X-Filter", c.filter)
+		r.Header.Set("X-Fields", c.fields)
+		result, err := applyFilters(r, []byte(response))
+
+		if c.expected == "error" {
+			if err == nil {
+				t.Errorf("query %q filter %q fields %q should fail, got %s", c.query, c.filter, c.fields, result)
+			}
+			continue
+		}
+		if err != nil || string(result) != c.expected {
+			t.Errorf("query %q filter %q fields %q: expected %s, got %s (%v)", c.query, c.filter, c.fields, c.expected, result, err)
+		}
+	}
+}
@@ -4,11 +4,14 @@ go 1.16
 
 require (
 	github.com/NYTimes/gziphandler v1.1.1
+	github.com/btcsuite/btcd/btcec/v2 v2.2.0
+	github.com/btcsuite/btcd/btcutil v1.1.1
 	github.com/fiatjaf/lightningd-gjson-rpc v1.6.1
 	github.com/gorilla/mux v1.7.4
 	github.com/gorilla/securecookie v1.1.1
 	github.com/rs/cors v1.7.0
 	github.com/tidwall/gjson v1.6.1
 	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
+	golang.org/x/net v0.0.0-20211015210444-4f30a5c0130f
 	gopkg.in/antage/eventsource.v1 v1.0.0-20150318155416-803f4c5af225
 )
@@ -0,0 +1,361 @@
+package main
+
+// A fake lightningd that runs the sparko binary as a plugin, speaking the
+// plugin protocol on its stdin/stdout and answering the calls it makes to
+// the lightning-rpc socket with canned responses.
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+var pluginBinary string
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "sparko-test")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	pluginBinary = filepath.Join(dir, "sparko")
+	build := exec.Command("go", "build", "-o", pluginBinary, ".")
+	build.Stderr = os.Stderr
+	if err := build.Run(); err != nil {
+		fmt.Fprintln(os.Stderr, "failed to build sparko:", err)
+		os.Exit(1)
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// RPCError is what a canned method returns to fail.
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type MethodHandler func(params gjson.Result) (interface{}, *RPCError)
+
+type FakeLightningd struct {
+	t        *testing.T
+	Dir      string
+	Port     string
+	Manifest gjson.Result
+
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	writeMu sync.Mutex
+
+	mutex     sync.Mutex
+	methods   map[string]MethodHandler
+	calls     []gjson.Result // every call made to the rpc socket
+	responses map[int64]chan gjson.Result
+	nextId    int64
+}
+
+// StartLightningd runs the plugin with the given options (all others get
+// their defaults, as lightningd does) and waits for its HTTP server.
+func StartLightningd(t *testing.T, options map[string]interface{}, methods map[string]MethodHandler) *FakeLightningd {
+	return StartLightningdWithData(t, nil, options, methods)
+}
+
+// StartLightningdWithData is the same as StartLightningd, but first writes the
+// given files to the sparko data directory, as if left by a previous run.
+func StartLightningdWithData(
+	t *testing.T,
+	data map[string]string,
+	options map[string]interface{},
+	methods map[string]MethodHandler,
+) *FakeLightningd {
+	dir, err := ioutil.TempDir("", "lightningd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range data {
+		path := filepath.Join(dir, "sparko", name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ln := &FakeLightningd{
+		t:         t,
+		Dir:       dir,
+		Port:      freePort(t),
+		methods:   make(map[string]MethodHandler),
+		responses: make(map[int64]chan gjson.Result),
+	}
+	ln.Handle("help", func(params gjson.Result) (interface{}, *RPCError) {
+		return map[string]interface{}{"help": []interface{}{}}, nil
+	})
+	for method, handler := range methods {
+		ln.Handle(method, handler)
+	}
+	ln.listenRPC()
+
+	ln.cmd = exec.Command(pluginBinary)
+	ln.cmd.Env = append(os.Environ(), "LIGHTNINGD_PLUGIN=1")
+	ln.cmd.Dir = dir
+	if testing.Verbose() {
+		ln.cmd.Stderr = os.Stderr
+	}
+	ln.stdin, _ = ln.cmd.StdinPipe()
+	stdout, _ := ln.cmd.StdoutPipe()
+	if err := ln.cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	go ln.readPlugin(stdout)
+
+	t.Cleanup(ln.Stop)
+
+	ln.Manifest = ln.callPlugin("getmanifest", map[string]interface{}{})
+
+	opts := map[string]interface{}{}
+	for _, opt := range ln.Manifest.Get("result.options").Array() {
+		if def := opt.Get("default"); def.Exists() && def.Type != gjson.Null {
+			opts[opt.Get("name").String()] = def.Value()
+		}
+	}
+	opts["sparko-port"] = ln.Port
+	for name, value := range options {
+		opts[name] = value
+	}
+	ln.callPlugin("init", map[string]interface{}{
+		"options": opts,
+		"configuration": map[string]interface{}{
+			"lightning-dir": dir,
+			"rpc-file":      "lightning-rpc",
+			"network":       "regtest",
+		},
+	})
+
+	// wait for the server
+	for i := 0; i < 100; i++ {
+		if resp, err := http.Get(ln.URL("/stream")); err == nil {
+			resp.Body.Close()
+			return ln
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	t.Fatal("sparko http server didn't start")
+	return nil
+}
+
+// StartFakeNode runs sparko standalone with --fake-node, so it has no
+// lightningd at all, and waits for its HTTP server. options without a value
+// are given as bare flags, before all the others.
+func StartFakeNode(t *testing.T, options map[string]string) *FakeLightningd {
+	dir, err := ioutil.TempDir("", "fakenode")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln := &FakeLightningd{t: t, Dir: dir, Port: freePort(t)}
+	args := []string{
+		"--fake-node",
+		"--rpc-file=" + filepath.Join(dir, "lightning-rpc"),
+		"--sparko-port=" + ln.Port,
+	}
+	for name, value := range options {
+		if value == "" {
+			args = append([]string{"--" + name}, args...)
+		} else {
+			args = append(args, "--"+name+"="+value)
+		}
+	}
+	ln.cmd = exec.Command(pluginBinary, args...)
+	ln.cmd.Env = os.Environ()
+	if testing.Verbose() {
+		ln.cmd.Stderr = os.Stderr
+	}
+	ln.stdin, _ = ln.cmd.StdinPipe()
+	if err := ln.cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ln.Stop)
+
+	for i := 0; i < 100; i++ {
+		if resp, err := http.Get(ln.URL("/stream")); err == nil {
+			resp.Body.Close()
+			return ln
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	t.Fatal("sparko http server didn't start")
+	return nil
+}
+
+func freePort(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return fmt.Sprintf("%d", l.Addr().(*net.TCPAddr).Port)
+}
+
+func (ln *FakeLightningd) URL(path string) string {
+	return "http://127.0.0.1:" + ln.Port + path
+}
+
+func (ln *FakeLightningd) Stop() {
+	ln.stdin.Close()
+	ln.cmd.Process.Kill()
+	ln.cmd.Wait()
+	os.RemoveAll(ln.Dir)
+}
+
+// Handle sets the canned response for a method called on the rpc socket.
+func (ln *FakeLightningd) Handle(method string, handler MethodHandler) {
+	ln.mutex.Lock()
+	defer ln.mutex.Unlock()
+	ln.methods[method] = handler
+}
+
+// Calls returns the calls made to the rpc socket with the given method.
+func (ln *FakeLightningd) Calls(method string) []gjson.Result {
+	ln.mutex.Lock()
+	defer ln.mutex.Unlock()
+
+	var calls []gjson.Result
+	for _, call := range ln.calls {
+		if call.Get("method").String() == method {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+func (ln *FakeLightningd) listenRPC() {
+	listener, err := net.Listen("unix", filepath.Join(ln.Dir, "lightning-rpc"))
+	if err != nil {
+		ln.t.Fatal(err)
+	}
+	ln.t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go ln.serveRPC(conn)
+		}
+	}()
+}
+
+func (ln *FakeLightningd) serveRPC(conn net.Conn) {
+	defer conn.Close()
+	decoder := json.NewDecoder(conn)
+	encoder := json.NewEncoder(conn)
+
+	for {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			return
+		}
+		call := gjson.ParseBytes(raw)
+		method := call.Get("method").String()
+
+		ln.mutex.Lock()
+		ln.calls = append(ln.calls, call)
+		handler, ok := ln.methods[method]
+		ln.mutex.Unlock()
+
+		response := map[string]interface{}{
+			"jsonrpc": "2.0",
+			"id":      call.Get("id").Value(),
+		}
+		if !ok {
+			response["error"] = RPCError{-32601, "Unknown command '" + method + "'"}
+		} else if result, rpcerr := handler(call.Get("params")); rpcerr != nil {
+			response["error"] = rpcerr
+		} else {
+			response["result"] = result
+		}
+		encoder.Encode(response)
+	}
+}
+
+func (ln *FakeLightningd) readPlugin(stdout io.Reader) {
+	decoder := json.NewDecoder(bufio.NewReader(stdout))
+	for {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			return
+		}
+		msg := gjson.ParseBytes(raw)
+
+		ln.mutex.Lock()
+		if response, ok := ln.responses[msg.Get("id").Int()]; ok {
+			response <- msg
+		}
+		ln.mutex.Unlock()
+	}
+}
+
+func (ln *FakeLightningd) send(msg map[string]interface{}) {
+	ln.writeMu.Lock()
+	defer ln.writeMu.Unlock()
+	json.NewEncoder(ln.stdin).Encode(msg)
+}
+
+// callPlugin sends a request to the plugin and returns the full response.
+func (ln *FakeLightningd) callPlugin(method string, params interface{}) gjson.Result {
+	ln.mutex.Lock()
+	ln.nextId++
+	id := ln.nextId
+	response := make(chan gjson.Result, 1)
+	ln.responses[id] = response
+	ln.mutex.Unlock()
+
+	ln.send(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      id,
+		"method":  method,
+		"params":  params,
+	})
+
+	select {
+	case msg := <-response:
+		return msg
+	case <-time.After(time.Second * 10):
+		ln.t.Fatalf("plugin didn't answer %s", method)
+		return gjson.Result{}
+	}
+}
+
+// CallPlugin calls one of the RPC methods provided by the plugin, as
+// `lightning-cli` would, returning its result or error.
+func (ln *FakeLightningd) CallPlugin(method string, params interface{}) (result gjson.Result, rpcerr gjson.Result) {
+	msg := ln.callPlugin(method, params)
+	return msg.Get("result"), msg.Get("error")
+}
+
+// Notify sends a notification to the plugin.
+func (ln *FakeLightningd) Notify(topic string, params interface{}) {
+	ln.send(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"method":  topic,
+		"params":  params,
+	})
+}
@@ -4,8 +4,16 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
 )
 
 var nonLetters = regexp.MustCompile(`\W+`)
@@ -23,3 +31,43 @@ func pathExists(path string) bool {
 	}
 	return true
 }
+
+// readMethodDurations parses a comma-separated list of method:seconds pairs.
+func readMethodDurations(configstr string) (map[string]time.Duration, error) {
+	durations := make(map[string]time.Duration)
+
+	for _, entry := range strings.Split(configstr, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.Split(entry, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid entry '%s', should be 'method:seconds'", entry)
+		}
+		seconds, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || seconds <= 0 {
+			return nil, fmt.Errorf("invalid number of seconds for '%s'", parts[0])
+		}
+		durations[strings.TrimSpace(parts[0])] = time.Second * time.Duration(seconds)
+	}
+
+	return durations, nil
+}
+
+// dataPath returns a path inside the directory where sparko keeps its data,
+// which is a "sparko" directory inside the lightning dir.
+func dataPath(p *plugin.Plugin, name string) string {
+	return filepath.Join(filepath.Dir(p.Client.Path), "sparko", name)
+}
+
+// writeFileAtomic writes to a temporary file first so we never end up with a
+// half-written file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,145 @@
+// Idempotency keys for /rpc calls.
+// When a call comes with an `Idempotency-Key` header its result is stored on
+// disk and returned again for any retry with the same key, so a client retrying
+// `pay` or `withdraw` after a network failure can't spend twice.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	lightning "github.com/fiatjaf/lightningd-gjson-rpc"
+	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
+)
+
+const IDEMPOTENCYRETENTION = time.Hour * 24 * 7
+
+type IdempotencyRecord struct {
+	Fingerprint string                  `json:"fingerprint"`
+	Method      string                  `json:"method"`
+	Status      string                  `json:"status"` // "pending" or "done"
+	Result      json.RawMessage         `json:"result,omitempty"`
+	Error       *lightning.ErrorCommand `json:"error,omitempty"`
+	CreatedAt   int64                   `json:"created_at"`
+}
+
+// IdempotencyError is returned when a key can't be used for the given call.
+type IdempotencyError struct {
+	Status  int
+	Message string
+}
+
+func (e IdempotencyError) Error() string { return e.Message }
+
+var idempotencyMutex sync.Mutex
+
+func idempotencyDir(p *plugin.Plugin) string {
+	return dataPath(p, "idempotency")
+}
+
+// callIdempotent performs the call only if it wasn't performed before with
+// the same key, otherwise returns the stored result. keys are scoped to the
+// access key (identified by its key id) that made the call.
+func callIdempotent(
+	p *plugin.Plugin,
+	keyid string,
+	key string,
+	b Backend,
+	node string,
+	req lightning.JSONRPCMessage,
+	timeout time.Duration,
+) ([]byte, error) {
+	jparams, _ := json.Marshal(req.Params)
+	fingerprint := sha256.Sum256(append([]byte(nodePrefix(node)+req.Method+":"), jparams...))
+	keyhash := sha256.Sum256([]byte(keyid + ":" + key))
+	path := filepath.Join(idempotencyDir(p), hex.EncodeToString(keyhash[:])+".json")
+
+	idempotencyMutex.Lock()
+	var record IdempotencyRecord
+	if b, err := ioutil.ReadFile(path); err == nil {
+		idempotencyMutex.Unlock()
+
+		if err := json.Unmarshal(b, &record); err != nil {
+			return nil, IdempotencyError{500, "corrupted idempotency record"}
+		}
+		if record.Fingerprint != hex.EncodeToString(fingerprint[:]) {
+			return nil, IdempotencyError{422, "Idempotency-Key was already used with a different request"}
+		}
+		if record.Status == "pending" {
+			return nil, IdempotencyError{409, "a request with this Idempotency-Key is still in progress or its outcome is unknown"}
+		}
+		if record.Error != nil {
+			return nil, *record.Error
+		}
+		return record.Result, nil
+	}
+
+	record = IdempotencyRecord{
+		Fingerprint: hex.EncodeToString(fingerprint[:]),
+		Method:      req.Method,
+		Status:      "pending",
+		CreatedAt:   time.Now().Unix(),
+	}
+	err := saveIdempotencyRecord(path, record)
+	idempotencyMutex.Unlock()
+	if err != nil {
+		p.Log("failed to save idempotency record: " + err.Error())
+		return nil, IdempotencyError{500, "failed to store Idempotency-Key"}
+	}
+
+	respbytes, err := b.Call(timeout, req)
+	if err != nil {
+		cmderr, ok := err.(lightning.ErrorCommand)
+		if !ok {
+			// we don't know what happened (a timeout, maybe), so the record
+			// stays pending and retries won't be executed
+			return nil, err
+		}
+		record.Error = &cmderr
+	} else {
+		record.Result = respbytes
+	}
+	record.Status = "done"
+
+	idempotencyMutex.Lock()
+	if err := saveIdempotencyRecord(path, record); err != nil {
+		p.Log("failed to save idempotency record: " + err.Error())
+	}
+	idempotencyMutex.Unlock()
+
+	if record.Error != nil {
+		return nil, *record.Error
+	}
+	return respbytes, nil
+}
+
+func saveIdempotencyRecord(path string, record IdempotencyRecord) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	j, _ := json.Marshal(record)
+	return writeFileAtomic(path, j)
+}
+
+// pruneIdempotencyRecords deletes records older than a week.
+func pruneIdempotencyRecords(p *plugin.Plugin) {
+	idempotencyMutex.Lock()
+	defer idempotencyMutex.Unlock()
+
+	entries, err := ioutil.ReadDir(idempotencyDir(p))
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if time.Since(entry.ModTime()) > IDEMPOTENCYRETENTION {
+			os.Remove(filepath.Join(idempotencyDir(p), entry.Name()))
+		}
+	}
+}
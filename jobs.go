@@ -0,0 +1,176 @@
+// Per-method timeouts and asynchronous calls.
+// Calls made with /rpc?async=1 return a job id immediately and are executed in
+// the background. When they finish a `job-complete` event is emitted on /stream
+// and the result can also be fetched at /jobs/{id}, both only for the key that
+// made the call.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	lightning "github.com/fiatjaf/lightningd-gjson-rpc"
+	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
+	"github.com/gorilla/mux"
+)
+
+const (
+	DEFAULTTIMEOUT = time.Second * 30
+	ASYNCTIMEOUT   = time.Hour
+	JOBRETENTION   = time.Hour * 24
+)
+
+var timeouts = make(map[string]time.Duration)
+
+// callTimeout returns the timeout configured for the method with
+// `sparko-timeouts` or the default.
+func callTimeout(method string) time.Duration {
+	if timeout, ok := timeouts[method]; ok {
+		return timeout
+	}
+	return DEFAULTTIMEOUT
+}
+
+type Job struct {
+	Id      string                   `json:"id"`
+	Status  string                   `json:"status"` // "awaiting-approval", "pending", "complete", "failed" or "denied"
+	Request lightning.JSONRPCMessage `json:"request"`
+	Node    string                   `json:"node,omitempty"`
+	KeyId   string                   `json:"-"` // of the key that made the call
+
+	idempotencyKey string
+	Result         json.RawMessage `json:"result,omitempty"`
+	Error          *LightningError `json:"error,omitempty"`
+	Started        int64           `json:"started_at"`
+	Finished       int64           `json:"finished_at,omitempty"`
+}
+
+var (
+	jobsMutex sync.Mutex
+	jobs      = make(map[string]*Job)
+)
+
+// startJob starts the call in the background and returns immediately.
+// with an idempotency key the call is only executed by the first job with it,
+// the others get its result.
+func startJob(
+	w http.ResponseWriter,
+	p *plugin.Plugin,
+	key string,
+	idempotencyKey string,
+	node string,
+	req lightning.JSONRPCMessage,
+) {
+	random := make([]byte, 16)
+	rand.Read(random)
+
+	job := &Job{
+		Id:      hex.EncodeToString(random),
+		Status:  "pending",
+		Request: req,
+		Node:    node,
+		KeyId:   keyId(key),
+		Started: time.Now().Unix(),
+
+		idempotencyKey: idempotencyKey,
+	}
+
+	jobsMutex.Lock()
+	jobs[job.Id] = job
+	for id, old := range jobs {
+		if old.Finished != 0 && time.Since(time.Unix(old.Finished, 0)) > JOBRETENTION {
+			delete(jobs, id)
+		}
+	}
+	jobsMutex.Unlock()
+
+	go runJob(p, job)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", nodePath(node)+"/jobs/"+job.Id)
+	w.WriteHeader(202)
+	json.NewEncoder(w).Encode(map[string]interface{}{"job": job.Id})
+}
+
+func runJob(p *plugin.Plugin, job *Job) {
+	// async calls can wait for longer, unless a specific timeout was set
+	timeout, ok := timeouts[job.Request.Method]
+	if !ok {
+		timeout = ASYNCTIMEOUT
+	}
+
+	var err error
+	var respbytes []byte
+	b, ok := nodeBackend(job.Node)
+	if !ok {
+		err = fmt.Errorf("unknown node '%s'", job.Node)
+	} else if job.idempotencyKey != "" {
+		respbytes, err = callIdempotent(p, job.KeyId, job.idempotencyKey, b, job.Node, job.Request, timeout)
+	} else {
+		respbytes, err = b.Call(timeout, job.Request)
+	}
+
+	jobsMutex.Lock()
+	job.Finished = time.Now().Unix()
+	if err != nil {
+		p.Logf("async '%s' call returned an error: %s", job.Request.Method, err)
+		job.Status = "failed"
+		job.Error = &LightningError{
+			Type:     "sparko",
+			Name:     "SparkoError",
+			Message:  err.Error(),
+			FullType: "sparko",
+		}
+		if cmderr, ok := err.(lightning.ErrorCommand); ok {
+			job.Error = &LightningError{
+				Type:     "lightning",
+				Name:     "LightningError",
+				Message:  cmderr.Message,
+				Code:     cmderr.Code,
+				FullType: "lightning",
+			}
+		}
+		if idemerr, ok := err.(IdempotencyError); ok {
+			job.Error.Name = "IdempotencyError"
+			job.Error.Code = idemerr.Status
+		}
+	} else {
+		job.Status = "complete"
+		job.Result = respbytes
+	}
+	j, _ := json.Marshal(job)
+	jobsMutex.Unlock()
+
+	ee <- event{typ: "job-complete", data: string(j), keyId: job.KeyId}
+}
+
+func handleJob(w http.ResponseWriter, r *http.Request) {
+	key, _ := r.Context().Value("key").(string)
+
+	jobsMutex.Lock()
+	job, ok := jobs[mux.Vars(r)["id"]]
+	var j []byte
+	if ok && (job.KeyId != keyId(key) || job.Node != requestNode(r)) {
+		// jobs of other keys (or of other nodes) don't exist as far as this
+		// one knows
+		ok = false
+	}
+	if ok {
+		j, _ = json.Marshal(job)
+	}
+	jobsMutex.Unlock()
+
+	if !ok {
+		w.WriteHeader(404)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
@@ -0,0 +1,148 @@
+// Lightning Addresses for multiple users on top of the LNURL-pay endpoints.
+// Each username configured in `sparko-lnaddress` gets its own description,
+// amount limits and invoice label prefix, so incoming payments can be told
+// apart in `listinvoices` and in `lnaddress-payment` events on /stream.
+// https://github.com/lnurl/luds/blob/luds/16.md
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
+)
+
+var lnaddressUsers = make(map[string]LNURLPayParams)
+
+// readLightningAddresses parses a semicolon-separated list of users, each
+// optionally followed by comma-separated settings, like
+// `alice: description="Tips, for Alice", min=1000, max=50000000, prefix=alice; bob`.
+// values can be quoted to contain commas or semicolons. settings not given are
+// taken from the defaults.
+func readLightningAddresses(configstr string, defaults LNURLPayParams) (map[string]LNURLPayParams, error) {
+	users := make(map[string]LNURLPayParams)
+
+	for _, userentry := range splitUnquoted(configstr, ';') {
+		parts := strings.SplitN(userentry, ":", 2)
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		if name == "" {
+			continue
+		}
+
+		params := defaults
+		params.LabelPrefix = "lnaddress/" + name
+
+		if len(parts) == 2 {
+			for _, setting := range splitUnquoted(parts[1], ',') {
+				kv := strings.SplitN(setting, "=", 2)
+				if len(kv) != 2 {
+					return nil, fmt.Errorf("invalid setting '%s' for '%s'", strings.TrimSpace(setting), name)
+				}
+				key := strings.TrimSpace(kv[0])
+				value := strings.TrimSpace(kv[1])
+				if unquoted, err := strconv.Unquote(value); err == nil {
+					value = unquoted
+				}
+
+				var err error
+				switch key {
+				case "description":
+					params.Description = value
+				case "min":
+					params.MinSendable, err = strconv.ParseInt(value, 10, 64)
+				case "max":
+					params.MaxSendable, err = strconv.ParseInt(value, 10, 64)
+				case "comment":
+					params.CommentAllowed, err = strconv.Atoi(value)
+				case "prefix":
+					params.LabelPrefix = value
+				default:
+					err = fmt.Errorf("unknown setting")
+				}
+				if err != nil {
+					return nil, fmt.Errorf("invalid setting '%s' for '%s': %w", key, name, err)
+				}
+			}
+		}
+
+		users[name] = params
+	}
+
+	return users, nil
+}
+
+// splitUnquoted splits a string on a separator that isn't inside double quotes.
+func splitUnquoted(s string, sep rune) []string {
+	var parts []string
+	quoted := false
+	escaped := false
+	start := 0
+	for i, c := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\' && quoted:
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case c == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// lnurlpParamsFor returns the LNURL-pay params for a username. When no users
+// are configured any name is accepted with the default params.
+func lnurlpParamsFor(name string) (LNURLPayParams, bool) {
+	if len(lnaddressUsers) == 0 {
+		params := lnurlpParams
+		params.LabelPrefix = "lnurlp/" + name
+		return params, true
+	}
+
+	params, ok := lnaddressUsers[strings.ToLower(name)]
+	return params, ok
+}
+
+// notifyLightningAddressPayment emits an event attributed to the user if the
+// paid invoice was created for one of them.
+// the longest prefixes are tried first, as prefixes may be prefixes of each other.
+func notifyLightningAddressPayment(p *plugin.Plugin, label string, msatoshi string) {
+	names := make([]string, 0, len(lnaddressUsers))
+	for name := range lnaddressUsers {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		pi, pj := lnaddressUsers[names[i]].LabelPrefix, lnaddressUsers[names[j]].LabelPrefix
+		if len(pi) != len(pj) {
+			return len(pi) > len(pj)
+		}
+		return names[i] < names[j]
+	})
+
+	for _, name := range names {
+		if !strings.HasPrefix(label, lnaddressUsers[name].LabelPrefix+"/") {
+			continue
+		}
+
+		comment := ""
+		if spl := strings.SplitN(label, ": ", 2); len(spl) == 2 {
+			comment = spl[1]
+		}
+
+		j, _ := json.Marshal(map[string]interface{}{
+			"username": name,
+			"label":    label,
+			"msat":     msatoshi,
+			"comment":  comment,
+		})
+		ee <- event{typ: "lnaddress-payment", data: string(j)}
+		return
+	}
+}
@@ -0,0 +1,195 @@
+// LNURL-auth login for the wallet UI, as an alternative to `sparko-login`.
+// Operators log in by signing a challenge with one of the linking keys listed
+// in `sparko-lnurlauth-keys` and get the same session cookie as with a password.
+// https://github.com/lnurl/luds/blob/luds/04.md
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"html/template"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
+	"github.com/gorilla/mux"
+)
+
+const CHALLENGEEXPIRY = time.Minute * 5
+
+type challenge struct {
+	key     string // the linking key that signed it, empty while not signed
+	expires time.Time
+}
+
+var (
+	lnurlauthKeys = make(map[string]bool)
+
+	challengesMutex sync.Mutex
+	challenges      = make(map[string]*challenge)
+)
+
+var loginPage = template.Must(template.New("login").Parse(`<!doctype html>
+<html>
+  <head>
+    <meta charset="utf-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <title>sparko login</title>
+  </head>
+  <body style="font-family: sans-serif; max-width: 600px; margin: 40px auto; word-break: break-all">
+    <h1>Login</h1>
+    <p>Sign in with your LNURL-auth wallet:</p>
+    <p><a href="lightning:{{.LNURL}}"><code>{{.LNURL}}</code></a></p>
+    {{if .Basic}}<p><a href="/?basic=1">or use your password</a></p>{{end}}
+    <script>
+      setInterval(function () {
+        fetch('/lnurlauth/{{.K1}}/status', {credentials: 'same-origin'})
+          .then(function (r) { if (r.status === 200) location.href = '/' })
+      }, 2000)
+    </script>
+  </body>
+</html>`))
+
+// readLNURLAuthKeys parses a comma-separated list of linking keys.
+func readLNURLAuthKeys(configstr string) (map[string]bool, error) {
+	keys := make(map[string]bool)
+	for _, key := range strings.Split(configstr, ",") {
+		key = strings.ToLower(strings.TrimSpace(key))
+		if key == "" {
+			continue
+		}
+		b, err := hex.DecodeString(key)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := btcec.ParsePubKey(b); err != nil {
+			return nil, err
+		}
+		keys[key] = true
+	}
+	return keys, nil
+}
+
+// isLNURLAuthUser tells if a session cookie value belongs to an operator that
+// logged in with a linking key that is still allowed.
+func isLNURLAuthUser(user string) bool {
+	return strings.HasPrefix(user, "lnurlauth:") &&
+		lnurlauthKeys[strings.TrimPrefix(user, "lnurlauth:")]
+}
+
+func addLNURLAuthRoutes(router *mux.Router) {
+	router.Path("/login").Methods("GET").HandlerFunc(handleLoginPage)
+	router.Path("/lnurlauth/callback").Methods("GET").HandlerFunc(handleLNURLAuthCallback)
+	router.Path("/lnurlauth/{k1}/status").Methods("GET").HandlerFunc(handleLNURLAuthStatus)
+}
+
+func handleLoginPage(w http.ResponseWriter, r *http.Request) {
+	random := make([]byte, 32)
+	rand.Read(random)
+	k1 := hex.EncodeToString(random)
+
+	challengesMutex.Lock()
+	for k, c := range challenges {
+		if time.Now().After(c.expires) {
+			delete(challenges, k)
+		}
+	}
+	challenges[k1] = &challenge{expires: time.Now().Add(CHALLENGEEXPIRY)}
+	challengesMutex.Unlock()
+
+	w.Header().Set("Content-Type", "text/html")
+	loginPage.Execute(w, map[string]interface{}{
+		"LNURL": encodeLNURL(baseURL(r) + "/lnurlauth/callback?tag=login&k1=" + k1),
+		"K1":    k1,
+		"Basic": login != "",
+	})
+}
+
+func handleLNURLAuthCallback(w http.ResponseWriter, r *http.Request) {
+	p := r.Context().Value("plugin").(*plugin.Plugin)
+	qs := r.URL.Query()
+	k1 := qs.Get("k1")
+	key := strings.ToLower(qs.Get("key"))
+
+	challengesMutex.Lock()
+	c, ok := challenges[k1]
+	challengesMutex.Unlock()
+	if !ok || time.Now().After(c.expires) {
+		writeLNURLError(w, "unknown or expired challenge")
+		return
+	}
+
+	k1b, err1 := hex.DecodeString(k1)
+	sigb, err2 := hex.DecodeString(qs.Get("sig"))
+	keyb, err3 := hex.DecodeString(key)
+	if err1 != nil || err2 != nil || err3 != nil {
+		writeLNURLError(w, "invalid params")
+		return
+	}
+	pubkey, err := btcec.ParsePubKey(keyb)
+	if err != nil {
+		writeLNURLError(w, "invalid key")
+		return
+	}
+	sig, err := ecdsa.ParseDERSignature(sigb)
+	if err != nil || !sig.Verify(k1b, pubkey) {
+		writeLNURLError(w, "invalid signature")
+		return
+	}
+
+	if !lnurlauthKeys[key] {
+		p.Logf("unknown linking key %s tried to log in, add it to sparko-lnurlauth-keys if that was you", key)
+		writeLNURLError(w, "this key is not allowed")
+		return
+	}
+
+	// each challenge can only be signed once
+	challengesMutex.Lock()
+	signed := c.key != ""
+	if !signed {
+		c.key = key
+	}
+	challengesMutex.Unlock()
+	if signed {
+		writeLNURLError(w, "challenge already used")
+		return
+	}
+
+	p.Logf("linking key %s logged in", key)
+	writeLNURL(w, map[string]interface{}{"status": "OK"})
+}
+
+// handleLNURLAuthStatus is polled by the login page and sets the session
+// cookie once the challenge is signed.
+func handleLNURLAuthStatus(w http.ResponseWriter, r *http.Request) {
+	k1 := mux.Vars(r)["k1"]
+
+	challengesMutex.Lock()
+	c, ok := challenges[k1]
+	key := ""
+	if ok {
+		key = c.key
+		if key != "" {
+			// each challenge can only be used once
+			delete(challenges, k1)
+		}
+	}
+	challengesMutex.Unlock()
+
+	if !ok || time.Now().After(c.expires) {
+		w.WriteHeader(404)
+		return
+	}
+	if key == "" {
+		w.WriteHeader(202)
+		return
+	}
+
+	setUserCookie(w, "lnurlauth:"+key)
+	w.WriteHeader(200)
+}
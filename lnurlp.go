@@ -0,0 +1,219 @@
+// LNURL-pay endpoints, so the node can receive payments from LNURL wallets
+// without a separate server.
+// https://github.com/lnurl/luds/blob/luds/06.md
+// https://github.com/lnurl/luds/blob/luds/12.md (comments)
+// https://github.com/lnurl/luds/blob/luds/16.md (/.well-known/lnurlp/{name})
+// https://github.com/nostr-protocol/nips/blob/master/57.md (zaps, see zaps.go)
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcutil/bech32"
+	lightning "github.com/fiatjaf/lightningd-gjson-rpc"
+	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
+	"github.com/gorilla/mux"
+)
+
+type LNURLPayParams struct {
+	Description    string
+	MinSendable    int64
+	MaxSendable    int64
+	CommentAllowed int
+	LabelPrefix    string
+}
+
+var (
+	lnurlpParams LNURLPayParams
+	lnurlBaseURL string
+)
+
+func addLNURLPayRoutes(router *mux.Router) {
+	router.Path("/.well-known/lnurlp/{name}").Methods("GET").HandlerFunc(handleLNURLPay)
+	router.Path("/lnurlp/{name}/callback").Methods("GET").HandlerFunc(handleLNURLPayCallback)
+}
+
+func handleLNURLPay(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	params, ok := lnurlpParamsFor(name)
+	if !ok {
+		writeLNURLError(w, "unknown user")
+		return
+	}
+
+	response := map[string]interface{}{
+		"tag":            "payRequest",
+		"callback":       baseURL(r) + "/lnurlp/" + name + "/callback",
+		"minSendable":    params.MinSendable,
+		"maxSendable":    params.MaxSendable,
+		"metadata":       lnurlpMetadata(r, name, params),
+		"commentAllowed": params.CommentAllowed,
+	}
+	if zapsEnabled {
+		response["allowsNostr"] = true
+		response["nostrPubkey"] = zapPubKey()
+	}
+	writeLNURL(w, response)
+}
+
+func handleLNURLPayCallback(w http.ResponseWriter, r *http.Request) {
+	p := r.Context().Value("plugin").(*plugin.Plugin)
+	name := mux.Vars(r)["name"]
+	params, ok := lnurlpParamsFor(name)
+	if !ok {
+		writeLNURLError(w, "unknown user")
+		return
+	}
+
+	amount, err := strconv.ParseInt(r.URL.Query().Get("amount"), 10, 64)
+	if err != nil {
+		writeLNURLError(w, "invalid amount")
+		return
+	}
+	if amount < params.MinSendable || amount > params.MaxSendable {
+		writeLNURLError(w, "amount out of bounds")
+		return
+	}
+
+	comment := r.URL.Query().Get("comment")
+	if len(comment) > params.CommentAllowed {
+		writeLNURLError(w, "comment too long")
+		return
+	}
+
+	random := make([]byte, 8)
+	rand.Read(random)
+	label := params.LabelPrefix + "/" + hex.EncodeToString(random)
+	if comment != "" {
+		label += ": " + comment
+	}
+
+	// zaps commit to the zap request instead of the metadata
+	description := lnurlpMetadata(r, name, params)
+	nostr := r.URL.Query().Get("nostr")
+	if nostr != "" && zapsEnabled {
+		if _, err := parseZapRequest(nostr, amount); err != nil {
+			writeLNURLError(w, err.Error())
+			return
+		}
+		description = nostr
+		if err := saveZapRequest(p, label, nostr); err != nil {
+			p.Log("failed to save zap request: " + err.Error())
+			writeLNURLError(w, "internal error")
+			return
+		}
+	}
+
+	bolt11, err := invoiceWithDescriptionHash(p, label, amount, description)
+	if err != nil {
+		p.Log("failed to create invoice for lnurl-pay: " + err.Error())
+		writeLNURLError(w, "failed to create invoice")
+		return
+	}
+
+	writeLNURL(w, map[string]interface{}{
+		"pr":     bolt11,
+		"routes": []interface{}{},
+	})
+}
+
+// lnurlpMetadata is the same for the first request and the callback (as the
+// invoice commits to its hash) and uses the public host when it's configured.
+func lnurlpMetadata(r *http.Request, name string, params LNURLPayParams) string {
+	host := strings.Split(r.Host, ":")[0]
+	if u, err := url.Parse(baseURL(r)); err == nil && u.Hostname() != "" {
+		host = u.Hostname()
+	}
+	metadata, _ := json.Marshal([][]string{
+		{"text/plain", params.Description},
+		{"text/identifier", name + "@" + host},
+	})
+	return string(metadata)
+}
+
+// invoiceWithDescriptionHash creates an invoice committing to the hash of the
+// given description. lightningd can do this by itself since v0.11 with
+// `deschashonly`, on older versions we sign the invoice ourselves.
+func invoiceWithDescriptionHash(p *plugin.Plugin, label string, msatoshi int64, description string) (string, error) {
+	inv, err := callBackend("invoice", map[string]interface{}{
+		"amount_msat":  msatoshi,
+		"label":        label,
+		"description":  description,
+		"deschashonly": true,
+	})
+	if err == nil {
+		return inv.Get("bolt11").String(), nil
+	}
+	if cmderr, ok := err.(lightning.ErrorCommand); !ok ||
+		!strings.Contains(strings.ToLower(cmderr.Message), "unknown parameter") {
+		return "", err
+	}
+
+	hash := sha256.Sum256([]byte(description))
+	return invoiceWithHash(p, label, msatoshi, hash[:], 0)
+}
+
+// invoiceWithHash creates an invoice committing to a description hash without
+// knowing the description: lightningd creates it with a placeholder
+// description and we sign it again with the hash.
+func invoiceWithHash(p *plugin.Plugin, label string, msatoshi int64, hash []byte, expiry int64) (string, error) {
+	params := map[string]interface{}{
+		"label":       label,
+		"description": lightning.DESCRIPTION_HASH_DESCRIPTION_PREFIX + hex.EncodeToString(hash),
+	}
+	if invoiceHasAmountMsat(getNodeVersion(p)) {
+		params["amount_msat"] = msatoshi
+	} else {
+		params["msatoshi"] = msatoshi
+	}
+	if expiry > 0 {
+		params["expiry"] = expiry
+	}
+
+	inv, err := callBackend("invoice", params)
+	if err != nil {
+		return "", err
+	}
+	return p.Client.TranslateInvoiceWithDescriptionHash(inv.Get("bolt11").String())
+}
+
+// baseURL is the URL at which this sparko is being accessed.
+func baseURL(r *http.Request) string {
+	if lnurlBaseURL != "" {
+		return lnurlBaseURL
+	}
+
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// encodeLNURL encodes an URL as a bech32 LNURL.
+func encodeLNURL(url string) string {
+	converted, _ := bech32.ConvertBits([]byte(url), 8, 5, true)
+	lnurl, _ := bech32.Encode("lnurl", converted)
+	return strings.ToUpper(lnurl)
+}
+
+func writeLNURL(w http.ResponseWriter, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(response)
+}
+
+func writeLNURLError(w http.ResponseWriter, reason string) {
+	writeLNURL(w, map[string]interface{}{
+		"status": "ERROR",
+		"reason": reason,
+	})
+}
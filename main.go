@@ -3,9 +3,12 @@ package main
 import (
 	"bytes"
 	"embed"
+	"encoding/hex"
 	"encoding/json"
 	"io/fs"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/NYTimes/gziphandler"
 	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
@@ -38,16 +41,69 @@ func main() {
 			{"sparko-host", "string", "127.0.0.1", "http(s) server listen address"},
 			{"sparko-port", "string", DEFAULTPORT, "http(s) server port"},
 			{"sparko-login", "string", nil, "http basic auth login, \"username:password\" format"},
+			{"sparko-lnurlauth-keys", "string", nil, "comma-separated list of LNURL-auth linking keys allowed to log in to the wallet UI"},
 			{"sparko-keys", "string", nil, "semicolon-separated list of key-permissions pairs"},
 			{"sparko-tls-path", "string", nil, "directory to read/store key.pem and cert.pem for TLS (relative to your lightning directory)"},
 			{"sparko-letsencrypt-email", "string", nil, "email in which LetsEncrypt will notify you and other things"},
 			{"sparko-allow-cors", "bool", false, "allow CORS"},
+			{"sparko-cache", "string", nil, "comma-separated list of method:seconds pairs of read-only methods to cache"},
+			{"sparko-timeouts", "string", nil, "comma-separated list of method:seconds pairs of call timeouts (default is 30 seconds)"},
+			{"sparko-approval-keys", "string", nil, "comma-separated list of keys whose calls must be approved by an operator"},
+			{"sparko-approval-rules", "string", DEFAULTAPPROVALRULES, "comma-separated list of methods that require approval, optionally with a threshold in msat"},
+			{"sparko-operators", "string", nil, "comma-separated list of name:pubkey pairs of operators that can sign approvals"},
+			{"sparko-quorum-rules", "string", nil, "comma-separated list of method:quorum pairs of methods that require approval from a number of operators"},
+			{"sparko-approval-expiry", "int", 86400, "seconds after which calls awaiting approval expire"},
+			{"sparko-open-min", "int", 0, "minimum size of channels opened through sparko, in satoshis"},
+			{"sparko-open-max", "int", 0, "maximum size of channels opened through sparko, in satoshis"},
+			{"sparko-open-max-per-peer", "int", 0, "maximum total size of the channels with a single peer, in satoshis"},
+			{"sparko-open-max-feerate", "int", 0, "maximum feerate of channel funding transactions, in perkw"},
+			{"sparko-open-reserve", "int", 0, "satoshis that must stay on-chain after opening channels"},
+			{"sparko-open-allowed-peers", "string", nil, "comma-separated list of the only node ids channels can be opened to"},
+			{"sparko-open-blocked-peers", "string", nil, "comma-separated list of node ids channels can't be opened to"},
+			{"sparko-lnurl-base-url", "string", nil, "public URL at which sparko is reachable, used in LNURL callbacks (defaults to the host of each request)"},
+			{"sparko-lnurlp", "bool", false, "serve LNURL-pay endpoints at /.well-known/lnurlp/{name}"},
+			{"sparko-lnurlp-description", "string", "Payment to sparko", "description of LNURL-pay payments"},
+			{"sparko-lnurlp-min", "int", 1000, "minimum amount of LNURL-pay payments, in msat"},
+			{"sparko-lnurlp-max", "int", 1000000000, "maximum amount of LNURL-pay payments, in msat"},
+			{"sparko-lnurlp-comment-length", "int", 0, "maximum length of comments on LNURL-pay payments, 0 means comments are not allowed"},
+			{"sparko-lnurlp-zaps", "bool", false, "accept nostr zap requests on LNURL-pay and publish zap receipts when they're paid"},
+			{"sparko-lnaddress", "string", nil, "semicolon-separated list of lightning address usernames, each with optional settings"},
+			{"sparko-companion-socket", "string", nil, "Unix socket through which the plugin forwards events and calls to sparko running standalone, instead of serving HTTP itself"},
+			{"sparko-companion-socket-mode", "string", "0600", "permissions of the companion socket, in octal"},
+			{"sparko-companion-socket-owner", "string", nil, "user:group to give the companion socket to, so a standalone sparko running as another user can connect"},
+			{"sparko-nwc-relays", "string", nil, "comma-separated list of nostr relays on which to serve Nostr Wallet Connect"},
+			{"sparko-nodes", "string", nil, "semicolon-separated list of name=target pairs of other nodes to route calls to, targets being lightning-rpc paths or sparko URLs with ?access-key="},
 		},
 		RPCMethods: []plugin.RPCMethod{
 			// required by spark-wallet
 			connectFund,
 			closeGet,
 			listpaysExt,
+
+			// channels funded by external wallets
+			connectFundStart,
+			connectFundComplete,
+			connectFundCancel,
+
+			// batches
+			connectFundBatch,
+			closeGetBatch,
+
+			// approval workflow
+			sparkoPending,
+			sparkoApprove,
+			sparkoDeny,
+			sparkoAudit,
+
+			// lnurl-withdraw vouchers
+			sparkoVoucherCreate,
+			sparkoVoucherList,
+			sparkoVoucherRevoke,
+
+			// nostr wallet connect
+			sparkoNWCCreate,
+			sparkoNWCList,
+			sparkoNWCRevoke,
 		},
 		Subscriptions: []plugin.Subscription{
 			subscribeSSE("channel_opened"),
@@ -55,7 +111,18 @@ func main() {
 			subscribeSSE("channel_state_changed"),
 			subscribeSSE("channel_opened"),
 			subscribeSSE("connect"),
-			subscribeSSE("disconnect"),
+			{
+				"disconnect",
+				func(p *plugin.Plugin, params plugin.Params) {
+					subscribeSSE("disconnect").Handler(p, params)
+
+					peerid := params.Get("disconnect.id").String()
+					if peerid == "" {
+						peerid = params.Get("id").String()
+					}
+					dropPendingOpen(peerid)
+				},
+			},
 			{
 				"invoice_payment",
 				func(p *plugin.Plugin, params plugin.Params) {
@@ -66,12 +133,19 @@ func main() {
 
 					// and the one spark wants
 					label := params.Get("invoice_payment.label").String()
-					inv, err := p.Client.Call("waitinvoice", label)
+					inv, err := callBackend("waitinvoice", []interface{}{label})
 					if err != nil {
 						p.Logf("Failed to get invoice on inv-paid notification: %s", err)
 						return
 					}
-					ee <- event{typ: "inv-paid", data: inv.String()}
+					invpaid, _ := json.Marshal(normalizeInvoice(inv))
+					clnEvents <- event{typ: "inv-paid", data: string(invpaid)}
+
+					// and one for lightning addresses
+					notifyLightningAddressPayment(p, label, params.Get("invoice_payment.msat").String())
+
+					// and a zap receipt on nostr if this was a zap
+					publishZapReceipt(p, inv)
 				},
 			},
 			subscribeSSE("invoice_creation"),
@@ -84,6 +158,18 @@ func main() {
 			subscribeSSE("openchannel_peer_sigs"),
 		},
 		OnInit: func(p *plugin.Plugin) {
+			// when sparko runs standalone we're just a companion
+			companionSocket, _ := p.Args.String("sparko-companion-socket")
+			if companionSocket != "" && !standalone {
+				startCompanion(p, companionSocket)
+				return
+			}
+
+			// the node we're a bridge to
+			if backend == nil {
+				backend = CLNBackend{p}
+			}
+
 			// compute access key
 			login, _ = p.Args.String("sparko-login")
 			if login != "" {
@@ -92,6 +178,21 @@ func main() {
 				p.Log("Login credentials read: " + login + " (full-access key: " + accessKey + ")")
 			}
 
+			// lnurl-auth login
+			if linkingkeys, err := p.Args.String("sparko-lnurlauth-keys"); err == nil {
+				lnurlauthKeys, err = readLNURLAuthKeys(linkingkeys)
+				if err != nil {
+					p.Log("Error reading LNURL-auth keys: " + err.Error())
+					return
+				}
+				if login == "" && len(lnurlauthKeys) > 0 {
+					// the wallet UI needs a full-access key, make a random one
+					accessKey = hmacStr(hex.EncodeToString(securecookie.GenerateRandomKey(32)), "access-key")
+					manifestKey = hmacStr(accessKey, "manifest-key")
+				}
+				p.Logf("%d LNURL-auth keys allowed to log in", len(lnurlauthKeys))
+			}
+
 			// permissions
 			if keypermissions, err := p.Args.String("sparko-keys"); err == nil {
 				keys, err = readPermissionsConfig(keypermissions)
@@ -106,8 +207,120 @@ func main() {
 				}
 			}
 
+			// calls that require approval
+			if approvalkeys, err := p.Args.String("sparko-approval-keys"); err == nil {
+				for _, key := range strings.Split(approvalkeys, ",") {
+					if key = strings.TrimSpace(key); key != "" {
+						approvalKeys[key] = true
+					}
+				}
+			}
+			if rules, err := p.Args.String("sparko-approval-rules"); err == nil {
+				approvalRules, err = readApprovalRules(rules, false)
+				if err != nil {
+					p.Log("Error reading approval rules: " + err.Error())
+					return
+				}
+			}
+			if ops, err := p.Args.String("sparko-operators"); err == nil {
+				operators, err = readOperators(ops)
+				if err != nil {
+					p.Log("Error reading operators: " + err.Error())
+					return
+				}
+			}
+			if rules, err := p.Args.String("sparko-quorum-rules"); err == nil {
+				quorumRules, err = readApprovalRules(rules, true)
+				if err != nil {
+					p.Log("Error reading quorum rules: " + err.Error())
+					return
+				}
+				for _, rule := range quorumRules {
+					if rule.Quorum > len(operators) {
+						p.Logf("Quorum of %d for '%s' can never be reached with %d operators.",
+							rule.Quorum, rule.Method, len(operators))
+						return
+					}
+				}
+			}
+			if expiry, err := p.Args.Int("sparko-approval-expiry"); err == nil && expiry > 0 {
+				approvalExpiry = time.Second * time.Duration(expiry)
+			}
+
+			// channel opening policy
+			openPolicy = OpenPolicy{
+				MinSatoshi:        p.Args.Get("sparko-open-min").Int(),
+				MaxSatoshi:        p.Args.Get("sparko-open-max").Int(),
+				MaxPerPeerSatoshi: p.Args.Get("sparko-open-max-per-peer").Int(),
+				MaxFeerate:        p.Args.Get("sparko-open-max-feerate").Int(),
+				ReserveSatoshi:    p.Args.Get("sparko-open-reserve").Int(),
+			}
+			if peers, err := p.Args.String("sparko-open-allowed-peers"); err == nil {
+				openPolicy.AllowedPeers = readPeerList(peers)
+			}
+			if peers, err := p.Args.String("sparko-open-blocked-peers"); err == nil {
+				openPolicy.BlockedPeers = readPeerList(peers)
+			}
+
+			if err := loadPendingCalls(p); err != nil {
+				p.Log("Error loading calls pending approval: " + err.Error())
+			}
+			go func() {
+				for {
+					expirePendingCalls(p)
+					time.Sleep(time.Minute)
+				}
+			}()
+
+			// per-method timeouts
+			if timeoutsconfig, err := p.Args.String("sparko-timeouts"); err == nil {
+				timeouts, err = readMethodDurations(timeoutsconfig)
+				if err != nil {
+					p.Log("Error reading timeouts config: " + err.Error())
+					return
+				}
+			}
+
+			// response cache
+			if cacheconfig, err := p.Args.String("sparko-cache"); err == nil {
+				cacheTTLs, err = readCacheConfig(cacheconfig)
+				if err != nil {
+					p.Log("Error reading cache config: " + err.Error())
+					return
+				}
+				p.Logf("%d methods will be cached", len(cacheTTLs))
+			}
+
+			// other nodes
+			if nodesconfig, err := p.Args.String("sparko-nodes"); err == nil {
+				nodes, err = readNodes(nodesconfig, p.Logf)
+				if err != nil {
+					p.Log("Error reading nodes config: " + err.Error())
+					return
+				}
+				p.Logf("routing calls to %d other nodes", len(nodes))
+			}
+
+			// clean up old idempotency keys
+			go func() {
+				for {
+					pruneIdempotencyRecords(p)
+					time.Sleep(time.Hour)
+				}
+			}()
+
+			// list available methods for discovery
+			go func() {
+				if err := loadMethods(""); err != nil {
+					p.Log("Error loading methods from `help`: " + err.Error())
+				}
+			}()
+
 			// start eventsource thing
-			es := startStreams(p)
+			startStreams(p)
+			if companionSocket != "" && standalone {
+				go connectCompanion(p, companionSocket)
+			}
 
 			// declare routes
 			router := mux.NewRouter()
@@ -115,12 +328,86 @@ func main() {
 			router.Use(authMiddleware(p))
 			router.Use(gziphandler.GzipHandler)
 
-			router.Path("/stream").Methods("GET").Handler(
-				checkStreamPermission(es),
-			)
+			router.Path("/stream").Methods("GET").HandlerFunc(handleStream)
 			router.Path("/rpc").Methods("POST").Handler(http.HandlerFunc(handleRPC))
+			addRESTRoutes(router.PathPrefix("/v1").Subrouter())
+			router.Path("/openrpc.json").Methods("GET").HandlerFunc(handleDiscovery)
+			router.Path("/jobs/{id}").Methods("GET").HandlerFunc(handleJob)
+
+			nodeRouter := router.PathPrefix("/nodes/{node}").Subrouter()
+			nodeRouter.Path("/stream").Methods("GET").HandlerFunc(handleNodeStream)
+			nodeRouter.Path("/openrpc.json").Methods("GET").HandlerFunc(handleDiscovery)
+			nodeRouter.Path("/jobs/{id}").Methods("GET").HandlerFunc(handleJob)
+			nodeRouter.Path("/rpc").Methods("POST").HandlerFunc(handleRPC)
+			addRESTRoutes(nodeRouter.PathPrefix("/v1").Subrouter())
+
+			go func() {
+				for {
+					time.Sleep(time.Minute * 10)
+					prunePendingOpens(p)
+				}
+			}()
+
+			// lnurl
+			lnurlBaseURL, _ = p.Args.String("sparko-lnurl-base-url")
+			lnurlBaseURL = strings.TrimSuffix(lnurlBaseURL, "/")
+			if p.Args.Get("sparko-lnurlp").Bool() {
+				lnurlpParams = LNURLPayParams{
+					Description:    p.Args.Get("sparko-lnurlp-description").String(),
+					MinSendable:    p.Args.Get("sparko-lnurlp-min").Int(),
+					MaxSendable:    p.Args.Get("sparko-lnurlp-max").Int(),
+					CommentAllowed: int(p.Args.Get("sparko-lnurlp-comment-length").Int()),
+				}
+				if users, err := p.Args.String("sparko-lnaddress"); err == nil {
+					lnaddressUsers, err = readLightningAddresses(users, lnurlpParams)
+					if err != nil {
+						p.Log("Error reading lightning addresses config: " + err.Error())
+						return
+					}
+					p.Logf("%d lightning addresses enabled", len(lnaddressUsers))
+				}
+				if p.Args.Get("sparko-lnurlp-zaps").Bool() {
+					if err := loadZaps(p); err != nil {
+						p.Log("Error loading zaps data: " + err.Error())
+						return
+					}
+					zapsEnabled = true
+					p.Log("Zaps enabled with nostr key " + zapPubKey())
+				}
+				addLNURLPayRoutes(router)
+			}
+			if err := loadVouchers(p); err != nil {
+				p.Log("Error loading vouchers: " + err.Error())
+			}
+			go func() {
+				for {
+					resolvePendingVouchers(p)
+					time.Sleep(time.Minute * 10)
+				}
+			}()
+			addVoucherRoutes(router)
+
+			// nostr wallet connect
+			if relays, err := p.Args.String("sparko-nwc-relays"); err == nil {
+				for _, relay := range strings.Split(relays, ",") {
+					if relay = strings.TrimSpace(relay); relay != "" {
+						nwcRelayURLs = append(nwcRelayURLs, relay)
+					}
+				}
+				if len(nwcRelayURLs) > 0 {
+					if err := loadNWC(p); err != nil {
+						p.Log("Error loading Nostr Wallet Connect data: " + err.Error())
+						return
+					}
+					startNWC(p)
+				}
+			}
+
+			if login != "" || len(lnurlauthKeys) > 0 {
+				if len(lnurlauthKeys) > 0 {
+					addLNURLAuthRoutes(router)
+				}
 
-			if login != "" {
 				// web ui
 				router.Path("/").Methods("GET").HandlerFunc(
 					func(w http.ResponseWriter, r *http.Request) {
@@ -150,6 +437,12 @@ func main() {
 		},
 	}
 
+	if isStandalone() {
+		runStandalone(&p)
+		return
+	}
+
+	wrapForCompanion(&p)
 	p.Run()
 }
 
@@ -158,7 +451,7 @@ func subscribeSSE(kind string) plugin.Subscription {
 		kind,
 		func(p *plugin.Plugin, params plugin.Params) {
 			j, _ := json.Marshal(params)
-			ee <- event{typ: kind, data: string(j)}
+			clnEvents <- event{typ: kind, data: string(j)}
 		},
 	}
 }
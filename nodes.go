@@ -0,0 +1,288 @@
+// Other nodes sparko can be a gateway to, besides the one it runs on.
+// They're configured with `sparko-nodes` and can be either other lightningd
+// sockets or other sparko instances. Calls are sent to them with an `X-Node`
+// header or under `/nodes/{name}/`, and their events are merged into
+// `/stream` with their name as a prefix to the event type.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	lightning "github.com/fiatjaf/lightningd-gjson-rpc"
+	"github.com/gorilla/mux"
+	"github.com/tidwall/gjson"
+	"gopkg.in/antage/eventsource.v1"
+)
+
+const LOCALNODE = "local"
+
+var (
+	nodes       = make(map[string]Backend)
+	nodeStreams = make(map[string]eventsource.EventSource)
+
+	validNodeName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+)
+
+// readNodes parses a semicolon-separated list of name=target pairs, where
+// targets are either paths to lightning-rpc sockets or URLs of other sparko
+// instances with their key as an `access-key` query parameter.
+func readNodes(configstr string, logf func(string, ...interface{})) (map[string]Backend, error) {
+	backends := make(map[string]Backend)
+	for _, entry := range strings.Split(configstr, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		spl := strings.SplitN(entry, "=", 2)
+		if len(spl) != 2 {
+			return nil, fmt.Errorf("invalid node '%s', should be 'name=target'", entry)
+		}
+		name := strings.TrimSpace(spl[0])
+		target := strings.TrimSpace(spl[1])
+		if !validNodeName.MatchString(name) || name == LOCALNODE {
+			return nil, fmt.Errorf("invalid node name '%s'", name)
+		}
+
+		if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+			b, err := newSparkoBackend(target, logf)
+			if err != nil {
+				return nil, fmt.Errorf("invalid URL for node '%s': %w", name, err)
+			}
+			backends[name] = b
+		} else {
+			backends[name] = SocketBackend{&lightning.Client{Path: target}}
+		}
+	}
+	return backends, nil
+}
+
+// requestNode is the name of the node a request is for, from the path or
+// from the `X-Node` header. it is empty for the local node.
+func requestNode(r *http.Request) string {
+	node := mux.Vars(r)["node"]
+	if node == "" {
+		node = r.Header.Get("X-Node")
+	}
+	if node == LOCALNODE {
+		return ""
+	}
+	return node
+}
+
+// nodePath is the prefix of the routes of a node.
+func nodePath(node string) string {
+	if node == "" {
+		return ""
+	}
+	return "/nodes/" + node
+}
+
+func nodeBackend(node string) (Backend, bool) {
+	if node == "" {
+		return backend, true
+	}
+	b, ok := nodes[node]
+	return b, ok
+}
+
+// mergeNodeEvents sends the events of each node to its own stream and, with
+// the node name prefixed to their type, to the main stream.
+func mergeNodeEvents(ee chan<- event) {
+	for name, b := range nodes {
+		events := b.Events()
+		if events == nil {
+			continue
+		}
+
+		es := eventsource.New(nil, nil)
+		nodeStreams[name] = es
+
+		go func(name string, es eventsource.EventSource, events <-chan event) {
+			id := 1
+			for e := range events {
+				es.SendEventMessage(e.data, e.typ, fmt.Sprintf("%d", id))
+				ee <- event{typ: name + "/" + e.typ, data: e.data, node: name}
+				id++
+			}
+		}(name, es, events)
+	}
+}
+
+// handleNodeStream serves the events of a single node.
+func handleNodeStream(w http.ResponseWriter, r *http.Request) {
+	if !isAllowed(r, "stream") {
+		w.WriteHeader(401)
+		return
+	}
+	es, ok := nodeStreams[requestNode(r)]
+	if !ok {
+		w.WriteHeader(404)
+		return
+	}
+	es.ServeHTTP(w, r)
+}
+
+// SocketBackend is another lightningd we can only call methods on, as we
+// don't get its notifications.
+type SocketBackend struct {
+	client *lightning.Client
+}
+
+func (s SocketBackend) Call(timeout time.Duration, req lightning.JSONRPCMessage) ([]byte, error) {
+	return s.client.CallMessageRaw(timeout, req)
+}
+
+func (s SocketBackend) Events() <-chan event { return nil }
+
+func (s SocketBackend) Help() (gjson.Result, error) {
+	return s.client.Call("help")
+}
+
+// SparkoBackend is another sparko, reached over HTTP with one of its keys.
+type SparkoBackend struct {
+	URL string
+	Key string
+
+	logf       func(string, ...interface{})
+	eventsOnce sync.Once
+	events     chan event
+}
+
+func newSparkoBackend(target string, logf func(string, ...interface{})) (*SparkoBackend, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	qs := u.Query()
+	key := qs.Get("access-key")
+	qs.Del("access-key")
+	u.RawQuery = qs.Encode()
+
+	return &SparkoBackend{
+		URL:    strings.TrimSuffix(u.String(), "/"),
+		Key:    key,
+		logf:   logf,
+		events: make(chan event),
+	}, nil
+}
+
+func (s *SparkoBackend) Call(timeout time.Duration, req lightning.JSONRPCMessage) ([]byte, error) {
+	body, _ := json.Marshal(req)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	hreq, _ := http.NewRequestWithContext(ctx, "POST", s.URL+"/rpc", bytes.NewReader(body))
+	hreq.Header.Set("X-Access", s.Key)
+	hreq.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respbytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == 202 {
+		// parked for approval (or an async job), so there's no result yet
+		job := gjson.GetBytes(respbytes, "job").String()
+		status := gjson.GetBytes(respbytes, "status").String()
+		if status == "" {
+			status = "pending"
+		}
+		return nil, fmt.Errorf("%s didn't execute the call yet, it is %s as job %s", s.URL, status, job)
+	}
+	if resp.StatusCode != 200 {
+		var lnerr LightningError
+		if json.Unmarshal(respbytes, &lnerr) == nil && lnerr.Type == "lightning" {
+			return nil, lightning.ErrorCommand{lnerr.Message, lnerr.Code, nil}
+		}
+		return nil, fmt.Errorf("%s returned %d", s.URL, resp.StatusCode)
+	}
+	return respbytes, nil
+}
+
+func (s *SparkoBackend) Events() <-chan event {
+	s.eventsOnce.Do(func() { go s.stream() })
+	return s.events
+}
+
+func (s *SparkoBackend) Help() (gjson.Result, error) {
+	respbytes, err := s.Call(DEFAULTTIMEOUT, lightning.JSONRPCMessage{Version: "2.0", Method: "help"})
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	return gjson.ParseBytes(respbytes), nil
+}
+
+// stream listens to the events of the other sparko, reconnecting forever.
+func (s *SparkoBackend) stream() {
+	for {
+		if err := s.readStream(); err != nil {
+			s.logf("lost event stream from %s: %s", s.URL, err)
+		}
+		time.Sleep(time.Second * 5)
+	}
+}
+
+func (s *SparkoBackend) readStream() error {
+	req, _ := http.NewRequest("GET", s.URL+"/stream", nil)
+	req.Header.Set("X-Access", s.Key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("got status %d", resp.StatusCode)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	var typ string
+	var data []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if typ != "" && typ != "keepalive" && len(data) > 0 {
+				s.events <- event{typ: typ, data: strings.Join(data, "\n")}
+			}
+			typ = ""
+			data = nil
+		case strings.HasPrefix(line, "event:"):
+			typ = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errors.New("stream closed")
+}
+
+// nodePrefix is prepended to cache keys and such so entries from different
+// nodes don't clash.
+func nodePrefix(node string) string {
+	if node == "" {
+		return ""
+	}
+	return node + "/"
+}
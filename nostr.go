@@ -0,0 +1,445 @@
+// Minimal nostr support: events, signatures, NIP-04 and NIP-44 encryption and
+// relay connections. Used by Nostr Wallet Connect.
+// https://github.com/nostr-protocol/nips
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/net/websocket"
+)
+
+type NostrEvent struct {
+	Id        string     `json:"id"`
+	PubKey    string     `json:"pubkey"`
+	CreatedAt int64      `json:"created_at"`
+	Kind      int        `json:"kind"`
+	Tags      [][]string `json:"tags"`
+	Content   string     `json:"content"`
+	Sig       string     `json:"sig"`
+}
+
+// serialize returns the canonical form of the event that is hashed for its id.
+func (evt *NostrEvent) serialize() []byte {
+	tags := evt.Tags
+	if tags == nil {
+		tags = make([][]string, 0)
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode([]interface{}{0, evt.PubKey, evt.CreatedAt, evt.Kind, tags, evt.Content})
+	return bytes.TrimSuffix(buf.Bytes(), []byte{'\n'})
+}
+
+func (evt *NostrEvent) Sign(sk *btcec.PrivateKey) error {
+	evt.PubKey = hex.EncodeToString(schnorr.SerializePubKey(sk.PubKey()))
+	if evt.Tags == nil {
+		evt.Tags = make([][]string, 0)
+	}
+
+	hash := sha256.Sum256(evt.serialize())
+	sig, err := schnorr.Sign(sk, hash[:])
+	if err != nil {
+		return err
+	}
+
+	evt.Id = hex.EncodeToString(hash[:])
+	evt.Sig = hex.EncodeToString(sig.Serialize())
+	return nil
+}
+
+func (evt *NostrEvent) CheckSignature() bool {
+	hash := sha256.Sum256(evt.serialize())
+	if hex.EncodeToString(hash[:]) != evt.Id {
+		return false
+	}
+
+	pkb, err := hex.DecodeString(evt.PubKey)
+	if err != nil {
+		return false
+	}
+	pubkey, err := schnorr.ParsePubKey(pkb)
+	if err != nil {
+		return false
+	}
+	sigb, err := hex.DecodeString(evt.Sig)
+	if err != nil {
+		return false
+	}
+	sig, err := schnorr.ParseSignature(sigb)
+	if err != nil {
+		return false
+	}
+	return sig.Verify(hash[:], pubkey)
+}
+
+// Tag returns the first value of the first tag with the given name.
+func (evt *NostrEvent) Tag(name string) string {
+	for _, tag := range evt.Tags {
+		if len(tag) >= 2 && tag[0] == name {
+			return tag[1]
+		}
+	}
+	return ""
+}
+
+// sharedSecret is the x coordinate of the ECDH point between our key and a
+// nostr (x-only) pubkey.
+func sharedSecret(sk *btcec.PrivateKey, pubkeyhex string) ([]byte, error) {
+	pkb, err := hex.DecodeString(pubkeyhex)
+	if err != nil {
+		return nil, err
+	}
+	pubkey, err := schnorr.ParsePubKey(pkb)
+	if err != nil {
+		return nil, err
+	}
+	return btcec.GenerateSharedSecret(sk, pubkey), nil
+}
+
+// NIP-04: AES-256-CBC with the raw shared secret as key.
+func nip04Encrypt(sk *btcec.PrivateKey, pubkey string, plaintext string) (string, error) {
+	key, err := sharedSecret(sk, pubkey)
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	rand.Read(iv)
+
+	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	padded := append([]byte(plaintext), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	ciphertext := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, padded)
+
+	return base64.StdEncoding.EncodeToString(ciphertext) + "?iv=" +
+		base64.StdEncoding.EncodeToString(iv), nil
+}
+
+func nip04Decrypt(sk *btcec.PrivateKey, pubkey string, content string) (string, error) {
+	spl := strings.Split(content, "?iv=")
+	if len(spl) != 2 {
+		return "", errors.New("invalid nip04 content")
+	}
+	ciphertext, err1 := base64.StdEncoding.DecodeString(spl[0])
+	iv, err2 := base64.StdEncoding.DecodeString(spl[1])
+	if err1 != nil || err2 != nil || len(iv) != aes.BlockSize ||
+		len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return "", errors.New("invalid nip04 content")
+	}
+
+	key, err := sharedSecret(sk, pubkey)
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > aes.BlockSize || padding > len(plaintext) {
+		return "", errors.New("invalid nip04 padding")
+	}
+	return string(plaintext[:len(plaintext)-padding]), nil
+}
+
+// NIP-44 (version 2): ChaCha20 with HMAC-SHA256 and keys derived with HKDF.
+func nip44ConversationKey(sk *btcec.PrivateKey, pubkey string) ([]byte, error) {
+	shared, err := sharedSecret(sk, pubkey)
+	if err != nil {
+		return nil, err
+	}
+	return hkdf.Extract(sha256.New, shared, []byte("nip44-v2")), nil
+}
+
+func nip44MessageKeys(conversationKey []byte, nonce []byte) (key, chachaNonce, hmacKey []byte, err error) {
+	keys := make([]byte, 76)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, conversationKey, nonce), keys); err != nil {
+		return nil, nil, nil, err
+	}
+	return keys[0:32], keys[32:44], keys[44:76], nil
+}
+
+func nip44PaddedLen(l int) int {
+	if l <= 32 {
+		return 32
+	}
+	nextPower := 1
+	for nextPower < l {
+		nextPower <<= 1
+	}
+	chunk := 32
+	if nextPower > 256 {
+		chunk = nextPower / 8
+	}
+	return chunk * ((l-1)/chunk + 1)
+}
+
+func nip44Encrypt(sk *btcec.PrivateKey, pubkey string, plaintext string) (string, error) {
+	if len(plaintext) < 1 || len(plaintext) > 65535 {
+		return "", errors.New("invalid plaintext length")
+	}
+	conversationKey, err := nip44ConversationKey(sk, pubkey)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, 32)
+	rand.Read(nonce)
+	key, chachaNonce, hmacKey, err := nip44MessageKeys(conversationKey, nonce)
+	if err != nil {
+		return "", err
+	}
+
+	padded := make([]byte, 2+nip44PaddedLen(len(plaintext)))
+	binary.BigEndian.PutUint16(padded, uint16(len(plaintext)))
+	copy(padded[2:], plaintext)
+
+	stream, err := chacha20.NewUnauthenticatedCipher(key, chachaNonce)
+	if err != nil {
+		return "", err
+	}
+	ciphertext := make([]byte, len(padded))
+	stream.XORKeyStream(ciphertext, padded)
+
+	mac := hmac.New(sha256.New, hmacKey)
+	mac.Write(nonce)
+	mac.Write(ciphertext)
+
+	payload := append([]byte{2}, nonce...)
+	payload = append(payload, ciphertext...)
+	payload = mac.Sum(payload)
+	return base64.StdEncoding.EncodeToString(payload), nil
+}
+
+func nip44Decrypt(sk *btcec.PrivateKey, pubkey string, content string) (string, error) {
+	payload, err := base64.StdEncoding.DecodeString(content)
+	if err != nil || len(payload) < 99 || payload[0] != 2 {
+		return "", errors.New("invalid nip44 payload")
+	}
+	nonce := payload[1:33]
+	ciphertext := payload[33 : len(payload)-32]
+	givenMac := payload[len(payload)-32:]
+
+	conversationKey, err := nip44ConversationKey(sk, pubkey)
+	if err != nil {
+		return "", err
+	}
+	key, chachaNonce, hmacKey, err := nip44MessageKeys(conversationKey, nonce)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, hmacKey)
+	mac.Write(nonce)
+	mac.Write(ciphertext)
+	if subtle.ConstantTimeCompare(mac.Sum(nil), givenMac) != 1 {
+		return "", errors.New("invalid nip44 mac")
+	}
+
+	stream, err := chacha20.NewUnauthenticatedCipher(key, chachaNonce)
+	if err != nil {
+		return "", err
+	}
+	padded := make([]byte, len(ciphertext))
+	stream.XORKeyStream(padded, ciphertext)
+
+	length := int(binary.BigEndian.Uint16(padded))
+	if length < 1 || 2+length > len(padded) || len(padded) != 2+nip44PaddedLen(length) {
+		return "", errors.New("invalid nip44 padding")
+	}
+	return string(padded[2 : 2+length]), nil
+}
+
+// Relay is a connection to a nostr relay that reconnects by itself and
+// resends its subscriptions when it does.
+type Relay struct {
+	URL string
+
+	mutex         sync.Mutex
+	conn          *websocket.Conn
+	subscriptions map[string]interface{}
+	onEvent       func(*NostrEvent)
+	onConnect     func(*Relay)
+	closed        bool
+}
+
+// connectRelay starts a connection in the background. onConnect is called
+// every time the connection is (re)established.
+func connectRelay(url string, onEvent func(*NostrEvent), onConnect func(*Relay), logf func(string, ...interface{})) *Relay {
+	relay := &Relay{
+		URL:           url,
+		subscriptions: make(map[string]interface{}),
+		onEvent:       onEvent,
+		onConnect:     onConnect,
+	}
+	go relay.run(logf)
+	return relay
+}
+
+func (relay *Relay) run(logf func(string, ...interface{})) {
+	backoff := time.Second
+	for {
+		relay.mutex.Lock()
+		closed := relay.closed
+		relay.mutex.Unlock()
+		if closed {
+			return
+		}
+
+		conn, err := websocket.Dial(relay.URL, "", "http://localhost/")
+		if err != nil {
+			logf("failed to connect to relay %s: %s", relay.URL, err)
+			time.Sleep(backoff)
+			if backoff < time.Minute*5 {
+				backoff *= 2
+			}
+			continue
+		}
+		backoff = time.Second
+
+		relay.mutex.Lock()
+		relay.conn = conn
+		for id, filter := range relay.subscriptions {
+			websocket.JSON.Send(conn, []interface{}{"REQ", id, filter})
+		}
+		relay.mutex.Unlock()
+		if relay.onConnect != nil {
+			go relay.onConnect(relay)
+		}
+
+		for {
+			var msg []json.RawMessage
+			if err := websocket.JSON.Receive(conn, &msg); err != nil {
+				break
+			}
+			if len(msg) < 3 {
+				continue
+			}
+
+			var typ string
+			json.Unmarshal(msg[0], &typ)
+			if typ != "EVENT" {
+				continue
+			}
+
+			var evt NostrEvent
+			if err := json.Unmarshal(msg[2], &evt); err != nil || !evt.CheckSignature() {
+				continue
+			}
+			if relay.onEvent != nil {
+				relay.onEvent(&evt)
+			}
+		}
+
+		relay.mutex.Lock()
+		relay.conn = nil
+		relay.mutex.Unlock()
+		conn.Close()
+		time.Sleep(backoff)
+	}
+}
+
+func (relay *Relay) Subscribe(id string, filter interface{}) {
+	relay.mutex.Lock()
+	defer relay.mutex.Unlock()
+
+	relay.subscriptions[id] = filter
+	if relay.conn != nil {
+		websocket.JSON.Send(relay.conn, []interface{}{"REQ", id, filter})
+	}
+}
+
+func (relay *Relay) Publish(evt *NostrEvent) error {
+	relay.mutex.Lock()
+	defer relay.mutex.Unlock()
+
+	if relay.conn == nil {
+		return errors.New("not connected to " + relay.URL)
+	}
+	return websocket.JSON.Send(relay.conn, []interface{}{"EVENT", evt})
+}
+
+func (relay *Relay) Close() {
+	relay.mutex.Lock()
+	defer relay.mutex.Unlock()
+
+	relay.closed = true
+	if relay.conn != nil {
+		relay.conn.Close()
+	}
+}
+
+// publishOnce connects to a relay (with the given dialer, or the default one
+// if nil) just to publish an event and waits for the relay to acknowledge it.
+func publishOnce(url string, dialer *net.Dialer, evt *NostrEvent) error {
+	config, err := websocket.NewConfig(url, "http://localhost/")
+	if err != nil {
+		return err
+	}
+	config.Dialer = dialer
+	conn, err := websocket.DialConfig(config)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := websocket.JSON.Send(conn, []interface{}{"EVENT", evt}); err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second * 10))
+	for {
+		var msg []json.RawMessage
+		if err := websocket.JSON.Receive(conn, &msg); err != nil {
+			return err
+		}
+		if len(msg) < 3 {
+			continue
+		}
+		var typ, id string
+		var ok bool
+		json.Unmarshal(msg[0], &typ)
+		json.Unmarshal(msg[1], &id)
+		json.Unmarshal(msg[2], &ok)
+		if typ == "OK" && id == evt.Id {
+			if !ok && len(msg) > 3 {
+				var reason string
+				json.Unmarshal(msg[3], &reason)
+				return errors.New(reason)
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+// NIP-04/NIP-44 test vectors and a fake nostr relay that keeps every event it
+// gets and sends them to all subscribers.
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"golang.org/x/net/websocket"
+)
+
+func testKey(t *testing.T, skhex string) (*btcec.PrivateKey, string) {
+	skb, err := hex.DecodeString(skhex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sk, pk := btcec.PrivKeyFromBytes(skb)
+	return sk, hex.EncodeToString(pk.SerializeCompressed()[1:])
+}
+
+func TestNIP04(t *testing.T) {
+	sk1, pk1 := testKey(t, "0000000000000000000000000000000000000000000000000000000000000001")
+	sk2, pk2 := testKey(t, "0000000000000000000000000000000000000000000000000000000000000002")
+
+	// made with openssl, the key being the x coordinate of 2G
+	plaintext, err := nip04Decrypt(sk2, pk1, "XUhNYcFIQysJpaZO0PivlejxRd7CJBtBV/f3wCyIdTg=?iv=AAECAwQFBgcICQoLDA0ODw==")
+	if err != nil || plaintext != "hello from nip04" {
+		t.Errorf("wrong nip04 decryption: %q, %v", plaintext, err)
+	}
+
+	content, err := nip04Encrypt(sk1, pk2, "back and forth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, err := nip04Decrypt(sk2, pk1, content); err != nil || plaintext != "back and forth" {
+		t.Errorf("wrong nip04 round trip: %q, %v", plaintext, err)
+	}
+
+	if _, err := nip04Decrypt(sk2, pk1, "XUhNYcFIQysJpaZO0PivlejxRd7CJBtBV/f3wCyIdTg="); err == nil {
+		t.Error("nip04 content without iv was accepted")
+	}
+}
+
+// vectors from https://github.com/paulmillr/nip44/blob/main/nip44.vectors.json
+func TestNIP44(t *testing.T) {
+	sk, _ := testKey(t, "315e59ff51cb9209768cf7da80791ddcaae56ac9775eb25b6dee1234bc5d2268")
+	key, err := nip44ConversationKey(sk, "c2f9d9948dc8c7c38321e4b85c8558872eafa0641cd269db76848a6073e69133")
+	if err != nil || hex.EncodeToString(key) != "3dfef0ce2a4d80a25e7a328accf73448ef67096f65f79588e358d9a0eb9013f1" {
+		t.Errorf("wrong nip44 conversation key: %x, %v", key, err)
+	}
+
+	sk1, pk1 := testKey(t, "0000000000000000000000000000000000000000000000000000000000000001")
+	sk2, pk2 := testKey(t, "0000000000000000000000000000000000000000000000000000000000000002")
+	key, _ = nip44ConversationKey(sk1, pk2)
+	if hex.EncodeToString(key) != "c41c775356fd92eadc63ff5a0dc1da211b268cbea22316767095b2871ea1412d" {
+		t.Errorf("wrong nip44 conversation key: %x", key)
+	}
+
+	payload := "AgAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAABee0G5VSK0/9YypIObAtDKfYEAjD35uVkHyB0F4DwrcNaCXlCWZKaArsGrY6M9wnuTMxWfp1RTN9Xga8no+kF5Vsb"
+	if plaintext, err := nip44Decrypt(sk2, pk1, payload); err != nil || plaintext != "a" {
+		t.Errorf("wrong nip44 decryption: %q, %v", plaintext, err)
+	}
+
+	// a changed mac
+	raw, _ := base64.StdEncoding.DecodeString(payload)
+	raw[len(raw)-1] ^= 1
+	if _, err := nip44Decrypt(sk2, pk1, base64.StdEncoding.EncodeToString(raw)); err == nil {
+		t.Error("nip44 payload with a wrong mac was accepted")
+	}
+
+	for l, expected := range map[int]int{16: 32, 32: 32, 33: 64, 37: 64, 65: 96, 100: 128, 257: 320, 1000: 1024, 65535: 65536} {
+		if padded := nip44PaddedLen(l); padded != expected {
+			t.Errorf("padded length %d for %d, expected %d", padded, l, expected)
+		}
+	}
+
+	content, err := nip44Encrypt(sk1, pk2, "back and forth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, err := nip44Decrypt(sk2, pk1, content); err != nil || plaintext != "back and forth" {
+		t.Errorf("wrong nip44 round trip: %q, %v", plaintext, err)
+	}
+}
+
+type FakeRelay struct {
+	URL string
+
+	mutex       sync.Mutex
+	events      []*NostrEvent
+	subscribers map[*websocket.Conn]string
+}
+
+// StartRelay runs a relay on a local port until the test ends.
+func StartRelay(t *testing.T) *FakeRelay {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay := &FakeRelay{
+		URL:         "ws://" + listener.Addr().String(),
+		subscribers: make(map[*websocket.Conn]string),
+	}
+	server := &http.Server{Handler: websocket.Handler(relay.serve)}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	return relay
+}
+
+func (relay *FakeRelay) serve(conn *websocket.Conn) {
+	defer func() {
+		relay.mutex.Lock()
+		delete(relay.subscribers, conn)
+		relay.mutex.Unlock()
+	}()
+
+	for {
+		var msg []json.RawMessage
+		if err := websocket.JSON.Receive(conn, &msg); err != nil {
+			return
+		}
+		if len(msg) < 2 {
+			continue
+		}
+		var typ string
+		json.Unmarshal(msg[0], &typ)
+
+		switch typ {
+		case "REQ":
+			var id string
+			json.Unmarshal(msg[1], &id)
+			relay.mutex.Lock()
+			relay.subscribers[conn] = id
+			for _, evt := range relay.events {
+				websocket.JSON.Send(conn, []interface{}{"EVENT", id, evt})
+			}
+			relay.mutex.Unlock()
+		case "EVENT":
+			var evt NostrEvent
+			if err := json.Unmarshal(msg[1], &evt); err != nil || !evt.CheckSignature() {
+				websocket.JSON.Send(conn, []interface{}{"OK", evt.Id, false, "invalid: bad event"})
+				continue
+			}
+			websocket.JSON.Send(conn, []interface{}{"OK", evt.Id, true, ""})
+			relay.Publish(&evt)
+		}
+	}
+}
+
+// Publish stores an event and sends it to every subscriber.
+func (relay *FakeRelay) Publish(evt *NostrEvent) {
+	relay.mutex.Lock()
+	defer relay.mutex.Unlock()
+
+	relay.events = append(relay.events, evt)
+	for conn, id := range relay.subscribers {
+		websocket.JSON.Send(conn, []interface{}{"EVENT", id, evt})
+	}
+}
+
+// WaitFor returns the first event that matches, waiting for it to arrive.
+func (relay *FakeRelay) WaitFor(t *testing.T, match func(*NostrEvent) bool) *NostrEvent {
+	for i := 0; i < 100; i++ {
+		relay.mutex.Lock()
+		for _, evt := range relay.events {
+			if match(evt) {
+				relay.mutex.Unlock()
+				return evt
+			}
+		}
+		relay.mutex.Unlock()
+		time.Sleep(time.Millisecond * 50)
+	}
+	t.Fatal("event never arrived at the relay")
+	return nil
+}
+
+func TestZapRelays(t *testing.T) {
+	relays := zapRelays([][]string{
+		{"p", "aa"},
+		{"relays", "ws://relay.example.com", "wss://a.example.com", "wss://a.example.com", "https://b.example.com",
+			"wss://1.example.com", "wss://2.example.com", "wss://3.example.com", "wss://4.example.com", "wss://5.example.com"},
+	})
+	if len(relays) != MAXZAPRELAYS || relays[0] != "wss://a.example.com" || relays[1] != "wss://1.example.com" {
+		t.Errorf("wrong zap relays: %v", relays)
+	}
+
+	for relay, public := range map[string]bool{
+		"wss://127.0.0.1":          false,
+		"wss://10.1.2.3:7777":      false,
+		"wss://192.168.0.10/":      false,
+		"wss://169.254.169.254":    false,
+		"wss://[::1]":              false,
+		"wss://[fd00::1]":          false,
+		"wss://[::ffff:127.0.0.1]": false,
+		"wss://8.8.8.8":            true,
+		"wss://[2001:4860::8888]":  true,
+	} {
+		if isPublicRelay(relay) != public {
+			t.Errorf("%s public should be %v", relay, public)
+		}
+	}
+}
+
+func TestPublicDialer(t *testing.T) {
+	relay := StartRelay(t)
+	sk, _ := testKey(t, "0000000000000000000000000000000000000000000000000000000000000001")
+	evt := &NostrEvent{Kind: 1, Content: "hello", Tags: [][]string{}, CreatedAt: time.Now().Unix()}
+	if err := evt.Sign(sk); err != nil {
+		t.Fatal(err)
+	}
+
+	// names are checked by the address they resolve to when connecting
+	for _, url := range []string{relay.URL, strings.Replace(relay.URL, "127.0.0.1", "localhost", 1)} {
+		if err := publishOnce(url, publicDialer, evt); err == nil {
+			t.Errorf("published to %s, a private address", url)
+		}
+	}
+	relay.mutex.Lock()
+	if len(relay.events) != 0 {
+		t.Errorf("the relay shouldn't have got anything: %v", relay.events)
+	}
+	relay.mutex.Unlock()
+
+	if err := publishOnce(relay.URL, nil, evt); err != nil {
+		t.Errorf("publishing with the default dialer: %s", err)
+	}
+}
@@ -0,0 +1,766 @@
+// Nostr Wallet Connect service, so wallets and apps can use the node through
+// nostr relays. Connections are created with `sparko-nwc-create` and, like
+// `sparko-keys`, can be restricted to some methods. They can also have a
+// spending budget that is reset every period. Connections and the service key
+// are kept on disk at sparko/nwc.json inside the lightning dir.
+// https://github.com/nostr-protocol/nips/blob/master/47.md
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcutil/bech32"
+	lightning "github.com/fiatjaf/lightningd-gjson-rpc"
+	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	NWCINFOKIND     = 13194
+	NWCREQUESTKIND  = 23194
+	NWCRESPONSEKIND = 23195
+)
+
+var nwcMethods = []string{
+	"pay_invoice",
+	"make_invoice",
+	"get_balance",
+	"get_info",
+	"lookup_invoice",
+	"list_transactions",
+}
+
+type NWCConnection struct {
+	Name         string          `json:"name"`
+	PubKey       string          `json:"pubkey"`
+	Methods      map[string]bool `json:"methods"` // empty means all methods
+	BudgetMsat   int64           `json:"budget_msat,omitempty"`
+	BudgetPeriod string          `json:"budget_period,omitempty"` // "daily", "weekly", "monthly", "yearly" or "never"
+	SpentMsat    int64           `json:"spent_msat"`
+	PeriodStart  int64           `json:"period_start"`
+	CreatedAt    int64           `json:"created_at"`
+	Revoked      bool            `json:"revoked,omitempty"`
+}
+
+type NWCError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (err NWCError) Error() string { return err.Code + ": " + err.Message }
+
+var (
+	nwcRelayURLs []string
+	nwcRelays    []*Relay
+	nwcKey       *btcec.PrivateKey
+
+	nwcMutex       sync.Mutex
+	nwcConnections = make(map[string]*NWCConnection)
+
+	nwcSeenMutex sync.Mutex
+	nwcSeen      = make(map[string]time.Time)
+)
+
+// nwcData is what is stored on disk.
+type nwcData struct {
+	ServiceKey  string                    `json:"service_key"`
+	Connections map[string]*NWCConnection `json:"connections"`
+}
+
+func nwcPubKey() string {
+	return hex.EncodeToString(nwcKey.PubKey().SerializeCompressed()[1:])
+}
+
+func saveNWC(p *plugin.Plugin) error {
+	path := dataPath(p, "nwc.json")
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	j, _ := json.Marshal(nwcData{
+		ServiceKey:  hex.EncodeToString(nwcKey.Serialize()),
+		Connections: nwcConnections,
+	})
+	return writeFileAtomic(path, j)
+}
+
+// loadNWC reads the service key and connections, creating a new key on the
+// first run.
+func loadNWC(p *plugin.Plugin) error {
+	nwcMutex.Lock()
+	defer nwcMutex.Unlock()
+
+	b, err := ioutil.ReadFile(dataPath(p, "nwc.json"))
+	if os.IsNotExist(err) {
+		nwcKey, err = btcec.NewPrivateKey()
+		if err != nil {
+			return err
+		}
+		return saveNWC(p)
+	} else if err != nil {
+		return err
+	}
+
+	var data nwcData
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+	skb, err := hex.DecodeString(data.ServiceKey)
+	if err != nil || len(skb) != 32 {
+		return errors.New("invalid service key")
+	}
+	nwcKey, _ = btcec.PrivKeyFromBytes(skb)
+	if data.Connections != nil {
+		nwcConnections = data.Connections
+	}
+	return nil
+}
+
+// startNWC connects to the relays and starts answering requests.
+func startNWC(p *plugin.Plugin) {
+	filter := map[string]interface{}{
+		"kinds": []int{NWCREQUESTKIND},
+		"#p":    []string{nwcPubKey()},
+		"since": time.Now().Add(-time.Minute).Unix(),
+	}
+
+	for _, url := range nwcRelayURLs {
+		relay := connectRelay(url,
+			func(evt *NostrEvent) { go handleNWCRequest(p, evt) },
+			func(relay *Relay) { publishNWCInfo(p, relay) },
+			p.Logf,
+		)
+		relay.Subscribe("nwc", filter)
+		nwcRelays = append(nwcRelays, relay)
+	}
+
+	p.Logf("Nostr Wallet Connect service %s listening on %s", nwcPubKey(), strings.Join(nwcRelayURLs, ", "))
+}
+
+// publishNWCInfo announces which methods and encryption schemes we support.
+func publishNWCInfo(p *plugin.Plugin, relay *Relay) {
+	evt := NostrEvent{
+		CreatedAt: time.Now().Unix(),
+		Kind:      NWCINFOKIND,
+		Tags:      [][]string{{"encryption", "nip44_v2 nip04"}},
+		Content:   strings.Join(nwcMethods, " "),
+	}
+	if err := evt.Sign(nwcKey); err != nil {
+		return
+	}
+	if err := relay.Publish(&evt); err != nil {
+		p.Logf("failed to publish NWC info to %s: %s", relay.URL, err)
+	}
+}
+
+// alreadySeen tells if we have handled this event before, as we get the same
+// requests from all relays. it also forgets old events.
+func alreadySeen(id string) bool {
+	nwcSeenMutex.Lock()
+	defer nwcSeenMutex.Unlock()
+
+	if _, ok := nwcSeen[id]; ok {
+		return true
+	}
+	for seen, at := range nwcSeen {
+		if time.Since(at) > time.Hour {
+			delete(nwcSeen, seen)
+		}
+	}
+	nwcSeen[id] = time.Now()
+	return false
+}
+
+func handleNWCRequest(p *plugin.Plugin, evt *NostrEvent) {
+	if evt.Kind != NWCREQUESTKIND || evt.Tag("p") != nwcPubKey() || alreadySeen(evt.Id) {
+		return
+	}
+	if expiration := gjson.Parse(evt.Tag("expiration")).Int(); expiration != 0 &&
+		expiration < time.Now().Unix() {
+		return
+	}
+
+	nwcMutex.Lock()
+	conn, ok := nwcConnections[evt.PubKey]
+	revoked := ok && conn.Revoked
+	nwcMutex.Unlock()
+	if !ok || revoked {
+		// can't even encrypt a response for unknown clients in a meaningful way
+		return
+	}
+
+	nip44 := !strings.Contains(evt.Content, "?iv=")
+	var plaintext string
+	var err error
+	if nip44 {
+		plaintext, err = nip44Decrypt(nwcKey, evt.PubKey, evt.Content)
+	} else {
+		plaintext, err = nip04Decrypt(nwcKey, evt.PubKey, evt.Content)
+	}
+	if err != nil {
+		p.Logf("failed to decrypt NWC request %s: %s", evt.Id, err)
+		return
+	}
+
+	request := gjson.Parse(plaintext)
+	method := request.Get("method").String()
+	result, err := callNWCMethod(p, conn, method, request.Get("params"))
+
+	response := map[string]interface{}{"result_type": method}
+	if err != nil {
+		var nwcerr NWCError
+		if !errors.As(err, &nwcerr) {
+			nwcerr = NWCError{"INTERNAL", err.Error()}
+		}
+		response["error"] = nwcerr
+		response["result"] = nil
+	} else {
+		response["result"] = result
+		response["error"] = nil
+	}
+
+	j, _ := json.Marshal(response)
+	var content string
+	if nip44 {
+		content, err = nip44Encrypt(nwcKey, evt.PubKey, string(j))
+	} else {
+		content, err = nip04Encrypt(nwcKey, evt.PubKey, string(j))
+	}
+	if err != nil {
+		p.Logf("failed to encrypt NWC response to %s: %s", evt.Id, err)
+		return
+	}
+
+	reply := NostrEvent{
+		CreatedAt: time.Now().Unix(),
+		Kind:      NWCRESPONSEKIND,
+		Tags:      [][]string{{"p", evt.PubKey}, {"e", evt.Id}},
+		Content:   content,
+	}
+	if nip44 {
+		reply.Tags = append(reply.Tags, []string{"encryption", "nip44_v2"})
+	}
+	if err := reply.Sign(nwcKey); err != nil {
+		p.Logf("failed to sign NWC response to %s: %s", evt.Id, err)
+		return
+	}
+
+	published := false
+	for _, relay := range nwcRelays {
+		if err := relay.Publish(&reply); err == nil {
+			published = true
+		}
+	}
+	if !published {
+		p.Logf("couldn't publish NWC response to %s on any relay", evt.Id)
+	}
+}
+
+func callNWCMethod(p *plugin.Plugin, conn *NWCConnection, method string, params gjson.Result) (interface{}, error) {
+	known := false
+	for _, m := range nwcMethods {
+		if m == method {
+			known = true
+		}
+	}
+	if !known {
+		return nil, NWCError{"NOT_IMPLEMENTED", "unknown method '" + method + "'"}
+	}
+	if !nwcAllowed(conn, method) {
+		return nil, NWCError{"RESTRICTED", "this connection can't call '" + method + "'"}
+	}
+
+	switch method {
+	case "pay_invoice":
+		return nwcPayInvoice(p, conn, params)
+	case "make_invoice":
+		return nwcMakeInvoice(p, params)
+	case "get_balance":
+		return nwcGetBalance(p)
+	case "get_info":
+		return nwcGetInfo(p, conn)
+	case "lookup_invoice":
+		return nwcLookupInvoice(p, params)
+	case "list_transactions":
+		return nwcListTransactions(p, params)
+	}
+	return nil, nil
+}
+
+// nwcAllowed tells if a connection can call the given method and is still
+// active.
+func nwcAllowed(conn *NWCConnection, method string) bool {
+	nwcMutex.Lock()
+	defer nwcMutex.Unlock()
+
+	return !conn.Revoked && (len(conn.Methods) == 0 || conn.Methods[method])
+}
+
+func nwcPayInvoice(p *plugin.Plugin, conn *NWCConnection, params gjson.Result) (interface{}, error) {
+	bolt11 := params.Get("invoice").String()
+	inv, err := callBackend("decodepay", []interface{}{bolt11})
+	if err != nil {
+		return nil, NWCError{"OTHER", "invalid invoice"}
+	}
+
+	payparams := map[string]interface{}{"bolt11": bolt11}
+	amount, _ := parseMsat(inv.Get("amount_msat").String(), true)
+	if amount == 0 {
+		amount = params.Get("amount").Int()
+		if amount <= 0 {
+			return nil, NWCError{"OTHER", "invoice has no amount"}
+		}
+		payparams["amount_msat"] = amount
+	}
+
+	// reserve the amount from the budget before paying
+	if err := spendBudget(p, conn, amount); err != nil {
+		return nil, err
+	}
+
+	res, err := callNodeWithTimeout(backend, ASYNCTIMEOUT, "pay", payparams)
+	preimage := res.Get("payment_preimage").String()
+	if err != nil {
+		status := "failed"
+		if _, ok := err.(lightning.ErrorCommand); !ok {
+			// we don't know if the payment went through (a timeout, maybe),
+			// so we ask listpays, and if it can't tell the amount stays spent
+			var pay gjson.Result
+			var lperr error
+			status, pay, lperr = payOutcome(bolt11)
+			if lperr != nil || status == "pending" || status == "" {
+				return nil, NWCError{"INTERNAL", err.Error()}
+			}
+			res, preimage = pay, pay.Get("preimage").String()
+		}
+		if status != "complete" {
+			spendBudget(p, conn, -amount)
+			return nil, NWCError{"PAYMENT_FAILED", err.Error()}
+		}
+	}
+
+	sent, _ := parseMsat(res.Get("amount_sent_msat").String(), true)
+	delivered, _ := parseMsat(res.Get("amount_msat").String(), true)
+	if fees := sent - delivered; fees > 0 {
+		spendBudget(p, conn, fees)
+	}
+
+	return map[string]interface{}{
+		"preimage":  preimage,
+		"fees_paid": sent - delivered,
+	}, nil
+}
+
+// spendBudget adds to the amount spent in the current period, failing if it
+// goes over the connection budget. negative amounts give the budget back.
+func spendBudget(p *plugin.Plugin, conn *NWCConnection, amount int64) error {
+	nwcMutex.Lock()
+	defer nwcMutex.Unlock()
+
+	if start := budgetPeriodStart(conn.BudgetPeriod, time.Now()); start > conn.PeriodStart {
+		conn.PeriodStart = start
+		conn.SpentMsat = 0
+	}
+
+	if amount > 0 && conn.BudgetMsat > 0 && conn.SpentMsat+amount > conn.BudgetMsat {
+		return NWCError{"QUOTA_EXCEEDED", fmt.Sprintf("only %d msat left in the budget", conn.BudgetMsat-conn.SpentMsat)}
+	}
+	conn.SpentMsat += amount
+	if conn.SpentMsat < 0 {
+		conn.SpentMsat = 0
+	}
+
+	if err := saveNWC(p); err != nil {
+		p.Log("failed to save NWC connections: " + err.Error())
+	}
+	return nil
+}
+
+func budgetPeriodStart(period string, now time.Time) int64 {
+	year, month, day := now.Date()
+	switch period {
+	case "daily":
+		return time.Date(year, month, day, 0, 0, 0, 0, now.Location()).Unix()
+	case "weekly":
+		return time.Date(year, month, day-int(now.Weekday()), 0, 0, 0, 0, now.Location()).Unix()
+	case "monthly":
+		return time.Date(year, month, 1, 0, 0, 0, 0, now.Location()).Unix()
+	case "yearly":
+		return time.Date(year, 1, 1, 0, 0, 0, 0, now.Location()).Unix()
+	}
+	return 0
+}
+
+func nwcMakeInvoice(p *plugin.Plugin, params gjson.Result) (interface{}, error) {
+	amount := params.Get("amount").Int()
+	if amount <= 0 {
+		return nil, NWCError{"OTHER", "invalid amount"}
+	}
+
+	random := make([]byte, 8)
+	rand.Read(random)
+	label := "sparko-nwc/" + hex.EncodeToString(random)
+	description := params.Get("description").String()
+	var bolt11 string
+	var err error
+	if params.Get("description_hash").Exists() {
+		var hash []byte
+		hash, err = hex.DecodeString(params.Get("description_hash").String())
+		if err != nil || len(hash) != 32 {
+			return nil, NWCError{"OTHER", "invalid description_hash"}
+		}
+		bolt11, err = invoiceWithHash(p, label, amount, hash, params.Get("expiry").Int())
+	} else {
+		invparams := map[string]interface{}{
+			"amount_msat": amount,
+			"label":       label,
+			"description": description,
+		}
+		if expiry := params.Get("expiry").Int(); expiry > 0 {
+			invparams["expiry"] = expiry
+		}
+		var inv gjson.Result
+		inv, err = callBackend("invoice", invparams)
+		bolt11 = inv.Get("bolt11").String()
+	}
+	if err != nil {
+		return nil, NWCError{"INTERNAL", err.Error()}
+	}
+
+	invs, err := callBackend("listinvoices", map[string]interface{}{"label": label})
+	if err != nil {
+		return nil, NWCError{"INTERNAL", err.Error()}
+	}
+	tx := nwcIncomingTransaction(invs.Get("invoices.0"))
+	tx["invoice"] = bolt11
+	if params.Get("description_hash").Exists() {
+		// not the placeholder lightningd has
+		tx["description"] = description
+		tx["description_hash"] = params.Get("description_hash").String()
+	}
+	return tx, nil
+}
+
+func nwcGetBalance(p *plugin.Plugin) (interface{}, error) {
+	funds, err := callBackend("listfunds", nil)
+	if err != nil {
+		return nil, NWCError{"INTERNAL", err.Error()}
+	}
+
+	var balance int64
+	for _, channel := range funds.Get("channels").Array() {
+		if channel.Get("state").String() != "CHANNELD_NORMAL" {
+			continue
+		}
+		ours := channel.Get("our_amount_msat")
+		if !ours.Exists() {
+			ours = channel.Get("channel_sat")
+			sat, _ := parseMsat(ours.String(), false)
+			balance += sat
+			continue
+		}
+		msat, _ := parseMsat(ours.String(), true)
+		balance += msat
+	}
+
+	return map[string]interface{}{"balance": balance}, nil
+}
+
+func nwcGetInfo(p *plugin.Plugin, conn *NWCConnection) (interface{}, error) {
+	info, err := callBackend("getinfo", nil)
+	if err != nil {
+		return nil, NWCError{"INTERNAL", err.Error()}
+	}
+
+	methods := make([]string, 0, len(nwcMethods))
+	for _, method := range nwcMethods {
+		if nwcAllowed(conn, method) {
+			methods = append(methods, method)
+		}
+	}
+
+	return map[string]interface{}{
+		"alias":        info.Get("alias").String(),
+		"color":        info.Get("color").String(),
+		"pubkey":       info.Get("id").String(),
+		"network":      info.Get("network").String(),
+		"block_height": info.Get("blockheight").Int(),
+		"methods":      methods,
+	}, nil
+}
+
+func nwcLookupInvoice(p *plugin.Plugin, params gjson.Result) (interface{}, error) {
+	hash := params.Get("payment_hash").String()
+	if hash == "" {
+		bolt11 := params.Get("invoice").String()
+		inv, err := callBackend("decodepay", []interface{}{bolt11})
+		if err != nil {
+			return nil, NWCError{"OTHER", "invalid invoice"}
+		}
+		hash = inv.Get("payment_hash").String()
+	}
+	if hash == "" {
+		return nil, NWCError{"OTHER", "payment_hash or invoice required"}
+	}
+
+	invs, err := callBackend("listinvoices", map[string]interface{}{"payment_hash": hash})
+	if err != nil {
+		return nil, NWCError{"INTERNAL", err.Error()}
+	}
+	if inv := invs.Get("invoices.0"); inv.Exists() {
+		return nwcIncomingTransaction(inv), nil
+	}
+
+	pays, err := callBackend("listpays", map[string]interface{}{"payment_hash": hash})
+	if err != nil {
+		return nil, NWCError{"INTERNAL", err.Error()}
+	}
+	if pay := pays.Get("pays.0"); pay.Exists() {
+		return nwcOutgoingTransaction(pay), nil
+	}
+
+	return nil, NWCError{"NOT_FOUND", "invoice not found"}
+}
+
+func nwcListTransactions(p *plugin.Plugin, params gjson.Result) (interface{}, error) {
+	from := params.Get("from").Int()
+	until := params.Get("until").Int()
+	unpaid := params.Get("unpaid").Bool()
+	typ := params.Get("type").String()
+
+	txs := make([]map[string]interface{}, 0)
+	inRange := func(tx map[string]interface{}) bool {
+		at := tx["created_at"].(int64)
+		return (from == 0 || at >= from) && (until == 0 || at <= until)
+	}
+
+	if typ == "" || typ == "incoming" {
+		invs, err := callBackend("listinvoices", nil)
+		if err != nil {
+			return nil, NWCError{"INTERNAL", err.Error()}
+		}
+		for _, inv := range invs.Get("invoices").Array() {
+			if !unpaid && inv.Get("status").String() != "paid" {
+				continue
+			}
+			if tx := nwcIncomingTransaction(inv); inRange(tx) {
+				txs = append(txs, tx)
+			}
+		}
+	}
+	if typ == "" || typ == "outgoing" {
+		pays, err := callBackend("listpays", nil)
+		if err != nil {
+			return nil, NWCError{"INTERNAL", err.Error()}
+		}
+		for _, pay := range pays.Get("pays").Array() {
+			if !unpaid && pay.Get("status").String() != "complete" {
+				continue
+			}
+			if tx := nwcOutgoingTransaction(pay); inRange(tx) {
+				txs = append(txs, tx)
+			}
+		}
+	}
+
+	sort.Slice(txs, func(i, j int) bool {
+		return txs[i]["created_at"].(int64) > txs[j]["created_at"].(int64)
+	})
+
+	offset := int(params.Get("offset").Int())
+	if offset > len(txs) {
+		offset = len(txs)
+	}
+	txs = txs[offset:]
+	if limit := int(params.Get("limit").Int()); limit > 0 && limit < len(txs) {
+		txs = txs[:limit]
+	}
+
+	return map[string]interface{}{"transactions": txs}, nil
+}
+
+func nwcIncomingTransaction(inv gjson.Result) map[string]interface{} {
+	amount, _ := parseMsat(inv.Get("amount_msat").String(), true)
+	if received := inv.Get("amount_received_msat"); received.Exists() {
+		amount, _ = parseMsat(received.String(), true)
+	}
+	// lightningd doesn't tell when invoices were created, but the bolt11 does.
+	createdAt := bolt11Timestamp(inv.Get("bolt11").String())
+	if createdAt == 0 {
+		createdAt = inv.Get("paid_at").Int()
+	}
+
+	tx := map[string]interface{}{
+		"type":         "incoming",
+		"invoice":      inv.Get("bolt11").String(),
+		"description":  inv.Get("description").String(),
+		"payment_hash": inv.Get("payment_hash").String(),
+		"amount":       amount,
+		"fees_paid":    0,
+		"created_at":   createdAt,
+		"expires_at":   inv.Get("expires_at").Int(),
+	}
+	if inv.Get("status").String() == "paid" {
+		tx["preimage"] = inv.Get("payment_preimage").String()
+		tx["settled_at"] = inv.Get("paid_at").Int()
+	}
+	return tx
+}
+
+// bolt11Timestamp reads the creation time of a bolt11 invoice, or 0 if it can't.
+func bolt11Timestamp(bolt11 string) int64 {
+	_, data, err := bech32.DecodeNoLimit(strings.ToLower(bolt11))
+	if err != nil || len(data) < 7 {
+		return 0
+	}
+	var timestamp int64
+	for _, b := range data[:7] {
+		timestamp = timestamp<<5 | int64(b)
+	}
+	return timestamp
+}
+
+func nwcOutgoingTransaction(pay gjson.Result) map[string]interface{} {
+	amount, _ := parseMsat(pay.Get("amount_msat").String(), true)
+	sent, _ := parseMsat(pay.Get("amount_sent_msat").String(), true)
+	fees := int64(0)
+	if sent > amount && amount > 0 {
+		fees = sent - amount
+	}
+
+	tx := map[string]interface{}{
+		"type":         "outgoing",
+		"invoice":      pay.Get("bolt11").String(),
+		"description":  pay.Get("description").String(),
+		"payment_hash": pay.Get("payment_hash").String(),
+		"amount":       amount,
+		"fees_paid":    fees,
+		"created_at":   pay.Get("created_at").Int(),
+	}
+	if pay.Get("status").String() == "complete" {
+		tx["preimage"] = pay.Get("preimage").String()
+		tx["settled_at"] = pay.Get("completed_at").Int()
+	}
+	return tx
+}
+
+var sparkoNWCCreate = plugin.RPCMethod{
+	"sparko-nwc-create",
+	"[name] [methods] [budget_msat] [budget_period]",
+	"Create a Nostr Wallet Connect connection, optionally restricted to a comma-separated list of methods and to spending budget_msat every budget_period (daily, weekly, monthly, yearly or never).",
+	"",
+	func(p *plugin.Plugin, params plugin.Params) (resp interface{}, errCode int, err error) {
+		if nwcKey == nil || len(nwcRelayURLs) == 0 {
+			return nil, 400, errors.New("sparko-nwc-relays must be set to create connections")
+		}
+
+		period := params.Get("budget_period").String()
+		if period == "" {
+			period = "never"
+		}
+		switch period {
+		case "daily", "weekly", "monthly", "yearly", "never":
+		default:
+			return nil, 400, errors.New("invalid budget_period '" + period + "'")
+		}
+
+		methods := make(map[string]bool)
+		for _, method := range strings.Split(params.Get("methods").String(), ",") {
+			if method = strings.TrimSpace(method); method != "" {
+				methods[method] = true
+			}
+		}
+
+		secret, err := btcec.NewPrivateKey()
+		if err != nil {
+			return nil, 500, err
+		}
+		pubkey := hex.EncodeToString(secret.PubKey().SerializeCompressed()[1:])
+		now := time.Now()
+		conn := &NWCConnection{
+			Name:         params.Get("name").String(),
+			PubKey:       pubkey,
+			Methods:      methods,
+			BudgetMsat:   params.Get("budget_msat").Int(),
+			BudgetPeriod: period,
+			PeriodStart:  budgetPeriodStart(period, now),
+			CreatedAt:    now.Unix(),
+		}
+
+		nwcMutex.Lock()
+		defer nwcMutex.Unlock()
+		nwcConnections[pubkey] = conn
+		if err := saveNWC(p); err != nil {
+			delete(nwcConnections, pubkey)
+			return nil, 500, err
+		}
+
+		qs := url.Values{"secret": {hex.EncodeToString(secret.Serialize())}}
+		for _, relay := range nwcRelayURLs {
+			qs.Add("relay", relay)
+		}
+		return map[string]interface{}{
+			"connection": conn,
+			"uri":        "nostr+walletconnect://" + nwcPubKey() + "?" + qs.Encode(),
+		}, 0, nil
+	},
+}
+
+var sparkoNWCList = plugin.RPCMethod{
+	"sparko-nwc-list",
+	"",
+	"List Nostr Wallet Connect connections.",
+	"",
+	func(p *plugin.Plugin, params plugin.Params) (resp interface{}, errCode int, err error) {
+		nwcMutex.Lock()
+		defer nwcMutex.Unlock()
+
+		list := make([]*NWCConnection, 0, len(nwcConnections))
+		for _, conn := range nwcConnections {
+			list = append(list, conn)
+		}
+		service := ""
+		if nwcKey != nil {
+			service = nwcPubKey()
+		}
+		return map[string]interface{}{
+			"service_pubkey": service,
+			"relays":         nwcRelayURLs,
+			"connections":    list,
+		}, 0, nil
+	},
+}
+
+var sparkoNWCRevoke = plugin.RPCMethod{
+	"sparko-nwc-revoke",
+	"pubkey",
+	"Revoke a Nostr Wallet Connect connection.",
+	"",
+	func(p *plugin.Plugin, params plugin.Params) (resp interface{}, errCode int, err error) {
+		nwcMutex.Lock()
+		defer nwcMutex.Unlock()
+
+		conn, ok := nwcConnections[params.Get("pubkey").String()]
+		if !ok {
+			return nil, 404, errors.New("unknown connection")
+		}
+		conn.Revoked = true
+		if err := saveNWC(p); err != nil {
+			return nil, 500, err
+		}
+		return conn, 0, nil
+	},
+}
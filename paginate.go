@@ -0,0 +1,234 @@
+// Cursor-based pagination for the methods that return huge lists.
+// The full list is fetched from lightningd when the first page is requested and
+// kept for a while so the following pages don't have to fetch it again.
+// Cursors point to the last entry returned, not to an offset, so pages don't
+// shift when new entries are added.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	lightning "github.com/fiatjaf/lightningd-gjson-rpc"
+	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
+	"github.com/tidwall/gjson"
+)
+
+const PAGECACHETTL = time.Minute * 2
+
+type paginatedMethod struct {
+	key       string   // the key of the array in the response
+	sortField string   // entries are sorted by this, newest first
+	uniqueIds []string // used to break ties between entries with the same sortField
+}
+
+var paginatedMethods = map[string]paginatedMethod{
+	"listinvoices":     {"invoices", "created_index", []string{"label"}},
+	"listsendpays":     {"payments", "id", []string{"id"}},
+	"listpays":         {"pays", "created_at", []string{"payment_hash"}},
+	"listforwards":     {"forwards", "received_time", []string{"in_channel", "in_htlc_id"}},
+	"listtransactions": {"transactions", "blockheight", []string{"hash"}},
+}
+
+type pageEntry struct {
+	sort   float64
+	unique string
+	raw    json.RawMessage
+}
+
+type cachedList struct {
+	entries []pageEntry
+	fetched time.Time
+}
+
+var (
+	pageCacheMutex sync.Mutex
+	pageCache      = make(map[string]cachedList)
+)
+
+// handlePaginated serves a single page of a paginated method. It's used by
+// handleRPC when the X-Page-Size header is present.
+func handlePaginated(
+	w http.ResponseWriter,
+	r *http.Request,
+	p *plugin.Plugin,
+	b Backend,
+	node string,
+	req lightning.JSONRPCMessage,
+	method paginatedMethod,
+) {
+	size, err := strconv.Atoi(r.Header.Get("X-Page-Size"))
+	if err != nil || size <= 0 {
+		p.Log("invalid X-Page-Size: " + r.Header.Get("X-Page-Size"))
+		w.WriteHeader(400)
+		return
+	}
+
+	cursorHeader := r.Header.Get("X-Cursor")
+	var cursor *pageEntry
+	if cursorHeader != "" {
+		cursor, err = decodeCursor(cursorHeader)
+		if err != nil {
+			p.Log("invalid X-Cursor: " + cursorHeader)
+			w.WriteHeader(400)
+			return
+		}
+	}
+
+	// always fetch again when starting from the first page
+	entries, err := getCachedList(p, b, node, req, method, cursor == nil)
+	if err != nil {
+		p.Logf("'%s' call returned an error", req.Method)
+		w.WriteHeader(500)
+		if cmderr, ok := err.(lightning.ErrorCommand); ok {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(LightningError{
+				Type:     "lightning",
+				Name:     "LightningError",
+				Message:  cmderr.Message,
+				Code:     cmderr.Code,
+				FullType: "lightning",
+				Request:  &req,
+			})
+		}
+		return
+	}
+
+	// find where this page starts
+	start := 0
+	if cursor != nil {
+		start = sort.Search(len(entries), func(i int) bool {
+			return isAfter(entries[i], *cursor)
+		})
+	}
+	end := start + size
+	if end > len(entries) {
+		end = len(entries)
+	}
+
+	page := make([]json.RawMessage, end-start)
+	for i, entry := range entries[start:end] {
+		page[i] = entry.raw
+	}
+
+	response := map[string]interface{}{method.key: page}
+	if end < len(entries) {
+		next := encodeCursor(entries[end-1])
+		response["next"] = next
+		w.Header().Set("X-Next-Cursor", next)
+	}
+
+	respbytes, _ := json.Marshal(response)
+	respbytes, err = applyFilters(r, respbytes)
+	if err != nil {
+		p.Logf("failed to filter '%s' response: %s", req.Method, err)
+		w.WriteHeader(400)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(respbytes)
+}
+
+func getCachedList(
+	p *plugin.Plugin,
+	b Backend,
+	node string,
+	req lightning.JSONRPCMessage,
+	method paginatedMethod,
+	refresh bool,
+) ([]pageEntry, error) {
+	jparams, _ := json.Marshal(req.Params)
+	cachekey := nodePrefix(node) + req.Method + ":" + string(jparams)
+
+	pageCacheMutex.Lock()
+	cached, ok := pageCache[cachekey]
+	for key, list := range pageCache {
+		if time.Since(list.fetched) > PAGECACHETTL {
+			delete(pageCache, key)
+		}
+	}
+	pageCacheMutex.Unlock()
+
+	if ok && !refresh && time.Since(cached.fetched) < PAGECACHETTL {
+		return cached.entries, nil
+	}
+
+	respbytes, err := b.Call(callTimeout(req.Method), req)
+	if err != nil {
+		return nil, err
+	}
+
+	items := gjson.GetBytes(respbytes, method.key).Array()
+	usePosition := len(items) > 0 && !items[0].Get(method.sortField).Exists()
+
+	entries := make([]pageEntry, len(items))
+	for i, item := range items {
+		// lightningd returns things in the order they were created, so when the
+		// sort field isn't available we use the position in the list
+		sortvalue := float64(i)
+		if !usePosition {
+			sortvalue = item.Get(method.sortField).Float()
+		}
+
+		uniques := make([]string, len(method.uniqueIds))
+		for j, field := range method.uniqueIds {
+			uniques[j] = item.Get(field).String()
+		}
+
+		entries[i] = pageEntry{
+			sort:   sortvalue,
+			unique: strings.Join(uniques, "/"),
+			raw:    json.RawMessage(item.Raw),
+		}
+	}
+
+	// newest first
+	sort.SliceStable(entries, func(i, j int) bool {
+		return isAfter(entries[j], entries[i])
+	})
+
+	pageCacheMutex.Lock()
+	pageCache[cachekey] = cachedList{entries, time.Now()}
+	pageCacheMutex.Unlock()
+
+	return entries, nil
+}
+
+// isAfter tells if entry comes after the cursor when sorting newest first.
+func isAfter(entry pageEntry, cursor pageEntry) bool {
+	if entry.sort != cursor.sort {
+		return entry.sort < cursor.sort
+	}
+	return entry.unique < cursor.unique
+}
+
+func encodeCursor(entry pageEntry) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(
+		strconv.FormatFloat(entry.sort, 'f', -1, 64) + ":" + entry.unique,
+	))
+}
+
+func decodeCursor(token string) (*pageEntry, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, err
+	}
+	spl := strings.SplitN(string(b), ":", 2)
+	if len(spl) != 2 {
+		return nil, fmt.Errorf("malformed cursor")
+	}
+	sortvalue, err := strconv.ParseFloat(spl[0], 64)
+	if err != nil {
+		return nil, err
+	}
+	return &pageEntry{sort: sortvalue, unique: spl[1]}, nil
+}
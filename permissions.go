@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"net/http"
 	"strings"
 )
 
@@ -59,3 +60,43 @@ func (keys Keys) Summary() (string, int) {
 
 	return strings.Join(out, ", "), i
 }
+
+// isAllowed checks if the key used on this request (if any) can call the given
+// method. requests authenticated with the default login have all permissions.
+// on other nodes permissions must be given as "node/method" or "node/*".
+func isAllowed(r *http.Request, method string) bool {
+	if permissions, ok := r.Context().Value("permissions").(map[string]bool); ok {
+		if len(permissions) > 0 {
+			if node := requestNode(r); node != "" {
+				return permissions[node+"/"+method] || permissions[node+"/*"]
+			}
+			if _, allowed := permissions[method]; !allowed {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// canReadNode tells if a key with these permissions gets the events of a node
+// (the local one being "") on /stream: the local events need `stream` and
+// those of other nodes `{node}/stream` or `{node}/*`. full access sees all.
+func canReadNode(permissions map[string]bool, node string) bool {
+	if len(permissions) == 0 {
+		return true
+	}
+	if node == "" {
+		return permissions["stream"]
+	}
+	return permissions[node+"/stream"] || permissions[node+"/*"]
+}
+
+// isExplicitlyAllowed is like isAllowed, but full-access keys don't count,
+// only the default login and keys that were given the method by name.
+func isExplicitlyAllowed(r *http.Request, method string) bool {
+	permissions, ok := r.Context().Value("permissions").(map[string]bool)
+	if !ok {
+		return true
+	}
+	return permissions[method]
+}
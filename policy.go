@@ -0,0 +1,304 @@
+// Rules for the channels opened through sparko, set with the
+// `sparko-open-*` options. They're checked by `connectfund` and the other
+// methods that open channels, and by handleRPC on raw `fundchannel`,
+// `fundchannel_start` and `multifundchannel` calls. Each rule fails with its
+// own error code.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	lightning "github.com/fiatjaf/lightningd-gjson-rpc"
+)
+
+const (
+	POLICYPEERNOTALLOWED = 1001
+	POLICYPEERBLOCKED    = 1002
+	POLICYBELOWMIN       = 1003
+	POLICYABOVEMAX       = 1004
+	POLICYPEERCAPACITY   = 1005
+	POLICYFEERATE        = 1006
+	POLICYRESERVE        = 1007
+)
+
+type OpenPolicy struct {
+	MinSatoshi        int64
+	MaxSatoshi        int64
+	MaxPerPeerSatoshi int64
+	MaxFeerate        int64 // perkw
+	ReserveSatoshi    int64
+	AllowedPeers      map[string]bool // if empty all peers are allowed
+	BlockedPeers      map[string]bool
+}
+
+var openPolicy OpenPolicy
+
+type PolicyError struct {
+	Code    int
+	Message string
+}
+
+func (err PolicyError) Error() string { return err.Message }
+
+// ChannelOpen is a channel about to be opened. Satoshi is -1 for "all".
+type ChannelOpen struct {
+	PeerId  string
+	Satoshi int64
+}
+
+// readPeerList parses a comma-separated list of node ids.
+func readPeerList(configstr string) map[string]bool {
+	peers := make(map[string]bool)
+	for _, peer := range strings.Split(configstr, ",") {
+		if peer = strings.TrimSpace(peer); peer != "" {
+			peers[peer] = true
+		}
+	}
+	return peers
+}
+
+// parseOpenAmount reads a funding amount in satoshis (the default unit for
+// these methods) or in any other unit lightningd accepts.
+func parseOpenAmount(amount interface{}) (int64, error) {
+	s := strings.TrimSpace(fmt.Sprint(amount))
+	if s == "all" {
+		return -1, nil
+	}
+	msat, err := parseMsat(s, false)
+	if err != nil {
+		return 0, err
+	}
+	return msat / 1000, nil
+}
+
+// openPolicyRequest reads the channels a raw call to lightningd would open,
+// if it's one of the methods that open channels.
+func openPolicyRequest(req lightning.JSONRPCMessage) (opens []ChannelOpen, feerate string, ok bool, err error) {
+	params := namedParams(req)
+	feerate, _ = params["feerate"].(string)
+	if f, isNumber := params["feerate"].(float64); isNumber {
+		feerate = strconv.FormatFloat(f, 'f', -1, 64)
+	}
+
+	switch req.Method {
+	case "fundchannel", "fundchannel_start":
+		amount, ok := params["amount"]
+		if !ok {
+			amount = params["satoshi"]
+		}
+		satoshi, err := parseOpenAmount(amount)
+		if err != nil {
+			return nil, "", true, err
+		}
+		id := strings.Split(fmt.Sprint(params["id"]), "@")[0]
+		return []ChannelOpen{{id, satoshi}}, feerate, true, nil
+	case "multifundchannel":
+		destinations, _ := params["destinations"].([]interface{})
+		for _, d := range destinations {
+			destination, _ := d.(map[string]interface{})
+			satoshi, err := parseOpenAmount(destination["amount"])
+			if err != nil {
+				return nil, "", true, err
+			}
+			id := strings.Split(fmt.Sprint(destination["id"]), "@")[0]
+			opens = append(opens, ChannelOpen{id, satoshi})
+		}
+		return opens, feerate, true, nil
+	}
+	return nil, "", false, nil
+}
+
+func (policy OpenPolicy) isEmpty() bool {
+	return policy.MinSatoshi == 0 && policy.MaxSatoshi == 0 && policy.MaxPerPeerSatoshi == 0 &&
+		policy.MaxFeerate == 0 && policy.ReserveSatoshi == 0 &&
+		len(policy.AllowedPeers) == 0 && len(policy.BlockedPeers) == 0
+}
+
+// check fails with a PolicyError if the channels can't be opened on the node
+// with the given feerate. Channels funded by an external wallet (with
+// `fundchannel_start`) don't touch the node's on-chain funds, so the reserve
+// doesn't apply to them.
+func (policy OpenPolicy) check(b Backend, opens []ChannelOpen, feerate string, externalFunds bool) error {
+	if policy.isEmpty() {
+		return nil
+	}
+
+	for _, open := range opens {
+		if len(policy.AllowedPeers) > 0 && !policy.AllowedPeers[open.PeerId] {
+			return PolicyError{POLICYPEERNOTALLOWED, "peer " + open.PeerId + " is not in the list of allowed peers"}
+		}
+		if policy.BlockedPeers[open.PeerId] {
+			return PolicyError{POLICYPEERBLOCKED, "peer " + open.PeerId + " is blocked"}
+		}
+	}
+
+	// "all" depends on what we have
+	var available int64 = -1
+	needsFunds := policy.ReserveSatoshi > 0 && !externalFunds
+	for _, open := range opens {
+		if open.Satoshi < 0 {
+			needsFunds = true
+		}
+	}
+	if needsFunds {
+		var err error
+		available, err = onchainSatoshi(b)
+		if err != nil {
+			return PolicyError{POLICYRESERVE, "cannot check on-chain funds: " + err.Error()}
+		}
+	}
+
+	var total int64
+	for i := range opens {
+		if opens[i].Satoshi < 0 {
+			opens[i].Satoshi = available
+		}
+		open := opens[i]
+		total += open.Satoshi
+
+		if policy.MinSatoshi > 0 && open.Satoshi < policy.MinSatoshi {
+			return PolicyError{POLICYBELOWMIN, fmt.Sprintf("channel of %d sat is below the minimum of %d sat", open.Satoshi, policy.MinSatoshi)}
+		}
+		if policy.MaxSatoshi > 0 && open.Satoshi > policy.MaxSatoshi {
+			return PolicyError{POLICYABOVEMAX, fmt.Sprintf("channel of %d sat is above the maximum of %d sat", open.Satoshi, policy.MaxSatoshi)}
+		}
+	}
+
+	if policy.MaxFeerate > 0 {
+		perkw, err := feeratePerKw(b, feerate)
+		if err != nil {
+			return PolicyError{POLICYFEERATE, "cannot check feerate: " + err.Error()}
+		}
+		if perkw > policy.MaxFeerate {
+			return PolicyError{POLICYFEERATE, fmt.Sprintf("feerate of %d perkw is above the maximum of %d perkw", perkw, policy.MaxFeerate)}
+		}
+	}
+
+	if policy.MaxPerPeerSatoshi > 0 {
+		opening := make(map[string]int64)
+		for _, open := range opens {
+			opening[open.PeerId] += open.Satoshi
+		}
+		for peerid, satoshi := range opening {
+			existing, err := peerCapacity(b, peerid)
+			if err != nil {
+				return PolicyError{POLICYPEERCAPACITY, "cannot check channels with " + peerid + ": " + err.Error()}
+			}
+			if existing+satoshi > policy.MaxPerPeerSatoshi {
+				return PolicyError{POLICYPEERCAPACITY, fmt.Sprintf("channels with %s would have %d sat, above the maximum of %d sat per peer", peerid, existing+satoshi, policy.MaxPerPeerSatoshi)}
+			}
+		}
+	}
+
+	if policy.ReserveSatoshi > 0 && !externalFunds && available-total < policy.ReserveSatoshi {
+		return PolicyError{POLICYRESERVE, fmt.Sprintf("opening %d sat would leave %d sat on-chain, below the reserve of %d sat", total, available-total, policy.ReserveSatoshi)}
+	}
+
+	return nil
+}
+
+// onchainSatoshi is how much the node has in confirmed outputs.
+func onchainSatoshi(b Backend) (int64, error) {
+	res, err := callNode(b, "listfunds", nil)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, output := range res.Get("outputs").Array() {
+		if output.Get("status").String() != "confirmed" || output.Get("reserved").Bool() {
+			continue
+		}
+		if amount := output.Get("amount_msat"); amount.Exists() {
+			msat, err := parseMsat(amount.String(), true)
+			if err != nil {
+				return 0, err
+			}
+			total += msat / 1000
+		} else {
+			total += output.Get("value").Int()
+		}
+	}
+	return total, nil
+}
+
+// closedStates are the states of channels that don't count towards the
+// capacity with a peer anymore.
+var closedStates = map[string]bool{
+	"CLOSINGD_COMPLETE":   true,
+	"AWAITING_UNILATERAL": true,
+	"FUNDING_SPEND_SEEN":  true,
+	"ONCHAIN":             true,
+	"CLOSED":              true,
+}
+
+// peerCapacity is the total size of the open channels with a peer.
+func peerCapacity(b Backend, peerid string) (int64, error) {
+	channels, err := listChannels(b, peerid)
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, channel := range channels {
+		if closedStates[channel.Get("state").String()] {
+			continue
+		}
+		amount := channel.Get("total_msat")
+		if !amount.Exists() {
+			amount = channel.Get("msatoshi_total")
+		}
+		msat, err := parseMsat(amount.String(), true)
+		if err != nil {
+			return 0, err
+		}
+		total += msat / 1000
+	}
+	return total, nil
+}
+
+// feeratePerKw reads a feerate as given to fundchannel, asking the node for
+// the current estimates of named ones.
+func feeratePerKw(b Backend, feerate string) (int64, error) {
+	feerate = strings.TrimSpace(feerate)
+	if feerate == "" {
+		feerate = "normal"
+	}
+
+	switch {
+	case strings.HasSuffix(feerate, "perkw"):
+		return strconv.ParseInt(strings.TrimSuffix(feerate, "perkw"), 10, 64)
+	case strings.HasSuffix(feerate, "perkb"):
+		perkb, err := strconv.ParseInt(strings.TrimSuffix(feerate, "perkb"), 10, 64)
+		return perkb / 4, err
+	}
+	if perkb, err := strconv.ParseInt(feerate, 10, 64); err == nil {
+		// lightningd's default unit
+		return perkb / 4, nil
+	}
+
+	// newer and older names of each estimate
+	names := map[string][]string{
+		"normal":  {"opening", "normal"},
+		"urgent":  {"unilateral_close", "urgent"},
+		"slow":    {"min_acceptable", "slow"},
+		"minimum": {"min_acceptable"},
+	}[feerate]
+	if names == nil {
+		return 0, errors.New("unknown feerate '" + feerate + "'")
+	}
+
+	res, err := callNode(b, "feerates", map[string]interface{}{"style": "perkw"})
+	if err != nil {
+		return 0, err
+	}
+	for _, name := range names {
+		if rate := res.Get("perkw." + name); rate.Exists() {
+			return rate.Int(), nil
+		}
+	}
+	return 0, errors.New("no estimate for '" + feerate + "'")
+}
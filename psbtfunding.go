@@ -0,0 +1,220 @@
+// Channel opens funded by an external wallet (a hardware wallet, for example)
+// instead of lightningd's own. `connectfund-start` connects to the peer and
+// returns the address the funding output must pay to; the client builds and
+// signs a PSBT with it and gives it to `connectfund-complete`, which secures
+// the commitments with the peer and broadcasts the transaction. Each step
+// emits a `funding-*` event on /stream.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
+)
+
+type PendingOpen struct {
+	PeerId         string `json:"peer_id"`
+	Satoshi        int64  `json:"satoshi"`
+	FundingAddress string `json:"funding_address"`
+	ScriptPubKey   string `json:"scriptpubkey"`
+	ChannelId      string `json:"channel_id,omitempty"`
+	Txid           string `json:"txid,omitempty"`
+	Status         string `json:"status"` // "started", "secured", "broadcast", "canceled" or "failed"
+	Error          string `json:"error,omitempty"`
+	StartedAt      int64  `json:"started_at"`
+}
+
+var (
+	pendingOpensMutex sync.Mutex
+	pendingOpens      = make(map[string]*PendingOpen) // by peer id
+)
+
+func emitFunding(open *PendingOpen) {
+	j, _ := json.Marshal(open)
+	ee <- event{typ: "funding-" + open.Status, data: string(j)}
+}
+
+// lightningd forgets an open started with fundchannel_start once the peer
+// disconnects, so we forget it too.
+func dropPendingOpen(peerid string) {
+	pendingOpensMutex.Lock()
+	open, ok := pendingOpens[peerid]
+	delete(pendingOpens, peerid)
+	pendingOpensMutex.Unlock()
+	if !ok {
+		return
+	}
+
+	open.Status = "canceled"
+	open.Error = "peer disconnected"
+	emitFunding(open)
+}
+
+// prunePendingOpens cancels the opens that weren't completed in ASYNCTIMEOUT.
+func prunePendingOpens(p *plugin.Plugin) {
+	var expired []*PendingOpen
+	pendingOpensMutex.Lock()
+	for peerid, open := range pendingOpens {
+		if time.Since(time.Unix(open.StartedAt, 0)) > ASYNCTIMEOUT {
+			expired = append(expired, open)
+			delete(pendingOpens, peerid)
+		}
+	}
+	pendingOpensMutex.Unlock()
+
+	for _, open := range expired {
+		if _, err := callBackend("fundchannel_cancel", map[string]interface{}{"id": open.PeerId}); err != nil {
+			p.Logf("failed to cancel expired channel open with %s: %s", open.PeerId, err)
+		}
+		open.Status = "canceled"
+		open.Error = "expired"
+		emitFunding(open)
+	}
+}
+
+var connectFundStart = plugin.RPCMethod{
+	"connectfund-start",
+	"peeruri satoshi [feerate] [announce]",
+	"Starts opening a channel to be funded by an external wallet and returns the address the funding output must pay to.",
+	"",
+	func(p *plugin.Plugin, params plugin.Params) (resp interface{}, errCode int, err error) {
+		peeruri := params.Get("peeruri").String()
+		peerid := strings.Split(peeruri, "@")[0]
+		satoshi := params.Get("satoshi").Int()
+		if satoshi <= 0 {
+			return nil, 400, errors.New("satoshi must be a positive amount")
+		}
+
+		if err := openPolicy.check(backend, []ChannelOpen{{peerid, satoshi}}, params.Get("feerate").String(), true); err != nil {
+			return nil, err.(PolicyError).Code, err
+		}
+
+		if _, err := callBackend("connect", []interface{}{peeruri}); err != nil {
+			return nil, 38, errors.New("cannot connect to peer: " + err.Error())
+		}
+
+		args := map[string]interface{}{"id": peerid, "amount": satoshi}
+		if feerate := params.Get("feerate").String(); feerate != "" {
+			args["feerate"] = feerate
+		}
+		if announce := params.Get("announce"); announce.Exists() {
+			args["announce"] = announce.Bool()
+		}
+		res, err := callBackend("fundchannel_start", args)
+		if err != nil {
+			return nil, 37, errors.New("cannot start channel open: " + err.Error())
+		}
+
+		open := &PendingOpen{
+			PeerId:         peerid,
+			Satoshi:        satoshi,
+			FundingAddress: res.Get("funding_address").String(),
+			ScriptPubKey:   res.Get("scriptpubkey").String(),
+			Status:         "started",
+			StartedAt:      time.Now().Unix(),
+		}
+		pendingOpensMutex.Lock()
+		pendingOpens[peerid] = open
+		pendingOpensMutex.Unlock()
+
+		emitFunding(open)
+		return open, 0, nil
+	},
+}
+
+var connectFundComplete = plugin.RPCMethod{
+	"connectfund-complete",
+	"peerid psbt [broadcast]",
+	"Completes a channel open started with connectfund-start given the PSBT with the funding output, signed unless broadcast is false.",
+	"",
+	func(p *plugin.Plugin, params plugin.Params) (resp interface{}, errCode int, err error) {
+		peerid := params.Get("peerid").String()
+		psbt := params.Get("psbt").String()
+		broadcast := true
+		if b := params.Get("broadcast"); b.Exists() {
+			broadcast = b.Bool()
+		}
+
+		// taken out while it's being completed so it can't be completed twice
+		pendingOpensMutex.Lock()
+		open, ok := pendingOpens[peerid]
+		delete(pendingOpens, peerid)
+		pendingOpensMutex.Unlock()
+		if !ok {
+			return nil, 404, errors.New("no channel open was started with this peer")
+		}
+
+		res, err := callBackend("fundchannel_complete", map[string]interface{}{"id": peerid, "psbt": psbt})
+		if err != nil {
+			// lightningd keeps the open going, so it can be tried again with
+			// another PSBT or canceled
+			failed := *open
+			failed.Status = "failed"
+			failed.Error = err.Error()
+			emitFunding(&failed)
+
+			pendingOpensMutex.Lock()
+			pendingOpens[peerid] = open
+			pendingOpensMutex.Unlock()
+			return nil, 37, errors.New("cannot complete channel open: " + err.Error())
+		}
+		open.ChannelId = res.Get("channel_id").String()
+		open.Status = "secured"
+		emitFunding(open)
+
+		if broadcast {
+			sent, err := callBackend("sendpsbt", map[string]interface{}{"psbt": psbt})
+			if err != nil {
+				// the commitments are secured, so it can still be broadcast by
+				// the external wallet
+				open.Error = err.Error()
+				p.Logf("failed to broadcast funding transaction for %s: %s", peerid, err)
+			} else {
+				open.Txid = sent.Get("txid").String()
+				open.Status = "broadcast"
+				emitFunding(open)
+			}
+		}
+
+		retval, errCode, err := getChannel(p, peerid, open.ChannelId)
+		if err != nil {
+			return
+		}
+		retval["funding"] = open
+		return retval, 0, nil
+	},
+}
+
+var connectFundCancel = plugin.RPCMethod{
+	"connectfund-cancel",
+	"peerid",
+	"Cancels a channel open started with connectfund-start.",
+	"",
+	func(p *plugin.Plugin, params plugin.Params) (resp interface{}, errCode int, err error) {
+		peerid := params.Get("peerid").String()
+
+		pendingOpensMutex.Lock()
+		open, ok := pendingOpens[peerid]
+		delete(pendingOpens, peerid)
+		pendingOpensMutex.Unlock()
+		if !ok {
+			return nil, 404, errors.New("no channel open was started with this peer")
+		}
+
+		if _, err := callBackend("fundchannel_cancel", map[string]interface{}{"id": peerid}); err != nil {
+			pendingOpensMutex.Lock()
+			pendingOpens[peerid] = open
+			pendingOpensMutex.Unlock()
+			return nil, 37, errors.New("cannot cancel channel open: " + err.Error())
+		}
+
+		open.Status = "canceled"
+		emitFunding(open)
+		return open, 0, nil
+	},
+}
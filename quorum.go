@@ -0,0 +1,128 @@
+// Operators that can approve calls requiring a quorum.
+// Operators are configured with `sparko-operators` as name:pubkey pairs and
+// approve a pending call by signing the sha256 of the call (see approvalHash)
+// with their secp256k1 key, either as a DER-encoded ECDSA signature or a
+// 64-byte schnorr signature.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+)
+
+type Approval struct {
+	Operator  string `json:"operator"`
+	Signature string `json:"signature"`
+	At        int64  `json:"at"`
+}
+
+var operators = make(map[string]*btcec.PublicKey)
+
+// readOperators parses a comma-separated list of name:pubkey pairs.
+func readOperators(configstr string) (map[string]*btcec.PublicKey, error) {
+	ops := make(map[string]*btcec.PublicKey)
+	for _, entry := range strings.Split(configstr, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		spl := strings.Split(entry, ":")
+		if len(spl) != 2 {
+			return nil, fmt.Errorf("invalid operator '%s', should be 'name:pubkey'", entry)
+		}
+		name := strings.TrimSpace(spl[0])
+		b, err := hex.DecodeString(strings.TrimSpace(spl[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid pubkey for operator '%s'", name)
+		}
+		parse := btcec.ParsePubKey
+		if len(b) == 32 {
+			// x-only, as used with schnorr signatures
+			parse = schnorr.ParsePubKey
+		}
+		pubkey, err := parse(b)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pubkey for operator '%s': %w", name, err)
+		}
+		ops[name] = pubkey
+	}
+	return ops, nil
+}
+
+// addApproval checks the operator signature and adds it to the pending call.
+// must be called with pendingMutex locked.
+func addApproval(pending *PendingCall, operator string, signature string) error {
+	if operator == "" || signature == "" {
+		return fmt.Errorf("this call requires signatures from %d operators", pending.Quorum)
+	}
+
+	pubkey, ok := operators[operator]
+	if !ok {
+		return errors.New("unknown operator '" + operator + "'")
+	}
+	for _, approval := range pending.Approvals {
+		if approval.Operator == operator {
+			return errors.New("operator '" + operator + "' has already approved this call")
+		}
+	}
+
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return errors.New("signature must be hex")
+	}
+	if !verifySignature(pubkey, approvalHash(pending), sig) {
+		return errors.New("invalid signature from operator '" + operator + "'")
+	}
+
+	pending.Approvals = append(pending.Approvals, Approval{
+		Operator:  operator,
+		Signature: signature,
+		At:        time.Now().Unix(),
+	})
+	return nil
+}
+
+// approvalHash is what operators sign: the sha256 of the call id, method,
+// params (as JSON with sorted keys and no whitespace) and node, separated by
+// newlines. so a signature only approves that exact call.
+func approvalHash(pending *PendingCall) []byte {
+	params := &strings.Builder{}
+	encoder := json.NewEncoder(params)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(pending.Request.Params)
+
+	message := strings.Join([]string{
+		pending.Id,
+		pending.Request.Method,
+		strings.TrimSuffix(params.String(), "\n"),
+		pending.Node,
+	}, "\n")
+	hash := sha256.Sum256([]byte(message))
+	return hash[:]
+}
+
+func verifySignature(pubkey *btcec.PublicKey, hash []byte, sig []byte) bool {
+	if len(sig) == 64 {
+		if ssig, err := schnorr.ParseSignature(sig); err == nil {
+			return ssig.Verify(hash, pubkey)
+		}
+		return false
+	}
+
+	esig, err := ecdsa.ParseDERSignature(sig)
+	if err != nil {
+		return false
+	}
+	return esig.Verify(hash, pubkey)
+}
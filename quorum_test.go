@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	lightning "github.com/fiatjaf/lightningd-gjson-rpc"
+	"github.com/tidwall/gjson"
+)
+
+func TestQuorumSignatures(t *testing.T) {
+	aliceKey, _ := testKey(t, "0000000000000000000000000000000000000000000000000000000000000001")
+	bobKey, _ := testKey(t, "0000000000000000000000000000000000000000000000000000000000000002")
+	carolKey, _ := testKey(t, "0000000000000000000000000000000000000000000000000000000000000003")
+
+	var err error
+	defer func(previous map[string]*btcec.PublicKey) { operators = previous }(operators)
+	operators, err = readOperators(strings.Join([]string{
+		"alice:" + hex.EncodeToString(aliceKey.PubKey().SerializeCompressed()),
+		"bob:" + hex.EncodeToString(schnorr.SerializePubKey(bobKey.PubKey())),
+	}, ","))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pending := &PendingCall{
+		Id:      "ab01",
+		Request: lightning.JSONRPCMessage{Method: "withdraw", Params: []interface{}{"bcrt1qdestination", 100000.0}},
+		Quorum:  2,
+	}
+	hash := approvalHash(pending)
+	aliceSig := hex.EncodeToString(ecdsa.Sign(aliceKey, hash).Serialize())
+	bobSchnorr, _ := schnorr.Sign(bobKey, hash)
+	bobSig := hex.EncodeToString(bobSchnorr.Serialize())
+
+	if err := addApproval(pending, "alice", ""); err == nil {
+		t.Error("an approval without a signature was accepted")
+	}
+	if err := addApproval(pending, "carol", hex.EncodeToString(ecdsa.Sign(carolKey, hash).Serialize())); err == nil {
+		t.Error("an approval from an unknown operator was accepted")
+	}
+	if err := addApproval(pending, "bob", aliceSig); err == nil {
+		t.Error("a signature from another key was accepted")
+	}
+	if err := addApproval(pending, "alice", "zz"); err == nil {
+		t.Error("a signature that isn't hex was accepted")
+	}
+
+	// signing the id alone doesn't approve the call
+	idHash := sha256.Sum256([]byte(pending.Id))
+	if err := addApproval(pending, "alice", hex.EncodeToString(ecdsa.Sign(aliceKey, idHash[:]).Serialize())); err == nil {
+		t.Error("a signature of the id alone was accepted")
+	}
+
+	// nor does signing the same id with other params
+	other := *pending
+	other.Request.Params = []interface{}{"bcrt1qattacker", 100000.0}
+	if err := addApproval(&other, "alice", aliceSig); err == nil {
+		t.Error("a signature was accepted for a call with other params")
+	}
+	other = *pending
+	other.Node = "remote"
+	if err := addApproval(&other, "alice", aliceSig); err == nil {
+		t.Error("a signature was accepted for a call to another node")
+	}
+
+	if err := addApproval(pending, "alice", aliceSig); err != nil {
+		t.Errorf("valid ecdsa signature: %s", err)
+	}
+	if err := addApproval(pending, "alice", aliceSig); err == nil {
+		t.Error("the same operator approved twice")
+	}
+	if err := addApproval(pending, "bob", bobSig); err != nil {
+		t.Errorf("valid schnorr signature: %s", err)
+	}
+	if len(pending.Approvals) != 2 {
+		t.Errorf("expected 2 approvals, got %v", pending.Approvals)
+	}
+}
+
+func TestQuorumApproval(t *testing.T) {
+	aliceKey, _ := testKey(t, "0000000000000000000000000000000000000000000000000000000000000001")
+	bobKey, _ := testKey(t, "0000000000000000000000000000000000000000000000000000000000000002")
+	carolKey, _ := testKey(t, "0000000000000000000000000000000000000000000000000000000000000003")
+
+	ln := StartLightningd(t, map[string]interface{}{
+		"sparko-keys": "k",
+		"sparko-operators": strings.Join([]string{
+			"alice:" + hex.EncodeToString(aliceKey.PubKey().SerializeCompressed()),
+			"bob:" + hex.EncodeToString(bobKey.PubKey().SerializeCompressed()),
+			"carol:" + hex.EncodeToString(carolKey.PubKey().SerializeCompressed()),
+		}, ","),
+		"sparko-quorum-rules": "withdraw:2",
+	}, map[string]MethodHandler{
+		"withdraw": func(params gjson.Result) (interface{}, *RPCError) {
+			return map[string]interface{}{"tx": "0200", "txid": "ff01"}, nil
+		},
+	})
+
+	status, res := rpcRequest(t, ln, "k", `{"method": "withdraw", "params": ["bcrt1qdestination", 100000]}`)
+	if status != 202 {
+		t.Fatalf("withdraw should await a quorum: %d %s", status, res.Raw)
+	}
+
+	// operators sign what they see with sparko-pending
+	list, _ := ln.CallPlugin("sparko-pending", nil)
+	var pending PendingCall
+	if err := json.Unmarshal([]byte(list.Get("pending.0").Raw), &pending); err != nil {
+		t.Fatal(err)
+	}
+	sign := func(key *btcec.PrivateKey) string {
+		return hex.EncodeToString(ecdsa.Sign(key, approvalHash(&pending)).Serialize())
+	}
+
+	res, rpcerr := ln.CallPlugin("sparko-approve", []interface{}{pending.Id, "alice", sign(aliceKey)})
+	if rpcerr.Exists() || res.Get("status").String() != "awaiting-approval" || res.Get("approvals").Int() != 1 {
+		t.Errorf("first approval: %s %s", res.Raw, rpcerr.Raw)
+	}
+	if _, rpcerr := ln.CallPlugin("sparko-approve", []interface{}{pending.Id, "bob", sign(aliceKey)}); !rpcerr.Exists() {
+		t.Error("bob approved with alice's signature")
+	}
+	time.Sleep(time.Millisecond * 200)
+	if len(ln.Calls("withdraw")) != 0 {
+		t.Fatal("withdraw was executed before reaching the quorum")
+	}
+
+	res, rpcerr = ln.CallPlugin("sparko-approve", []interface{}{pending.Id, "carol", sign(carolKey)})
+	if rpcerr.Exists() || res.Get("status").String() != "approved" {
+		t.Errorf("second approval: %s %s", res.Raw, rpcerr.Raw)
+	}
+	for i := 0; i < 50 && len(ln.Calls("withdraw")) == 0; i++ {
+		time.Sleep(time.Millisecond * 100)
+	}
+	if len(ln.Calls("withdraw")) != 1 {
+		t.Errorf("withdraw should be executed once the quorum is reached, got %v", ln.Calls("withdraw"))
+	}
+}
@@ -0,0 +1,223 @@
+// Resource-style routes that translate to lightningd calls.
+// These are just sugar over the same methods available at /rpc and are subject
+// to the same permissions.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	lightning "github.com/fiatjaf/lightningd-gjson-rpc"
+	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
+	"github.com/gorilla/mux"
+	"github.com/tidwall/gjson"
+)
+
+var errNotFound = errors.New("not found")
+
+func addRESTRoutes(router *mux.Router) {
+	router.Path("/invoices").Methods("GET").HandlerFunc(
+		restHandler("listinvoices", noParams, nil),
+	)
+	router.Path("/invoices").Methods("POST").HandlerFunc(
+		restHandler("invoice", paramsFromBody, nil),
+	)
+	router.Path("/invoices/{label}").Methods("GET").HandlerFunc(
+		restHandler("listinvoices", func(r *http.Request) (interface{}, error) {
+			return map[string]interface{}{"label": mux.Vars(r)["label"]}, nil
+		}, firstOf("invoices")),
+	)
+	router.Path("/pay").Methods("POST").HandlerFunc(
+		restHandler("pay", paramsFromBody, nil),
+	)
+	router.Path("/channels").Methods("GET").HandlerFunc(
+		handleRESTChannels,
+	)
+	router.Path("/peers/{id}").Methods("GET").HandlerFunc(
+		restHandler("listpeers", func(r *http.Request) (interface{}, error) {
+			return map[string]interface{}{"id": mux.Vars(r)["id"]}, nil
+		}, firstOf("peers")),
+	)
+}
+
+// restHandler builds a handler that calls a single lightningd method with the
+// params given by getParams and optionally transforms the result before
+// returning it.
+func restHandler(
+	method string,
+	getParams func(*http.Request) (interface{}, error),
+	transform func(gjson.Result) (interface{}, error),
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := r.Context().Value("plugin").(*plugin.Plugin)
+
+		if !isAllowed(r, method) {
+			p.Logf("insufficient permissions for '%s' call", method)
+			writeRESTError(w, 401, errors.New("insufficient permissions"))
+			return
+		}
+
+		params, err := getParams(r)
+		if err != nil {
+			writeRESTError(w, 400, err)
+			return
+		}
+
+		req := lightning.JSONRPCMessage{
+			Version: "2.0",
+			Method:  method,
+			Params:  params,
+		}
+
+		node := requestNode(r)
+		b, ok := nodeBackend(node)
+		if !ok {
+			writeRESTError(w, 404, errors.New("unknown node"))
+			return
+		}
+
+		key, _ := r.Context().Value("key").(string)
+		if needsApproval, quorum, amount := requiresApproval(p, key, req); needsApproval {
+			parkCall(w, p, key, r.Header.Get("Idempotency-Key"), node, req, quorum, amount)
+			return
+		}
+
+		respbytes, err := b.Call(callTimeout(method), req)
+		if err != nil {
+			p.Logf("'%s' call returned an error", method)
+			if cmderr, ok := err.(lightning.ErrorCommand); ok {
+				writeRESTError(w, statusFromLightningCode(cmderr.Code), cmderr)
+			} else {
+				writeRESTError(w, 502, err)
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if transform == nil {
+			w.Write(respbytes)
+			return
+		}
+
+		result, err := transform(gjson.ParseBytes(respbytes))
+		if err != nil {
+			if err == errNotFound {
+				writeRESTError(w, 404, err)
+			} else {
+				writeRESTError(w, 500, err)
+			}
+			return
+		}
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+func noParams(r *http.Request) (interface{}, error) {
+	return map[string]interface{}{}, nil
+}
+
+func paramsFromBody(r *http.Request) (interface{}, error) {
+	params := make(map[string]interface{})
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		return nil, errors.New("invalid JSON body")
+	}
+	return params, nil
+}
+
+func firstOf(key string) func(gjson.Result) (interface{}, error) {
+	return func(res gjson.Result) (interface{}, error) {
+		items := res.Get(key).Array()
+		if len(items) == 0 {
+			return nil, errNotFound
+		}
+		return items[0].Value(), nil
+	}
+}
+
+// handleRESTChannels lists the channels of all peers, which are in
+// `listpeerchannels` or inside each peer in `listpeers` depending on the
+// version of the node.
+func handleRESTChannels(w http.ResponseWriter, r *http.Request) {
+	p := r.Context().Value("plugin").(*plugin.Plugin)
+
+	b, ok := nodeBackend(requestNode(r))
+	if !ok {
+		writeRESTError(w, 404, errors.New("unknown node"))
+		return
+	}
+
+	// only the method that will actually be called on this node needs to be allowed
+	method, err := channelsMethod(b)
+	if err != nil {
+		p.Logf("failed to get the node version: %s", err)
+		writeRESTError(w, 502, err)
+		return
+	}
+	if !isAllowed(r, method) {
+		p.Logf("insufficient permissions for %s", method)
+		writeRESTError(w, 401, errors.New("insufficient permissions"))
+		return
+	}
+
+	channels, err := listChannels(b, "")
+	if err != nil {
+		p.Logf("failed to list channels: %s", err)
+		if cmderr, ok := err.(lightning.ErrorCommand); ok {
+			writeRESTError(w, statusFromLightningCode(cmderr.Code), cmderr)
+		} else {
+			writeRESTError(w, 502, err)
+		}
+		return
+	}
+
+	ichannels := make([]interface{}, len(channels))
+	for i, channel := range channels {
+		ichannels[i] = channel.Value()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"channels": ichannels})
+}
+
+func writeRESTError(w http.ResponseWriter, status int, err error) {
+	resterr := LightningError{
+		Type:     "sparko",
+		Name:     "SparkoError",
+		Message:  err.Error(),
+		FullType: "sparko",
+	}
+	if cmderr, ok := err.(lightning.ErrorCommand); ok {
+		resterr = LightningError{
+			Type:     "lightning",
+			Name:     "LightningError",
+			Message:  cmderr.Message,
+			Code:     cmderr.Code,
+			FullType: "lightning",
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resterr)
+}
+
+// statusFromLightningCode maps lightningd error codes to HTTP status codes.
+// see https://github.com/ElementsProject/lightning/blob/master/common/jsonrpc_errors.h
+func statusFromLightningCode(code int) int {
+	switch {
+	case code == -32601: // method not found
+		return 404
+	case code == -32602: // invalid params
+		return 400
+	case code == 900: // invoice label already exists
+		return 409
+	case code == 201: // already paid
+		return 409
+	case code >= 200 && code < 300: // payment errors
+		return 402
+	default:
+		return 500
+	}
+}
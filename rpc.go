@@ -5,7 +5,6 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
-	"time"
 
 	lightning "github.com/fiatjaf/lightningd-gjson-rpc"
 	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
@@ -23,20 +22,98 @@ func handleRPC(w http.ResponseWriter, r *http.Request) {
 	}
 	req.Version = "2.0"
 
+	node := requestNode(r)
+	b, ok := nodeBackend(node)
+	if !ok {
+		p.Logf("call to unknown node '%s'", node)
+		w.WriteHeader(404)
+		return
+	}
+
 	// check permissions
-	if permissions, ok := r.Context().Value("permissions").(map[string]bool); ok {
-		if len(permissions) > 0 {
-			if _, allowed := permissions[req.Method]; !allowed {
-				p.Logf("insufficient permissions for '%s' call", req.Method)
-				w.WriteHeader(401)
-				return
+	if !isAllowed(r, req.Method) {
+		p.Logf("insufficient permissions for '%s' call", req.Method)
+		w.WriteHeader(401)
+		return
+	}
+
+	// channels opened directly must follow the rules too
+	if opens, feerate, isOpen, err := openPolicyRequest(req); isOpen {
+		if err == nil {
+			err = openPolicy.check(b, opens, feerate, req.Method == "fundchannel_start")
+		}
+		if err != nil {
+			p.Logf("'%s' call rejected: %s", req.Method, err)
+			// params we can't read are a bad request, only rejections by the
+			// rules are forbidden
+			status, code := 400, 400
+			if perr, ok := err.(PolicyError); ok {
+				status, code = 403, perr.Code
 			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(LightningError{
+				Type:     "sparko",
+				Name:     "PolicyError",
+				Message:  err.Error(),
+				Code:     code,
+				FullType: "sparko",
+				Request:  &req,
+			})
+			return
+		}
+	}
+
+	// some keys must have their calls approved by an operator, and only keys
+	// given the permission explicitly can act as operators
+	key, _ := r.Context().Value("key").(string)
+	if req.Method == "sparko-approve" || req.Method == "sparko-deny" {
+		if approvalKeys[key] || !isExplicitlyAllowed(r, req.Method) {
+			p.Logf("key %s can't approve or deny calls", keyId(key))
+			w.WriteHeader(401)
+			return
 		}
 	}
+	if needsApproval, quorum, amount := requiresApproval(p, key, req); needsApproval {
+		parkCall(w, p, key, r.Header.Get("Idempotency-Key"), node, req, quorum, amount)
+		return
+	}
 
-	// actually do the call
-	respbytes, err := p.Client.CallMessageRaw(time.Second*30, req)
+	// paginated calls are handled separately
+	if method, ok := paginatedMethods[req.Method]; ok && r.Header.Get("X-Page-Size") != "" {
+		handlePaginated(w, r, p, b, node, req, method)
+		return
+	}
+
+	// async calls return immediately and are executed in the background
+	if async := r.URL.Query().Get("async"); async == "1" || async == "true" {
+		startJob(w, p, key, r.Header.Get("Idempotency-Key"), node, req)
+		return
+	}
+
+	// actually do the call (or get it from the cache or from a previous call
+	// with the same idempotency key)
+	var respbytes []byte
+	if idemkey := r.Header.Get("Idempotency-Key"); idemkey != "" {
+		respbytes, err = callIdempotent(p, keyId(key), idemkey, b, node, req, callTimeout(req.Method))
+	} else {
+		respbytes, err = callCached(p, b, node, req)
+	}
 	if err != nil {
+		if idemerr, ok := err.(IdempotencyError); ok {
+			p.Logf("'%s' call with Idempotency-Key failed: %s", req.Method, idemerr.Message)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(idemerr.Status)
+			json.NewEncoder(w).Encode(LightningError{
+				Type:     "sparko",
+				Name:     "IdempotencyError",
+				Message:  idemerr.Message,
+				FullType: "sparko",
+				Request:  &req,
+			})
+			return
+		}
+
 		p.Logf("'%s' call returned an error", req.Method)
 		w.WriteHeader(500)
 
@@ -48,13 +125,21 @@ func handleRPC(w http.ResponseWriter, r *http.Request) {
 				Message:  cmderr.Message,
 				Code:     cmderr.Code,
 				FullType: "lightning",
-				Request:  req,
+				Request:  &req,
 			})
 		}
 
 		return
 	}
 
+	// filter and select fields if asked to
+	respbytes, err = applyFilters(r, respbytes)
+	if err != nil {
+		p.Logf("failed to filter '%s' response: %s", req.Method, err)
+		w.WriteHeader(400)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 
 	// if we have a "Range" header, try to filter the response
@@ -120,14 +205,14 @@ func handleRPC(w http.ResponseWriter, r *http.Request) {
 	}
 
 sendEverythingWithoutRange:
-	w.Write(respbytes)
+	writeWithETag(w, r, respbytes)
 }
 
 type LightningError struct {
-	Type     string                   `json:"type"`
-	Name     string                   `json:"name"`
-	Message  string                   `json:"message"`
-	Code     int                      `json:"code"`
-	FullType string                   `json:"fullType"`
-	Request  lightning.JSONRPCMessage `json:"request"`
+	Type     string                    `json:"type"`
+	Name     string                    `json:"name"`
+	Message  string                    `json:"message"`
+	Code     int                       `json:"code"`
+	FullType string                    `json:"fullType"`
+	Request  *lightning.JSONRPCMessage `json:"request,omitempty"`
 }
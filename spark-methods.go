@@ -4,10 +4,13 @@
 package main
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
 	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
@@ -22,11 +25,20 @@ var connectFund = plugin.RPCMethod{
 	func(p *plugin.Plugin, params plugin.Params) (resp interface{}, errCode int, err error) {
 		peeruri := params.Get("peeruri").String()
 		peerid := strings.Split(peeruri, "@")[0]
-		p.Client.Call("connect", peeruri)
-
 		satoshi := params.Get("satoshi").String()
 		feerate := params.Get("feerate").String()
-		res, err := p.Client.Call("fundchannel", peerid, satoshi, feerate)
+
+		amount, err := parseOpenAmount(satoshi)
+		if err != nil {
+			return nil, 400, err
+		}
+		if err := openPolicy.check(backend, []ChannelOpen{{peerid, amount}}, feerate, false); err != nil {
+			return nil, err.(PolicyError).Code, err
+		}
+
+		callBackend("connect", []interface{}{peeruri})
+
+		res, err := callBackend("fundchannel", []interface{}{peerid, satoshi, feerate})
 		if err != nil {
 			return nil, 37, errors.New("cannot open channel")
 		}
@@ -37,112 +49,310 @@ var connectFund = plugin.RPCMethod{
 
 var closeGet = plugin.RPCMethod{
 	"closeget",
-	"peeruri chanid force timeout",
+	"peeruri chanid [force] [timeout] [destination] [fee_negotiation_step] [feerange] [wrong_funding]",
 	"",
 	"",
 	func(p *plugin.Plugin, params plugin.Params) (resp interface{}, errCode int, err error) {
-		peerid := params.Get("peerid").String()
+		peerid := strings.Split(params.Get("peeruri").String(), "@")[0]
 		chanid := params.Get("chanid").String()
-		force := params.Get("force").String()
-		timeout := params.Get("timeout").String()
 
-		res, err := p.Client.Call("close", chanid, force, timeout)
+		args, err := closeArgs(p, params)
 		if err != nil {
-			return nil, 37, errors.New("cannot close channel")
+			return nil, 400, err
 		}
 
-		retval, errCode, err := getChannel(p, peerid, res.Get("channel_id").String())
+		// the channel must exist before we try to close it
+		_, before, errCode, err := findPeerChannel(p, peerid, chanid)
 		if err != nil {
 			return
 		}
+		channelId, _ := before["channel_id"].(string)
 
-		retval["closing"] = res.Value()
+		args["id"] = chanid
+		unilateraltimeout, _ := args["unilateraltimeout"].(int64)
+		res, err := callNodeWithTimeout(backend, closeTimeout(unilateraltimeout), "close", args)
+		if err != nil {
+			return nil, 37, errors.New("cannot close channel: " + err.Error())
+		}
+
+		retval, errCode, err := getChannel(p, peerid, channelId)
+		if err != nil {
+			return
+		}
+
+		closing := res.Value().(map[string]interface{})
+		if _, ok := closing["txid"]; !ok {
+			// newer versions may close with many transactions
+			if txids := res.Get("txids").Array(); len(txids) > 0 {
+				closing["txid"] = txids[len(txids)-1].String()
+				closing["tx"] = res.Get("txs." + strconv.Itoa(len(txids)-1)).String()
+			}
+		}
+		retval["closing"] = closing
 		return retval, 0, nil
 	},
 }
 
+var (
+	addressRe      = regexp.MustCompile(`^[a-zA-Z0-9]{14,90}$`)
+	feeStepRe      = regexp.MustCompile(`^([0-9]+)(%?)$`)
+	feerateRe      = regexp.MustCompile(`^([0-9]+)(perkw|perkb)?$`)
+	wrongFundingRe = regexp.MustCompile(`^[0-9a-fA-F]{64}:[0-9]+$`)
+)
+
+// closeTimeout is how long to wait for `close`, which only returns when the
+// peer agrees to close or after going unilateral, so we must wait for longer
+// than that or a channel that was closed would be reported as a timeout.
+func closeTimeout(unilateraltimeout int64) time.Duration {
+	if unilateraltimeout <= 0 {
+		return ASYNCTIMEOUT
+	}
+	return time.Duration(unilateraltimeout)*time.Second + DEFAULTTIMEOUT
+}
+
+// closeArgs validates the closeget params and translates them to the named
+// params of `close`.
+func closeArgs(p *plugin.Plugin, params plugin.Params) (args map[string]interface{}, err error) {
+	args = make(map[string]interface{})
+	if params.Get("chanid").String() == "" {
+		return nil, errors.New("chanid is required")
+	}
+	version := getNodeVersion(p)
+
+	// `force` and `timeout` are from old versions of `close`, now when forced it
+	// goes unilateral after the timeout and otherwise never does
+	timeout := int64(30)
+	if t := params.Get("timeout"); t.Exists() && t.String() != "" {
+		timeout, err = strconv.ParseInt(t.String(), 10, 64)
+		if err != nil || timeout < 0 {
+			return nil, errors.New("timeout must be a number of seconds")
+		}
+	}
+	if force := params.Get("force"); force.Exists() && force.String() != "" {
+		if force.Bool() {
+			if timeout == 0 {
+				timeout = 1
+			}
+			args["unilateraltimeout"] = timeout
+		} else {
+			args["unilateraltimeout"] = 0
+		}
+	}
+
+	if destination := params.Get("destination").String(); destination != "" {
+		if !addressRe.MatchString(destination) {
+			return nil, errors.New("invalid destination address")
+		}
+		args["destination"] = destination
+	}
+
+	if step := params.Get("fee_negotiation_step").String(); step != "" {
+		if err := requireVersion(version, 0, 9, "fee_negotiation_step"); err != nil {
+			return nil, err
+		}
+		m := feeStepRe.FindStringSubmatch(step)
+		if m == nil {
+			return nil, errors.New("fee_negotiation_step must be a number of satoshis or a percentage")
+		}
+		n, _ := strconv.Atoi(m[1])
+		if n == 0 || (m[2] == "%" && n > 100) {
+			return nil, errors.New("fee_negotiation_step must be between 1 and 100%, or a positive number of satoshis")
+		}
+		args["fee_negotiation_step"] = step
+	}
+
+	if feerange := params.Get("feerange"); feerange.Exists() && feerange.Raw != `""` {
+		if err := requireVersion(version, 0, 11, "feerange"); err != nil {
+			return nil, err
+		}
+		rates := feerange.Array()
+		if len(rates) != 2 {
+			return nil, errors.New("feerange must be a list with a minimum and a maximum feerate")
+		}
+		var values [2]int64
+		for i, rate := range rates {
+			switch rate.String() {
+			case "slow", "normal", "urgent":
+				values[i] = -1
+			default:
+				m := feerateRe.FindStringSubmatch(rate.String())
+				if m == nil {
+					return nil, errors.New("invalid feerate '" + rate.String() + "'")
+				}
+				values[i], _ = strconv.ParseInt(m[1], 10, 64)
+				if m[2] == "perkb" {
+					values[i] /= 4
+				}
+			}
+		}
+		if values[0] >= 0 && values[1] >= 0 && values[0] > values[1] {
+			return nil, errors.New("feerange minimum is above its maximum")
+		}
+		args["feerange"] = []interface{}{rates[0].Value(), rates[1].Value()}
+	}
+
+	if wrongFunding := params.Get("wrong_funding").String(); wrongFunding != "" {
+		if err := requireVersion(version, 0, 10, "wrong_funding"); err != nil {
+			return nil, err
+		}
+		if !wrongFundingRe.MatchString(wrongFunding) {
+			return nil, errors.New("wrong_funding must be txid:outnum")
+		}
+		args["wrong_funding"] = wrongFunding
+	}
+
+	return args, nil
+}
+
+// requireVersion fails if the node is known to be older than the version that
+// introduced an option.
+func requireVersion(v CLNVersion, major, minor int, option string) error {
+	if v == (CLNVersion{}) || v.AtLeast(major, minor) {
+		return nil
+	}
+	return fmt.Errorf("%s requires lightningd v%d.%d or newer", option, major, minor)
+}
+
 var listpaysExt = plugin.RPCMethod{
 	"listpaysext",
-	"",
+	"[limit] [offset] [status]",
 	"",
 	"",
 	func(p *plugin.Plugin, params plugin.Params) (resp interface{}, errCode int, err error) {
-		res, err := p.Client.CallWithCustomTimeout(time.Second*30, "listpays")
+		limit := int(params.Get("limit").Int())
+		if limit <= 0 {
+			limit = 30
+		}
+		offset := int(params.Get("offset").Int())
+		if offset < 0 {
+			return nil, 400, errors.New("offset can't be negative")
+		}
+		status := params.Get("status").String()
+		if status != "" && status != "complete" && status != "pending" && status != "failed" {
+			return nil, 400, errors.New("status must be complete, pending or failed")
+		}
+
+		res, err := callBackend("listpays", nil)
 		if err != nil {
 			return nil, 37, errors.New("cannot listpays -- enable the pay plugin")
 		}
 
-		pays := res.Get("pays").Array()
-		// more than 30, we filter
-		if len(pays) > 30 {
-			pays = pays[len(pays)-30:]
+		var pays []gjson.Result
+		for _, pay := range res.Get("pays").Array() {
+			if status == "" || pay.Get("status").String() == status {
+				pays = append(pays, pay)
+			}
 		}
+		total := len(pays)
 
-		retval := make([]interface{}, len(pays))
+		// newest first. old versions don't give us the creation time, but
+		// lightningd lists pays in the order they were created.
+		hasHashes := listpaysHasHashes(getNodeVersion(p))
+		if hasHashes {
+			sort.SliceStable(pays, func(i, j int) bool {
+				return pays[i].Get("created_at").Int() > pays[j].Get("created_at").Int()
+			})
+		} else {
+			for i, j := 0, len(pays)-1; i < j; i, j = i+1, j-1 {
+				pays[i], pays[j] = pays[j], pays[i]
+			}
+		}
 
-		if len(pays) == 0 {
-			return map[string]interface{}{"pays": retval}, 0, nil
+		if offset > len(pays) {
+			offset = len(pays)
+		}
+		pays = pays[offset:]
+		if len(pays) > limit {
+			pays = pays[:limit]
 		}
 
-		// these are not currently available, but be prepared for when they are
-		if pays[0].Get("payment_hash").Exists() && pays[0].Get("created_at").Exists() {
+		retval := make([]interface{}, len(pays))
+		if hasHashes {
 			for i, pay := range pays {
-				retval[i] = pay.Value()
+				retval[i] = normalizePay(pay)
 			}
 		} else {
-			filled := make(chan interface{}, len(pays))
-			for _, pay := range pays {
-				go fillPay(p, pay, filled)
-			}
-			i := 0
-			for fpay := range filled {
-				retval[i] = fpay
-				i++
-			}
+			fillPays(p, pays, retval)
 		}
 
-		return map[string]interface{}{"pays": retval}, 0, nil
+		return map[string]interface{}{
+			"pays":   retval,
+			"total":  total,
+			"offset": offset,
+		}, 0, nil
 	},
 }
 
-func fillPay(p *plugin.Plugin, pay gjson.Result, filled chan<- interface{}) {
-	payv := pay.Value().(map[string]interface{})
-	if pay.Get("status").String() != "complete" {
-		filled <- payv
-		return
-	}
+const LISTPAYSWORKERS = 8
 
-	preimage, _ := hex.DecodeString(pay.Get("preimage").String())
-	hash := sha256.Sum256(preimage)
-	hexhash := hex.EncodeToString(hash[:])
-	payv["payment_hash"] = hexhash
-	res, _ := p.Client.CallNamed("listsendpays", "payment_hash", hexhash)
-	payv["created_at"] = res.Get("payments.0.created_at").Int()
+type payInfo struct {
+	hash      string
+	createdAt int64
+}
+
+var (
+	payInfoMutex sync.Mutex
+	payInfoCache = make(map[string]payInfo) // by bolt11 or preimage
+)
 
-	filled <- payv
+// fillPays adds the payment hash and creation time to pays from old versions,
+// querying lightningd with a few workers for the ones we haven't seen before.
+func fillPays(p *plugin.Plugin, pays []gjson.Result, filled []interface{}) {
+	forEach(len(pays), LISTPAYSWORKERS, func(i int) {
+		filled[i] = fillPay(p, pays[i])
+	})
 }
 
-func getChannel(p *plugin.Plugin, peerid string, channel_id string) (resp map[string]interface{}, errCode int, err error) {
-	res, err := p.Client.Call("listpeers")
-	if err != nil || len(res.Array()) == 0 {
-		return nil, 38, errors.New("cannot find peer")
+func fillPay(p *plugin.Plugin, pay gjson.Result) map[string]interface{} {
+	payv := normalizePay(pay)
+
+	cachekey := pay.Get("bolt11").String()
+	if cachekey == "" {
+		cachekey = pay.Get("preimage").String()
 	}
-	peer := res.Array()[0]
+	if cachekey == "" {
+		return payv
+	}
+
+	payInfoMutex.Lock()
+	info, ok := payInfoCache[cachekey]
+	payInfoMutex.Unlock()
+
+	if !ok {
+		// pays that didn't complete have no preimage to get the hash from
+		hash, _ := payv["payment_hash"].(string)
+		if hash == "" {
+			res, err := callBackend("decodepay", []interface{}{pay.Get("bolt11").String()})
+			if err != nil {
+				return payv
+			}
+			hash = res.Get("payment_hash").String()
+		}
 
-	var channel gjson.Result
-	for _, channel = range peer.Get("channels").Array() {
-		if channel.Get("channel_id").String() == channel_id {
-			goto found
+		res, err := callBackend("listsendpays", map[string]interface{}{"payment_hash": hash})
+		if err != nil || !res.Get("payments.0.created_at").Exists() {
+			return payv
 		}
+		info = payInfo{hash, res.Get("payments.0.created_at").Int()}
+
+		payInfoMutex.Lock()
+		payInfoCache[cachekey] = info
+		payInfoMutex.Unlock()
 	}
-	return nil, 39, errors.New("cannot find channel")
 
-found:
-	ipeer := peer.Value().(map[string]interface{})
-	delete(ipeer, "channels")
+	payv["payment_hash"] = info.hash
+	payv["created_at"] = info.createdAt
+	return payv
+}
+
+func getChannel(p *plugin.Plugin, peerid string, channel_id string) (resp map[string]interface{}, errCode int, err error) {
+	peer, channel, errCode, err := findPeerChannel(p, peerid, channel_id)
+	if err != nil {
+		return nil, errCode, err
+	}
 
 	return map[string]interface{}{
-		"peer": ipeer,
+		"peer": peer,
 		"chan": channel,
 	}, 0, nil
 }
@@ -0,0 +1,155 @@
+// Standalone mode, so sparko can run as its own daemon (restarted or upgraded
+// independently of lightningd, or as a different user or in another container)
+// talking to an existing lightning-rpc socket. Options are the same as in
+// plugin mode and are read from flags or from a config file in lightningd's
+// format. Events come from the companion plugin, see companion.go.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	lightning "github.com/fiatjaf/lightningd-gjson-rpc"
+	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
+)
+
+var standalone bool
+
+// isStandalone tells if we were started by hand instead of by lightningd,
+// which sets LIGHTNINGD_PLUGIN for all its plugins.
+func isStandalone() bool {
+	return os.Getenv("LIGHTNINGD_PLUGIN") == ""
+}
+
+func runStandalone(p *plugin.Plugin) {
+	standalone = true
+
+	flags := flag.NewFlagSet(p.Name, flag.ExitOnError)
+	rpcFile := flags.String("rpc-file", os.Getenv("SPARKO_RPC_FILE"), "path to the lightning-rpc socket")
+	fakeNode := flags.Bool("fake-node", false, "don't connect to lightningd, use an in-memory fake node instead (for development)")
+	conf := flags.String("conf", os.Getenv("SPARKO_CONF"), "config file with sparko options, in the same format as lightningd's config")
+	for _, opt := range p.Options {
+		// so a bare --sparko-allow-cors doesn't take the next argument as its value
+		if opt.Type == "bool" {
+			flags.Bool(opt.Name, false, opt.Description)
+		} else {
+			flags.String(opt.Name, "", opt.Description)
+		}
+	}
+	flags.Parse(os.Args[1:])
+
+	logger := log.New(os.Stderr, "sparko ", log.LstdFlags)
+	p.Log = func(args ...interface{}) { logger.Println(args...) }
+	p.Logf = logger.Printf
+
+	if *fakeNode && *rpcFile == "" {
+		// sparko keeps its data next to the rpc file
+		*rpcFile = filepath.Join(os.TempDir(), "sparko-fake", "lightning-rpc")
+	}
+	if *rpcFile == "" {
+		fmt.Fprintln(os.Stderr, "sparko is meant to be run as a lightningd plugin, or standalone with --rpc-file=<path to lightning-rpc>.")
+		flags.PrintDefaults()
+		os.Exit(1)
+	}
+	rpc, _ := filepath.Abs(*rpcFile)
+
+	// option values, from lowest to highest precedence: defaults, config file, flags
+	values := make(map[string]string)
+	for _, opt := range p.Options {
+		if opt.Default != nil {
+			values[opt.Name] = fmt.Sprintf("%v", opt.Default)
+		}
+	}
+	if *conf != "" {
+		if err := readConfigFile(*conf, values); err != nil {
+			p.Log("Error reading config file: " + err.Error())
+			os.Exit(1)
+		}
+	}
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name != "rpc-file" && f.Name != "conf" && f.Name != "fake-node" {
+			values[f.Name] = f.Value.String()
+		}
+	})
+
+	p.Args = make(plugin.Params)
+	for _, opt := range p.Options {
+		value, ok := values[opt.Name]
+		if !ok {
+			continue
+		}
+		v, err := optionValue(opt, value)
+		if err != nil {
+			p.Logf("Invalid value for %s: %s", opt.Name, err)
+			os.Exit(1)
+		}
+		p.Args[opt.Name] = v
+	}
+
+	p.Client = &lightning.Client{
+		Path:         rpc,
+		LightningDir: filepath.Dir(rpc),
+	}
+	if *fakeNode {
+		backend = NewFakeNode()
+	} else {
+		backend = CLNBackend{p}
+	}
+	info, err := callBackend("getinfo", nil)
+	if err != nil {
+		p.Log("Error connecting to lightningd: " + err.Error())
+		os.Exit(1)
+	}
+	p.Network = info.Get("network").String()
+	p.Logf("running standalone %s, connected to %s", p.Version, info.Get("id").String())
+
+	if _, err := p.Args.String("sparko-companion-socket"); err != nil && !*fakeNode {
+		p.Log("sparko-companion-socket is not set, events won't be available.")
+	}
+
+	p.OnInit(p)
+}
+
+// readConfigFile reads sparko options from a file with option=value lines,
+// ignoring everything else, so the lightningd config itself can be used.
+func readConfigFile(path string, values map[string]string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "sparko-") {
+			continue
+		}
+		spl := strings.SplitN(line, "=", 2)
+		name := strings.TrimSpace(spl[0])
+		value := "true" // flags without values, like `sparko-allow-cors`
+		if len(spl) == 2 {
+			value = strings.TrimSpace(spl[1])
+		}
+		values[name] = value
+	}
+	return scanner.Err()
+}
+
+// optionValue converts a value to the type lightningd would give to the plugin.
+func optionValue(opt plugin.Option, value string) (interface{}, error) {
+	switch opt.Type {
+	case "int":
+		return strconv.Atoi(value)
+	case "bool":
+		return strconv.ParseBool(value)
+	}
+	return value, nil
+}
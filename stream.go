@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
@@ -14,25 +15,51 @@ import (
 type event struct {
 	typ  string
 	data string
+
+	// if set only the streams of the key with this id get the event
+	keyId string
+
+	// the other node it came from, see nodes.go
+	node string
 }
 
-func checkStreamPermission(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if permissions, ok := r.Context().Value("permissions").(map[string]bool); ok {
-			if len(permissions) > 0 {
-				if _, allowed := permissions["stream"]; !allowed {
-					w.WriteHeader(401)
-					return
-				}
-			}
-		}
+type keyStream struct {
+	es          eventsource.EventSource
+	permissions map[string]bool
+}
+
+var (
+	streamsMutex sync.Mutex
+	streams      = make(map[string]keyStream) // by key id
+)
 
-		next.ServeHTTP(w, r)
-	})
+// handleStream serves the events to each key on its own stream, so events
+// meant for a single key (like the results of its async calls) only go to it
+// and each key only gets the events of the nodes it can read. the `X-Node`
+// header doesn't matter here, the stream of a single node is at
+// /nodes/{node}/stream.
+func handleStream(w http.ResponseWriter, r *http.Request) {
+	permissions, _ := r.Context().Value("permissions").(map[string]bool)
+	allowed := canReadNode(permissions, "")
+	for name := range nodes {
+		allowed = allowed || canReadNode(permissions, name)
+	}
+	if !allowed {
+		w.WriteHeader(401)
+		return
+	}
+
+	key, _ := r.Context().Value("key").(string)
+	streamFor(keyId(key), permissions).ServeHTTP(w, r)
 }
 
-func startStreams(p *plugin.Plugin) eventsource.EventSource {
-	id := 1
+func streamFor(keyid string, permissions map[string]bool) eventsource.EventSource {
+	streamsMutex.Lock()
+	defer streamsMutex.Unlock()
+
+	if stream, ok := streams[keyid]; ok {
+		return stream.es
+	}
 
 	es := eventsource.New(
 		&eventsource.Settings{
@@ -50,19 +77,40 @@ func startStreams(p *plugin.Plugin) eventsource.EventSource {
 			}
 		},
 	)
+	streams[keyid] = keyStream{es, permissions}
+
+	go func() {
+		time.Sleep(1 * time.Second)
+		es.SendRetryMessage(3 * time.Second)
+	}()
+
+	return es
+}
+
+func startStreams(p *plugin.Plugin) {
+	id := 1
 
 	ee = make(chan event)
 	go pollRate(p, ee)
 
+	// events from the node
 	go func() {
-		time.Sleep(1 * time.Second)
-		es.SendRetryMessage(3 * time.Second)
+		for e := range backend.Events() {
+			ee <- e
+		}
 	}()
 
+	// events from other nodes
+	mergeNodeEvents(ee)
+
 	go func() {
 		for {
 			time.Sleep(25 * time.Second)
-			es.SendEventMessage("", "keepalive", "")
+			streamsMutex.Lock()
+			for _, stream := range streams {
+				stream.es.SendEventMessage("", "keepalive", "")
+			}
+			streamsMutex.Unlock()
 		}
 	}()
 
@@ -70,13 +118,18 @@ func startStreams(p *plugin.Plugin) eventsource.EventSource {
 		for {
 			select {
 			case e := <-ee:
-				es.SendEventMessage(e.data, e.typ, strconv.Itoa(id))
+				invalidateCache(e.typ)
+				streamsMutex.Lock()
+				for keyid, stream := range streams {
+					if e.keyId == keyid || (e.keyId == "" && canReadNode(stream.permissions, e.node)) {
+						stream.es.SendEventMessage(e.data, e.typ, strconv.Itoa(id))
+					}
+				}
+				streamsMutex.Unlock()
 			}
 			id++
 		}
 	}()
-
-	return es
 }
 
 func pollRate(p *plugin.Plugin, ee chan<- event) {
@@ -0,0 +1,415 @@
+// LNURL-withdraw vouchers, created with the `sparko-voucher-create` method and
+// redeemed by any LNURL wallet. Their redemption state is kept on disk at
+// sparko/vouchers.json inside the lightning dir.
+// https://github.com/lnurl/luds/blob/luds/03.md
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	lightning "github.com/fiatjaf/lightningd-gjson-rpc"
+	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
+	"github.com/gorilla/mux"
+	"github.com/tidwall/gjson"
+)
+
+type Voucher struct {
+	Id          string       `json:"id"`
+	MinMsat     int64        `json:"min_msat"`
+	MaxMsat     int64        `json:"max_msat"`
+	Uses        int          `json:"uses"`
+	Description string       `json:"description"`
+	CreatedAt   int64        `json:"created_at"`
+	ExpiresAt   int64        `json:"expires_at,omitempty"`
+	Redemptions []Redemption `json:"redemptions"`
+}
+
+type Redemption struct {
+	Bolt11    string `json:"bolt11"`
+	Msat      int64  `json:"msat"`
+	Status    string `json:"status"` // "pending", "complete" or "failed"
+	Preimage  string `json:"preimage,omitempty"`
+	Error     string `json:"error,omitempty"`
+	ClaimedAt int64  `json:"claimed_at"`
+}
+
+var (
+	vouchersMutex sync.Mutex
+	vouchers      = make(map[string]*Voucher)
+)
+
+// usesLeft counts redemptions that haven't failed, including pending ones
+// whose outcome is still unknown.
+func (v *Voucher) usesLeft() int {
+	used := 0
+	for _, redemption := range v.Redemptions {
+		if redemption.Status != "failed" {
+			used++
+		}
+	}
+	return v.Uses - used
+}
+
+func (v *Voucher) lnurl() string {
+	return encodeLNURL(lnurlBaseURL + "/lnurlw/" + v.Id)
+}
+
+func (v *Voucher) summary() map[string]interface{} {
+	return map[string]interface{}{
+		"voucher":   v,
+		"uses_left": v.usesLeft(),
+		"url":       lnurlBaseURL + "/lnurlw/" + v.Id,
+		"lnurl":     v.lnurl(),
+	}
+}
+
+func saveVouchers(p *plugin.Plugin) error {
+	path := dataPath(p, "vouchers.json")
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	j, _ := json.Marshal(vouchers)
+	return writeFileAtomic(path, j)
+}
+
+func loadVouchers(p *plugin.Plugin) error {
+	b, err := ioutil.ReadFile(dataPath(p, "vouchers.json"))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	vouchersMutex.Lock()
+	defer vouchersMutex.Unlock()
+	return json.Unmarshal(b, &vouchers)
+}
+
+func addVoucherRoutes(router *mux.Router) {
+	router.Path("/lnurlw/{id}").Methods("GET").HandlerFunc(handleVoucher)
+	router.Path("/lnurlw/{id}/callback").Methods("GET").HandlerFunc(handleVoucherCallback)
+}
+
+// getUsableVoucher must be called with vouchersMutex locked.
+func getUsableVoucher(id string) (*Voucher, error) {
+	voucher, ok := vouchers[id]
+	if !ok {
+		return nil, errors.New("unknown voucher")
+	}
+	if voucher.ExpiresAt != 0 && voucher.ExpiresAt < time.Now().Unix() {
+		return nil, errors.New("voucher has expired")
+	}
+	if voucher.usesLeft() <= 0 {
+		return nil, errors.New("voucher has already been used")
+	}
+	return voucher, nil
+}
+
+func handleVoucher(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	vouchersMutex.Lock()
+	voucher, err := getUsableVoucher(id)
+	vouchersMutex.Unlock()
+	if err != nil {
+		writeLNURLError(w, err.Error())
+		return
+	}
+
+	writeLNURL(w, map[string]interface{}{
+		"tag":                "withdrawRequest",
+		"callback":           baseURL(r) + "/lnurlw/" + id + "/callback",
+		"k1":                 id,
+		"defaultDescription": voucher.Description,
+		"minWithdrawable":    voucher.MinMsat,
+		"maxWithdrawable":    voucher.MaxMsat,
+	})
+}
+
+func handleVoucherCallback(w http.ResponseWriter, r *http.Request) {
+	p := r.Context().Value("plugin").(*plugin.Plugin)
+	id := mux.Vars(r)["id"]
+	if r.URL.Query().Get("k1") != id {
+		writeLNURLError(w, "invalid k1")
+		return
+	}
+
+	bolt11 := r.URL.Query().Get("pr")
+	inv, err := callBackend("decodepay", []interface{}{bolt11})
+	if err != nil {
+		writeLNURLError(w, "invalid invoice")
+		return
+	}
+	amount, err := parseMsat(inv.Get("amount_msat").String(), true)
+	if err != nil || amount == 0 {
+		writeLNURLError(w, "invoice must have an amount")
+		return
+	}
+
+	// reserve a use of the voucher before paying
+	vouchersMutex.Lock()
+	voucher, err := getUsableVoucher(id)
+	if err != nil {
+		vouchersMutex.Unlock()
+		writeLNURLError(w, err.Error())
+		return
+	}
+	if amount < voucher.MinMsat || amount > voucher.MaxMsat {
+		vouchersMutex.Unlock()
+		writeLNURLError(w, "amount out of bounds")
+		return
+	}
+	voucher.Redemptions = append(voucher.Redemptions, Redemption{
+		Bolt11:    bolt11,
+		Msat:      amount,
+		Status:    "pending",
+		ClaimedAt: time.Now().Unix(),
+	})
+	index := len(voucher.Redemptions) - 1
+	err = saveVouchers(p)
+	vouchersMutex.Unlock()
+	if err != nil {
+		p.Log("failed to save vouchers: " + err.Error())
+		writeLNURLError(w, "internal error")
+		return
+	}
+
+	go payVoucher(p, id, index, bolt11)
+
+	writeLNURL(w, map[string]interface{}{"status": "OK"})
+}
+
+func payVoucher(p *plugin.Plugin, id string, index int, bolt11 string) {
+	res, err := callNodeWithTimeout(backend, ASYNCTIMEOUT, "pay", []interface{}{bolt11})
+	if err != nil {
+		if _, ok := err.(lightning.ErrorCommand); !ok {
+			// we don't know if the payment went through (a timeout, maybe), so
+			// the redemption stays pending until resolvePendingVouchers finds
+			// it with listpays
+			p.Logf("unknown outcome paying voucher %s: %s", id, err)
+			return
+		}
+		p.Logf("failed to pay voucher %s: %s", id, err)
+	}
+
+	vouchersMutex.Lock()
+	redemption := &vouchers[id].Redemptions[index]
+	if redemption.Status != "pending" {
+		// already resolved by resolvePendingVouchers
+		vouchersMutex.Unlock()
+		return
+	}
+	if err != nil {
+		redemption.Status = "failed"
+		redemption.Error = err.Error()
+	} else {
+		redemption.Status = "complete"
+		redemption.Preimage = res.Get("payment_preimage").String()
+	}
+	ev := finishRedemption(p, id, index)
+	vouchersMutex.Unlock()
+
+	ee <- ev
+}
+
+// finishRedemption saves a redemption that left the pending state and returns
+// the event to be emitted. must be called with vouchersMutex locked.
+func finishRedemption(p *plugin.Plugin, id string, index int) event {
+	voucher := vouchers[id]
+	redemption := voucher.Redemptions[index]
+	if err := saveVouchers(p); err != nil {
+		p.Log("failed to save vouchers: " + err.Error())
+	}
+	j, _ := json.Marshal(map[string]interface{}{
+		"id":         id,
+		"redemption": redemption,
+		"uses_left":  voucher.usesLeft(),
+	})
+
+	if redemption.Status == "failed" {
+		return event{typ: "voucher-failed", data: string(j)}
+	}
+	return event{typ: "voucher-claimed", data: string(j)}
+}
+
+// payOutcome finds what happened to the payment of an invoice with listpays:
+// "complete" (with the successful pay), "pending", "failed" when every attempt
+// has failed or "" when it was never attempted.
+func payOutcome(bolt11 string) (status string, pay gjson.Result, err error) {
+	res, err := callBackend("listpays", []interface{}{bolt11})
+	if err != nil {
+		return "", pay, err
+	}
+
+	for _, attempt := range res.Get("pays").Array() {
+		switch attempt.Get("status").String() {
+		case "complete":
+			return "complete", attempt, nil
+		case "pending":
+			status = "pending"
+		default:
+			if status == "" {
+				status = "failed"
+			}
+		}
+	}
+	return status, pay, nil
+}
+
+// resolvePendingVouchers checks with listpays the redemptions whose payment
+// outcome wasn't known when `pay` returned, so they don't hold a use of the
+// voucher forever.
+func resolvePendingVouchers(p *plugin.Plugin) {
+	type pending struct {
+		id     string
+		index  int
+		bolt11 string
+		at     int64
+	}
+
+	vouchersMutex.Lock()
+	var list []pending
+	for id, voucher := range vouchers {
+		for i, redemption := range voucher.Redemptions {
+			if redemption.Status == "pending" {
+				list = append(list, pending{id, i, redemption.Bolt11, redemption.ClaimedAt})
+			}
+		}
+	}
+	vouchersMutex.Unlock()
+
+	for _, item := range list {
+		status, pay, err := payOutcome(item.bolt11)
+		if err != nil {
+			p.Logf("failed to check voucher %s payment: %s", item.id, err)
+			continue
+		}
+		if status == "" && time.Since(time.Unix(item.at, 0)) > ASYNCTIMEOUT {
+			// the payment never even started
+			status = "failed"
+		}
+		if status == "" || status == "pending" {
+			continue
+		}
+		preimage := pay.Get("preimage").String()
+
+		vouchersMutex.Lock()
+		redemption := &vouchers[item.id].Redemptions[item.index]
+		if redemption.Status != "pending" {
+			vouchersMutex.Unlock()
+			continue
+		}
+		redemption.Status = status
+		redemption.Preimage = preimage
+		if status == "failed" {
+			redemption.Error = "payment failed"
+		}
+		ev := finishRedemption(p, item.id, item.index)
+		vouchersMutex.Unlock()
+
+		ee <- ev
+	}
+}
+
+var sparkoVoucherCreate = plugin.RPCMethod{
+	"sparko-voucher-create",
+	"amount_msat [uses] [expiry] [description] [min_msat]",
+	"Create an LNURL-withdraw voucher for up to amount_msat that can be redeemed a number of times (default 1) until expiry seconds from now.",
+	"",
+	func(p *plugin.Plugin, params plugin.Params) (resp interface{}, errCode int, err error) {
+		if lnurlBaseURL == "" {
+			return nil, 400, errors.New("sparko-lnurl-base-url must be set to create vouchers")
+		}
+
+		amount := params.Get("amount_msat").Int()
+		if amount <= 0 {
+			return nil, 400, errors.New("invalid amount_msat")
+		}
+		uses := int(params.Get("uses").Int())
+		if uses <= 0 {
+			uses = 1
+		}
+		min := params.Get("min_msat").Int()
+		if min <= 0 || min > amount {
+			min = amount
+		}
+		description := params.Get("description").String()
+		if description == "" {
+			description = "Voucher"
+		}
+
+		random := make([]byte, 32)
+		rand.Read(random)
+		now := time.Now()
+		voucher := &Voucher{
+			Id:          hex.EncodeToString(random),
+			MinMsat:     min,
+			MaxMsat:     amount,
+			Uses:        uses,
+			Description: description,
+			CreatedAt:   now.Unix(),
+			Redemptions: make([]Redemption, 0),
+		}
+		if expiry := params.Get("expiry").Int(); expiry > 0 {
+			voucher.ExpiresAt = now.Add(time.Second * time.Duration(expiry)).Unix()
+		}
+
+		vouchersMutex.Lock()
+		defer vouchersMutex.Unlock()
+		vouchers[voucher.Id] = voucher
+		if err := saveVouchers(p); err != nil {
+			delete(vouchers, voucher.Id)
+			return nil, 500, err
+		}
+
+		return voucher.summary(), 0, nil
+	},
+}
+
+var sparkoVoucherList = plugin.RPCMethod{
+	"sparko-voucher-list",
+	"",
+	"List LNURL-withdraw vouchers and their redemptions.",
+	"",
+	func(p *plugin.Plugin, params plugin.Params) (resp interface{}, errCode int, err error) {
+		vouchersMutex.Lock()
+		defer vouchersMutex.Unlock()
+
+		list := make([]interface{}, 0, len(vouchers))
+		for _, voucher := range vouchers {
+			list = append(list, voucher.summary())
+		}
+		return map[string]interface{}{"vouchers": list}, 0, nil
+	},
+}
+
+var sparkoVoucherRevoke = plugin.RPCMethod{
+	"sparko-voucher-revoke",
+	"id",
+	"Revoke an LNURL-withdraw voucher so it can't be redeemed anymore.",
+	"",
+	func(p *plugin.Plugin, params plugin.Params) (resp interface{}, errCode int, err error) {
+		vouchersMutex.Lock()
+		defer vouchersMutex.Unlock()
+
+		voucher, ok := vouchers[params.Get("id").String()]
+		if !ok {
+			return nil, 404, errors.New("unknown voucher")
+		}
+		voucher.ExpiresAt = time.Now().Unix() - 1
+		if err := saveVouchers(p); err != nil {
+			return nil, 500, err
+		}
+		return voucher.summary(), 0, nil
+	},
+}
@@ -0,0 +1,296 @@
+// Nostr zaps for LNURL-pay. Zap requests sent to the LNURL-pay callback are
+// remembered by invoice label and, once the invoice is paid, a zap receipt is
+// signed and published to the relays listed in the request. Pending zap
+// requests and the key that signs receipts are kept on disk at
+// sparko/zaps.json inside the lightning dir.
+// https://github.com/nostr-protocol/nips/blob/master/57.md
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	ZAPREQUESTKIND   = 9734
+	ZAPRECEIPTKIND   = 9735
+	ZAPREQUESTEXPIRY = time.Hour * 24 * 8 // a bit more than the default invoice expiry
+	MAXZAPRELAYS     = 5
+)
+
+type ZapRequest struct {
+	Request   string `json:"request"` // the zap request event, exactly as received
+	CreatedAt int64  `json:"created_at"`
+}
+
+var (
+	zapsEnabled bool
+	zapKey      *btcec.PrivateKey
+
+	zapsMutex   sync.Mutex
+	zapRequests = make(map[string]ZapRequest)
+
+	privateNets = parseCIDRs(
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8",
+		"169.254.0.0/16", "172.16.0.0/12", "192.168.0.0/16",
+		"::/128", "::1/128", "fc00::/7", "fe80::/10",
+	)
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, nets[i], _ = net.ParseCIDR(cidr)
+	}
+	return nets
+}
+
+type zapsData struct {
+	Key      string                `json:"key"`
+	Requests map[string]ZapRequest `json:"requests"`
+}
+
+func zapPubKey() string {
+	return hex.EncodeToString(zapKey.PubKey().SerializeCompressed()[1:])
+}
+
+// saveZaps must be called with zapsMutex locked.
+func saveZaps(p *plugin.Plugin) error {
+	for label, zr := range zapRequests {
+		if time.Since(time.Unix(zr.CreatedAt, 0)) > ZAPREQUESTEXPIRY {
+			delete(zapRequests, label)
+		}
+	}
+
+	path := dataPath(p, "zaps.json")
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	j, _ := json.Marshal(zapsData{
+		Key:      hex.EncodeToString(zapKey.Serialize()),
+		Requests: zapRequests,
+	})
+	return writeFileAtomic(path, j)
+}
+
+// loadZaps reads the key and pending zap requests, creating a new key on the
+// first run.
+func loadZaps(p *plugin.Plugin) error {
+	zapsMutex.Lock()
+	defer zapsMutex.Unlock()
+
+	b, err := ioutil.ReadFile(dataPath(p, "zaps.json"))
+	if os.IsNotExist(err) {
+		zapKey, err = btcec.NewPrivateKey()
+		if err != nil {
+			return err
+		}
+		return saveZaps(p)
+	} else if err != nil {
+		return err
+	}
+
+	var data zapsData
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+	skb, err := hex.DecodeString(data.Key)
+	if err != nil || len(skb) != 32 {
+		return errors.New("invalid zaps key")
+	}
+	zapKey, _ = btcec.PrivKeyFromBytes(skb)
+	if data.Requests != nil {
+		zapRequests = data.Requests
+	}
+	return nil
+}
+
+// parseZapRequest validates a zap request sent to the LNURL-pay callback.
+func parseZapRequest(nostr string, amount int64) (*NostrEvent, error) {
+	var zr NostrEvent
+	if err := json.Unmarshal([]byte(nostr), &zr); err != nil {
+		return nil, errors.New("invalid zap request")
+	}
+	if zr.Kind != ZAPREQUESTKIND || !zr.CheckSignature() {
+		return nil, errors.New("invalid zap request")
+	}
+
+	var ps, es int
+	for _, tag := range zr.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+		switch tag[0] {
+		case "p":
+			ps++
+		case "e":
+			es++
+		case "amount":
+			if requested, err := strconv.ParseInt(tag[1], 10, 64); err != nil || requested != amount {
+				return nil, errors.New("zap request amount doesn't match")
+			}
+		}
+	}
+	if ps != 1 || es > 1 {
+		return nil, errors.New("zap request must have one p tag and at most one e tag")
+	}
+	if len(zapRelays(zr.Tags)) == 0 {
+		return nil, errors.New("zap request has no wss:// relays")
+	}
+
+	return &zr, nil
+}
+
+func saveZapRequest(p *plugin.Plugin, label string, nostr string) error {
+	zapsMutex.Lock()
+	defer zapsMutex.Unlock()
+
+	zapRequests[label] = ZapRequest{Request: nostr, CreatedAt: time.Now().Unix()}
+	return saveZaps(p)
+}
+
+// publishZapReceipt is called for every paid invoice and publishes a receipt
+// if the invoice was created for a zap request.
+func publishZapReceipt(p *plugin.Plugin, inv gjson.Result) {
+	if !zapsEnabled {
+		return
+	}
+
+	label := inv.Get("label").String()
+	zapsMutex.Lock()
+	zr, ok := zapRequests[label]
+	if ok {
+		delete(zapRequests, label)
+		if err := saveZaps(p); err != nil {
+			p.Log("failed to save zap requests: " + err.Error())
+		}
+	}
+	zapsMutex.Unlock()
+	if !ok {
+		return
+	}
+
+	var request NostrEvent
+	json.Unmarshal([]byte(zr.Request), &request)
+
+	receipt := NostrEvent{
+		CreatedAt: inv.Get("paid_at").Int(),
+		Kind:      ZAPRECEIPTKIND,
+	}
+	if receipt.CreatedAt == 0 {
+		receipt.CreatedAt = time.Now().Unix()
+	}
+	for _, tag := range request.Tags {
+		if len(tag) >= 2 && (tag[0] == "p" || tag[0] == "e" || tag[0] == "a") {
+			receipt.Tags = append(receipt.Tags, []string{tag[0], tag[1]})
+		}
+	}
+	receipt.Tags = append(receipt.Tags,
+		[]string{"P", request.PubKey},
+		[]string{"bolt11", inv.Get("bolt11").String()},
+		[]string{"description", zr.Request},
+		[]string{"preimage", inv.Get("payment_preimage").String()},
+	)
+	if err := receipt.Sign(zapKey); err != nil {
+		p.Log("failed to sign zap receipt: " + err.Error())
+		return
+	}
+
+	for _, relay := range zapRelays(request.Tags) {
+		go func(relay string) {
+			if !isPublicRelay(relay) {
+				p.Logf("not publishing zap receipt for %s to %s: not a public address", label, relay)
+				return
+			}
+			if err := publishOnce(relay, publicDialer, &receipt); err != nil {
+				p.Logf("failed to publish zap receipt for %s to %s: %s", label, relay, err)
+			}
+		}(relay)
+	}
+}
+
+// zapRelays are the relays listed in a zap request we will publish the
+// receipt to: only wss:// ones and at most MAXZAPRELAYS, so a zap request
+// can't make us connect to an unbounded number of places.
+func zapRelays(tags [][]string) []string {
+	var relays []string
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		if len(tag) < 2 || tag[0] != "relays" {
+			continue
+		}
+		for _, relay := range tag[1:] {
+			u, err := url.Parse(relay)
+			if err != nil || u.Scheme != "wss" || u.Hostname() == "" || seen[relay] {
+				continue
+			}
+			seen[relay] = true
+			relays = append(relays, relay)
+			if len(relays) == MAXZAPRELAYS {
+				return relays
+			}
+		}
+	}
+	return relays
+}
+
+// isPublicRelay tells if all the addresses of a relay are public ones, so
+// zap requests can't be used to reach the node's local network.
+func isPublicRelay(relay string) bool {
+	u, err := url.Parse(relay)
+	if err != nil {
+		return false
+	}
+	ips, err := net.LookupIP(u.Hostname())
+	if err != nil || len(ips) == 0 {
+		return false
+	}
+	for _, ip := range ips {
+		if isPrivateIP(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func isPrivateIP(ip net.IP) bool {
+	for _, private := range privateNets {
+		if private.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// publicDialer only connects to public addresses. the address is checked
+// again right before connecting, as the name of a relay could resolve to a
+// private one by then.
+var publicDialer = &net.Dialer{
+	Timeout: time.Second * 10,
+	Control: func(network, address string, _ syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(host); ip == nil || isPrivateIP(ip) {
+			return fmt.Errorf("%s is not a public address", host)
+		}
+		return nil
+	},
+}